@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/diwise/messaging-golang/pkg/messaging"
+)
+
+// consumers wraps the message handlers that are registered with the messaging
+// context so that shutdown can wait for them before the connection is closed.
+//
+// The messaging context acks a message as soon as it has been passed to the
+// handlers, and can neither cancel a consumer nor requeue a message. A message
+// that arrives during shutdown is therefore handled like any other, since it
+// would be lost if it was skipped, and stop waits for it as well.
+type consumers struct {
+	mu       sync.Mutex
+	inflight int
+	idle     chan struct{}
+}
+
+func (c *consumers) enter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inflight++
+}
+
+func (c *consumers) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inflight--
+
+	if c.inflight == 0 && c.idle != nil {
+		close(c.idle)
+		c.idle = nil
+	}
+}
+
+func (c *consumers) command(handler messaging.CommandHandler) messaging.CommandHandler {
+	return func(ctx context.Context, cmd messaging.IncomingCommand, logger *slog.Logger) error {
+		c.enter()
+		defer c.leave()
+
+		return handler(ctx, cmd, logger)
+	}
+}
+
+func (c *consumers) topic(handler messaging.TopicMessageHandler) messaging.TopicMessageHandler {
+	return func(ctx context.Context, msg messaging.IncomingTopicMessage, logger *slog.Logger) {
+		c.enter()
+		defer c.leave()
+
+		handler(ctx, msg, logger)
+	}
+}
+
+// stop waits until no handler is running, including the handlers of messages
+// that arrive while it waits, or for the context to be cancelled
+func (c *consumers) stop(ctx context.Context) error {
+	c.mu.Lock()
+	if c.inflight == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+	}
+	idle := c.idle
+	c.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestMessagesThatArriveDuringShutdownAreHandled(t *testing.T) {
+	is := is.New(t)
+
+	c := &consumers{}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	handled := []string{}
+
+	handler := c.topic(func(ctx context.Context, msg messaging.IncomingTopicMessage, logger *slog.Logger) {
+		started <- struct{}{}
+		<-release
+
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, string(msg.Body()))
+	})
+
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	deliver := func(body string) {
+		go handler(t.Context(), &messaging.IncomingTopicMessageMock{
+			BodyFunc: func() []byte { return []byte(body) },
+		}, l)
+		<-started
+	}
+
+	deliver("first")
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.stop(context.Background()) }()
+
+	// the messaging context has already acked a message that arrives while
+	// the handlers are drained, so it must be handled rather than skipped
+	deliver("second")
+
+	select {
+	case <-stopped:
+		t.Fatal("stop should wait for the messages that are being handled")
+	default:
+	}
+
+	close(release)
+
+	is.NoErr(<-stopped)
+
+	mu.Lock()
+	defer mu.Unlock()
+	is.Equal(len(handled), 2) // no message should have been dropped
+}
+
+func TestStopIsCancelledWithTheContext(t *testing.T) {
+	is := is.New(t)
+
+	c := &consumers{}
+
+	release := make(chan struct{})
+	defer close(release)
+
+	started := make(chan struct{})
+	handler := c.command(func(ctx context.Context, cmd messaging.IncomingCommand, logger *slog.Logger) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	go handler(t.Context(), nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	is.Equal(c.stop(ctx), context.Canceled)
+}
@@ -10,13 +10,19 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/diwise/iot-core/internal/pkg/application"
 	"github.com/diwise/iot-core/internal/pkg/application/functions"
 	"github.com/diwise/iot-core/internal/pkg/application/measurements"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
 	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
 	"github.com/diwise/iot-core/internal/pkg/presentation/api"
+	"github.com/diwise/iot-core/internal/pkg/presentation/api/auth"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/iot-device-mgmt/pkg/client"
 	"github.com/diwise/messaging-golang/pkg/messaging"
@@ -33,12 +39,30 @@ const serviceName string = "iot-core"
 var tracer = otel.Tracer(serviceName)
 var functionsConfigPath string
 
+const defaultFunctionsConfigPath string = "/opt/diwise/config/functions.csv"
+
+// shutdownTimeout is how long the service waits for requests and messages
+// that are being handled to finish when it is stopped
+const shutdownTimeout time.Duration = 20 * time.Second
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(validateConfig(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	// exit with exitCode once the deferred calls below have closed everything
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	serviceVersion := buildinfo.SourceVersion()
 	ctx, _, cleanup := o11y.Init(context.Background(), serviceName, serviceVersion, "json")
 	defer cleanup()
 
-	flag.StringVar(&functionsConfigPath, "functions", "/opt/diwise/config/functions.csv", "configuration file for functions")
+	flag.StringVar(&functionsConfigPath, "functions", defaultFunctionsConfigPath, "configuration file for functions (yaml, json or csv)")
 	flag.Parse()
 
 	var err error
@@ -48,31 +72,71 @@ func main() {
 
 	measurementsClient := createMeasurementsClientOrDie(ctx)
 
+	// the messaging context is closed by the shutdown func returned by initialize
 	msgCtx := createMessagingContextOrDie(ctx)
-	defer msgCtx.Close()
 
 	storage := createDatabaseConnectionOrDie(ctx)
+	defer storage.Close()
 
-	var configFile *os.File
+	var config io.Reader
 
 	if functionsConfigPath != "" {
-		configFile, err = os.Open(functionsConfigPath)
+		configFile, err := os.Open(functionsConfigPath)
 		if err != nil {
 			fatal(ctx, "failed to open functions config file", err)
 		}
 		defer configFile.Close()
+
+		config = configFile
 	}
 
-	_, api_, err := initialize(ctx, dmClient, measurementsClient, msgCtx, configFile, storage)
+	authenticator := createAuthenticatorOrDie(ctx)
+
+	// the background work of the service stops when runCtx is cancelled
+	runCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdown, api_, err := initialize(runCtx, dmClient, measurementsClient, msgCtx, config, storage, authenticator)
 	if err != nil {
 		fatal(ctx, "initialization failed", err)
 	}
 
 	servicePort := env.GetVariableOrDefault(ctx, "SERVICE_PORT", "8080")
-	err = http.ListenAndServe(":"+servicePort, api_.Router())
+	server := &http.Server{Addr: ":" + servicePort, Handler: api_.Router()}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	logger := logging.GetFromContext(ctx)
+
+	select {
+	case <-runCtx.Done():
+		logger.Info("shutting down")
+	case err = <-serverErr:
+		logger.Error("request router failed, shutting down", "err", err.Error())
+		exitCode = 1
+		stop()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
 	if err != nil {
-		fatal(ctx, "failed to start request router", err)
+		logger.Error("failed to shut down request router", "err", err.Error())
+		exitCode = 1
 	}
+
+	err = shutdown(shutdownCtx)
+	if err != nil {
+		logger.Error("failed to shut down cleanly", "err", err.Error())
+		exitCode = 1
+	}
+
+	// the database is closed by the deferred calls
+	logger.Info("shutdown complete")
 }
 
 func createDeviceManagementClientOrDie(ctx context.Context) client.DeviceManagementClient {
@@ -131,22 +195,103 @@ func createDatabaseConnectionOrDie(ctx context.Context) database.Storage {
 	return storage
 }
 
-func initialize(ctx context.Context, dmClient client.DeviceManagementClient, mClient measurements.MeasurementsClient, msgctx messaging.MsgContext, fconfig io.Reader, storage database.Storage) (application.App, api.API, error) {
-	functionsRegistry, err := functions.NewRegistry(ctx, fconfig, storage)
+func createAuthenticatorOrDie(ctx context.Context) func(http.Handler) http.Handler {
+	var keys auth.KeySource
+	var err error
+
+	if jwksFile := env.GetVariableOrDefault(ctx, "AUTH_JWKS_FILE", ""); jwksFile != "" {
+		keys, err = auth.NewFileKeySource(jwksFile)
+		if err != nil {
+			fatal(ctx, "failed to load key set", err)
+		}
+	} else if jwksURL := env.GetVariableOrDefault(ctx, "AUTH_JWKS_URL", ""); jwksURL != "" {
+		keys = auth.NewRemoteKeySource(ctx, jwksURL)
+	} else {
+		// authentication is opt-in to not break existing deployments, but an
+		// unprotected API should never go unnoticed
+		logging.GetFromContext(ctx).Warn("!!! AUTH_JWKS_URL and AUTH_JWKS_FILE are not set, the API is NOT protected and gives anyone access to all tenants !!!")
+		return auth.NewAllowAllAuthenticator()
+	}
+
+	issuer := env.GetVariableOrDefault(ctx, "AUTH_ISSUER", "")
+	tenantsClaim := env.GetVariableOrDefault(ctx, "AUTH_TENANTS_CLAIM", "tenants")
+
+	return auth.NewAuthenticator(ctx, keys, issuer, tenantsClaim)
+}
+
+// initialize creates the application and its API, and starts the background
+// work that runs until ctx is cancelled. The returned shutdown func waits for
+// the background work to finish and for the messages that are being handled,
+// and saves the state of all functions before it closes msgctx. It should be
+// called once ctx has been cancelled.
+func initialize(ctx context.Context, dmClient client.DeviceManagementClient, mClient measurements.MeasurementsClient, msgctx messaging.MsgContext, fconfig io.Reader, storage database.Storage, authenticator func(http.Handler) http.Handler) (func(context.Context) error, api.API, error) {
+	clk := clock.New()
+
+	functionsRegistry, err := functions.NewRegistry(ctx, fconfig, storage, clk)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	app := application.New(dmClient, mClient, functionsRegistry)
 
+	var background sync.WaitGroup
+
+	scheduler := functions.NewScheduler(functionsRegistry, msgctx, clk, functions.DefaultTickInterval)
+	background.Go(func() { scheduler.Run(ctx) })
+
+	if functionsConfigPath != "" {
+		reloader := newConfigReloader(functionsConfigPath, functionsRegistry)
+		background.Go(func() { reloader.Run(ctx) })
+	}
+
+	consuming := &consumers{}
+
 	msgctx.RegisterCommandHandler(func(m messaging.Message) bool {
 		return strings.HasPrefix(m.ContentType(), "application/vnd.oma.lwm2m")
-	}, newCommandHandler(msgctx, app))
+	}, consuming.command(newCommandHandler(msgctx, app)))
+
+	msgctx.RegisterTopicMessageHandler("message.accepted", consuming.topic(newTopicMessageHandler(msgctx, app)))
+	msgctx.RegisterTopicMessageHandler("function.updated", consuming.topic(newFunctionUpdatedTopicMessageHandler(msgctx)))
+
+	shutdown := func(shutdownCtx context.Context) error {
+		// msgctx stays open until the end, so that the messages that are
+		// being handled, and the scheduler until it has stopped, can still
+		// publish what they produce
+		defer msgctx.Close()
+
+		// the scheduler publishes function updates that are consumed by this
+		// service, so it is stopped before the message handlers are drained
+		finished := make(chan struct{})
+		go func() {
+			background.Wait()
+			close(finished)
+		}()
+
+		select {
+		case <-finished:
+		case <-shutdownCtx.Done():
+			return fmt.Errorf("failed to wait for background work to finish: %w", shutdownCtx.Err())
+		}
+
+		err := consuming.stop(shutdownCtx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for message handlers to return: %w", err)
+		}
 
-	msgctx.RegisterTopicMessageHandler("message.accepted", newTopicMessageHandler(msgctx, app))
-	msgctx.RegisterTopicMessageHandler("function.updated", newFunctionUpdatedTopicMessageHandler(msgctx))
+		err = app.Shutdown(shutdownCtx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for messages to be handled: %w", err)
+		}
+
+		err = functionsRegistry.SaveStates(shutdownCtx)
+
+		// messages that arrive after the handlers have been drained are
+		// handled by their consumers, and save their own state, so they are
+		// waited for as well before msgctx is closed
+		return errors.Join(err, consuming.stop(shutdownCtx))
+	}
 
-	return app, api.New(ctx, functionsRegistry), nil
+	return shutdown, api.New(ctx, functionsRegistry, dmClient, authenticator), nil
 }
 
 func newCommandHandler(messenger messaging.MsgContext, app application.App) messaging.CommandHandler {
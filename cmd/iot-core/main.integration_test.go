@@ -8,10 +8,15 @@ import (
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
+	"github.com/diwise/iot-core/internal/pkg/presentation/api"
+	"github.com/diwise/iot-core/internal/pkg/presentation/api/auth"
 	"github.com/diwise/iot-device-mgmt/pkg/client"
 	dmctest "github.com/diwise/iot-device-mgmt/pkg/test"
 	"github.com/diwise/messaging-golang/pkg/messaging"
@@ -22,17 +27,26 @@ func TestAPIfunctionsReturns200OK(t *testing.T) {
 	is, dmClient, msgCtx := testSetup(t)
 
 	fconf := bytes.NewBufferString("fid1;name;counter;overflow;internalID;false")
-	_, api, err := initialize(context.Background(), dmClient, nil, msgCtx, fconf, &database.StorageMock{
+	api, err := testInitialize(t, dmClient, msgCtx, fconf, &database.StorageMock{
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 			return nil
 		},
 		InitializeFunc: func(contextMoqParam context.Context) error {
 			return nil
 		},
-	})
+	}, allowTenants("default"))
 	is.NoErr(err)
 
 	server := httptest.NewServer(api.Router())
@@ -42,22 +56,327 @@ func TestAPIfunctionsReturns200OK(t *testing.T) {
 	is.Equal(resp.StatusCode, http.StatusOK)
 }
 
+func TestAPIQueryFunctionsWithFilters(t *testing.T) {
+	is, dmClient, msgCtx := testSetup(t)
+
+	api, err := testInitialize(t, dmClient, msgCtx, bytes.NewBufferString(""), &database.StorageMock{
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return []database.Fnct{
+				{ID: "fid1", Type: "counter", SubType: "overflow", SensorID: "s1", Tenant: "default"},
+				{ID: "fid2", Type: "stopwatch", SensorID: "s2", Tenant: "default"},
+			}, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+	}, allowTenants("default"))
+	is.NoErr(err)
+
+	server := httptest.NewServer(api.Router())
+	defer server.Close()
+
+	resp, body := testRequest(server, http.MethodGet, "/api/functions?type=counter&subtype=overflow&tenant=default", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(strings.Contains(body, "fid1"))
+	is.True(!strings.Contains(body, "fid2"))
+
+	resp, body = testRequest(server, http.MethodGet, "/api/functions?bbox=17.0,62.0,18.0,63.0", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(!strings.Contains(body, "fid1")) // functions without a known location are outside any bbox
+
+	resp, _ = testRequest(server, http.MethodGet, "/api/functions?bbox=17.0,62.0", nil)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+}
+
+func TestAPICreateUpdateAndDeleteFunction(t *testing.T) {
+	is, dmClient, msgCtx := testSetup(t)
+
+	api, err := testInitialize(t, dmClient, msgCtx, bytes.NewBufferString(""), &database.StorageMock{
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		SaveFnctFunc: func(ctx context.Context, f database.Fnct) error {
+			return nil
+		},
+		DeleteFnctFunc: func(ctx context.Context, id string) error {
+			return nil
+		},
+	}, allowTenants("default"))
+	is.NoErr(err)
+
+	server := httptest.NewServer(api.Router())
+	defer server.Close()
+
+	body := `{"id":"fid1","name":"name","type":"counter","subtype":"overflow","sensorID":"internalID","tenant":"default"}`
+	resp, _ := testRequest(server, http.MethodPost, "/api/functions", bytes.NewBufferString(body))
+	is.Equal(resp.StatusCode, http.StatusCreated)
+	is.Equal(resp.Header.Get("Location"), "/api/functions/fid1")
+
+	resp, _ = testRequest(server, http.MethodPost, "/api/functions", bytes.NewBufferString(body))
+	is.Equal(resp.StatusCode, http.StatusConflict)
+
+	resp, respBody := testRequest(server, http.MethodPatch, "/api/functions/fid1", bytes.NewBufferString(`{"name":"patched"}`))
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(strings.Contains(respBody, `"name": "patched"`))
+
+	resp, _ = testRequest(server, http.MethodPut, "/api/functions/fid1", bytes.NewBufferString(`{"type":"nosuchtype","sensorID":"internalID"}`))
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+
+	resp, _ = testRequest(server, http.MethodPost, "/api/functions", bytes.NewBufferString(`{"id":"comp1","type":"composite","args":"sources=fid1"}`))
+	is.Equal(resp.StatusCode, http.StatusCreated)
+
+	resp, _ = testRequest(server, http.MethodPost, "/api/functions", bytes.NewBufferString(`{"id":"comp2","type":"composite","args":"sources=comp1"}`))
+	is.Equal(resp.StatusCode, http.StatusCreated)
+
+	resp, _ = testRequest(server, http.MethodPatch, "/api/functions/comp1", bytes.NewBufferString(`{"args":"sources=fid1|comp2"}`))
+	is.Equal(resp.StatusCode, http.StatusBadRequest) // composites should not depend on themselves
+
+	resp, _ = testRequest(server, http.MethodDelete, "/api/functions/fid1", nil)
+	is.Equal(resp.StatusCode, http.StatusNoContent)
+
+	resp, _ = testRequest(server, http.MethodDelete, "/api/functions/fid1", nil)
+	is.Equal(resp.StatusCode, http.StatusNotFound)
+}
+
+func TestAPIDeniesAccessToOtherTenants(t *testing.T) {
+	is, dmClient, msgCtx := testSetup(t)
+
+	fconf := bytes.NewBufferString("fid1;name;counter;overflow;internalID;false")
+	api, err := testInitialize(t, dmClient, msgCtx, fconf, &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return []database.Fnct{{ID: "fid2", Name: "other", Type: "counter", SubType: "overflow", SensorID: "otherID", Tenant: "other"}}, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+	}, allowTenants("default"))
+	is.NoErr(err)
+
+	server := httptest.NewServer(api.Router())
+	defer server.Close()
+
+	resp, body := testRequest(server, http.MethodGet, "/api/functions", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(!strings.Contains(body, "fid2")) // functions of other tenants should be filtered out
+
+	resp, _ = testRequest(server, http.MethodGet, "/api/functions/fid2/history", nil)
+	is.Equal(resp.StatusCode, http.StatusForbidden)
+
+	resp, _ = testRequest(server, http.MethodDelete, "/api/functions/fid2", nil)
+	is.Equal(resp.StatusCode, http.StatusForbidden)
+
+	resp, _ = testRequest(server, http.MethodDelete, "/api/functions/fid1", nil)
+	is.Equal(resp.StatusCode, http.StatusConflict) // functions from the config can not be removed through the api
+}
+
+func TestAPIRejectsSensorsOfOtherTenants(t *testing.T) {
+	is, dmClient, msgCtx := testSetup(t)
+
+	dmClient.FindDeviceFromInternalIDFunc = func(ctx context.Context, deviceID string) (client.Device, error) {
+		switch deviceID {
+		case "internalid":
+			return &dmctest.DeviceMock{TenantFunc: func() string { return "default" }}, nil
+		case "otherid":
+			return &dmctest.DeviceMock{TenantFunc: func() string { return "other" }}, nil
+		}
+		return nil, client.ErrNotFound
+	}
+
+	api, err := testInitialize(t, dmClient, msgCtx, bytes.NewBufferString(""), &database.StorageMock{
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		SaveFnctFunc: func(ctx context.Context, f database.Fnct) error {
+			return nil
+		},
+	}, allowTenants("default"))
+	is.NoErr(err)
+
+	server := httptest.NewServer(api.Router())
+	defer server.Close()
+
+	body := `{"id":"fid1","name":"name","type":"counter","subtype":"overflow","sensorID":"internalID,otherID","tenant":"default"}`
+	resp, _ := testRequest(server, http.MethodPost, "/api/functions", bytes.NewBufferString(body))
+	is.Equal(resp.StatusCode, http.StatusForbidden) // a function should not be bound to the sensors of another tenant
+
+	body = `{"id":"fid1","name":"name","type":"counter","subtype":"overflow","sensorID":"unknownID","tenant":"default"}`
+	resp, _ = testRequest(server, http.MethodPost, "/api/functions", bytes.NewBufferString(body))
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+
+	body = `{"id":"fid1","name":"name","type":"counter","subtype":"overflow","sensorID":"internalID"}`
+	resp, respBody := testRequest(server, http.MethodPost, "/api/functions", bytes.NewBufferString(body))
+	is.Equal(resp.StatusCode, http.StatusCreated)
+	is.True(strings.Contains(respBody, `"tenant": "default"`)) // functions without a tenant should belong to the default tenant
+
+	resp, _ = testRequest(server, http.MethodPut, "/api/functions/fid1", bytes.NewBufferString(`{"type":"counter","sensorID":"otherID"}`))
+	is.Equal(resp.StatusCode, http.StatusForbidden)
+
+	resp, _ = testRequest(server, http.MethodPatch, "/api/functions/fid1", bytes.NewBufferString(`{"sensorID":"internalID,otherID"}`))
+	is.Equal(resp.StatusCode, http.StatusForbidden)
+}
+
+func TestAPIRejectsCompositesOverFunctionsOfOtherTenants(t *testing.T) {
+	is, dmClient, msgCtx := testSetup(t)
+
+	api, err := testInitialize(t, dmClient, msgCtx, bytes.NewBufferString(""), &database.StorageMock{
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return []database.Fnct{
+				{ID: "fid1", Name: "own", Type: "counter", SubType: "overflow", SensorID: "internalID", Tenant: "default"},
+				{ID: "fid2", Name: "other", Type: "counter", SubType: "overflow", SensorID: "otherID", Tenant: "other"},
+			}, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		SaveFnctFunc: func(ctx context.Context, f database.Fnct) error {
+			return nil
+		},
+	}, allowTenants("default"))
+	is.NoErr(err)
+
+	server := httptest.NewServer(api.Router())
+	defer server.Close()
+
+	resp, _ := testRequest(server, http.MethodPost, "/api/functions", bytes.NewBufferString(`{"id":"comp1","type":"composite","args":"sources=fid1|fid2"}`))
+	is.Equal(resp.StatusCode, http.StatusForbidden) // a composite should not read the values of another tenant
+
+	resp, _ = testRequest(server, http.MethodPost, "/api/functions", bytes.NewBufferString(`{"id":"comp1","type":"composite","args":"sources=fid1|nosuchfunction"}`))
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+
+	resp, _ = testRequest(server, http.MethodPost, "/api/functions", bytes.NewBufferString(`{"id":"comp1","type":"composite","args":"sources=fid1"}`))
+	is.Equal(resp.StatusCode, http.StatusCreated)
+
+	resp, _ = testRequest(server, http.MethodPut, "/api/functions/comp1", bytes.NewBufferString(`{"type":"composite","args":"sources=fid2"}`))
+	is.Equal(resp.StatusCode, http.StatusForbidden)
+
+	resp, _ = testRequest(server, http.MethodPatch, "/api/functions/comp1", bytes.NewBufferString(`{"args":"sources=fid1|fid2"}`))
+	is.Equal(resp.StatusCode, http.StatusForbidden)
+}
+
+func TestAPIFunctionsWithoutTenantBelongToTheDefaultTenant(t *testing.T) {
+	is, dmClient, msgCtx := testSetup(t)
+
+	fconf := bytes.NewBufferString("total;Totalt;composite;;;false;sources=c1|c2,op=sum")
+	api, err := testInitialize(t, dmClient, msgCtx, fconf, &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+	}, allowTenants("default"))
+	is.NoErr(err)
+
+	server := httptest.NewServer(api.Router())
+	defer server.Close()
+
+	resp, body := testRequest(server, http.MethodGet, "/api/functions?tenant=default", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(strings.Contains(body, `"id": "total"`))
+}
+
+func TestAPIQueryFunctionHistoryByTimeRange(t *testing.T) {
+	is, dmClient, msgCtx := testSetup(t)
+
+	var query database.HistoryQuery
+
+	api, err := testInitialize(t, dmClient, msgCtx, bytes.NewBufferString(""), &database.StorageMock{
+		HistoryFunc: func(ctx context.Context, id, label string, lastN int) ([]database.LogValue, error) {
+			return []database.LogValue{}, nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return []database.Fnct{{ID: "fid1", Name: "name", Type: "level", SubType: "sand", SensorID: "internalID", Tenant: "default", Args: "maxd=3.0,maxl=2.5"}}, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		QueryHistoryFunc: func(ctx context.Context, id string, q database.HistoryQuery) (database.HistoryResult, error) {
+			query = q
+			return database.HistoryResult{
+				Values:     []database.LogValue{{Value: 1.5, Timestamp: q.TimeAt.Add(time.Hour)}},
+				Offset:     q.Offset,
+				Limit:      q.Limit,
+				TotalCount: 11,
+			}, nil
+		},
+	}, allowTenants("default"))
+	is.NoErr(err)
+
+	server := httptest.NewServer(api.Router())
+	defer server.Close()
+
+	resp, body := testRequest(server, http.MethodGet, "/api/functions/fid1/history?timeAt=2024-01-01T00:00:00Z&endTimeAt=2024-01-02T00:00:00Z&offset=10&limit=10", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(query.TimeRel, "between")
+	is.Equal(query.Label, "level")
+	is.Equal(query.EndTimeAt, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	is.Equal(query.Offset, 10)
+	is.True(strings.Contains(body, `"totalCount": 11`))
+
+	resp, _ = testRequest(server, http.MethodGet, "/api/functions/fid1/history?timeRel=before&timeAt=2024-01-01T00:00:00Z", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(query.TimeRel, "before")
+	is.Equal(query.Limit, 1000)
+
+	resp, _ = testRequest(server, http.MethodGet, "/api/functions/fid1/history?timeRel=between&timeAt=2024-01-01T00:00:00Z", nil)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+
+	resp, _ = testRequest(server, http.MethodGet, "/api/functions/fid1/history?timeAt=yesterday", nil)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+
+	resp, body = testRequest(server, http.MethodGet, "/api/functions/fid1/history?timeAt=2024-01-01T00:00:00Z&endTimeAt=2024-02-01T00:00:00Z&aggr=avg&interval=1d", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(query.Aggregate, "avg")
+	is.Equal(query.Interval, 24*time.Hour)
+	is.True(strings.Contains(body, `"interval": "1d"`))
+
+	resp, _ = testRequest(server, http.MethodGet, "/api/functions/fid1/history?timeAt=2024-01-01T00:00:00Z&aggr=median&interval=1h", nil)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+
+	resp, _ = testRequest(server, http.MethodGet, "/api/functions/fid1/history?timeAt=2024-01-01T00:00:00Z&aggr=max", nil)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+}
+
 func TestReceiveDigitalInputUpdateMessage(t *testing.T) {
 	is, dmClient, msgCtx := testSetup(t)
 	sID := "internalID"
 
 	fconf := bytes.NewBufferString("fid1;name;counter;overflow;" + sID + ";false")
-	_, _, err := initialize(context.Background(), dmClient, nil, msgCtx, fconf, &database.StorageMock{
+	_, err := testInitialize(t, dmClient, msgCtx, fconf, &database.StorageMock{
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 			return nil
 		},
 		InitializeFunc: func(contextMoqParam context.Context) error {
 			return nil
 		},
-	})
+	}, allowTenants("default"))
 	is.NoErr(err)
 
 	topicMessageHandler := msgCtx.RegisterTopicMessageHandlerCalls()[0].Handler
@@ -83,6 +402,142 @@ func TestReceiveDigitalInputUpdateMessage(t *testing.T) {
 	is.Equal(string(b), expectation)
 }
 
+func TestShutdownClosesMessagingAfterSavingStates(t *testing.T) {
+	is, dmClient, msgCtx := testSetup(t)
+
+	steps := []string{}
+	var mu sync.Mutex
+	step := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		steps = append(steps, s)
+	}
+
+	msgCtx.CloseFunc = func() { step("close") }
+	msgCtx.PublishOnTopicFunc = func(ctx context.Context, message messaging.TopicMessage) error {
+		step("publish " + message.TopicName())
+		return nil
+	}
+
+	var topicMessageHandler messaging.TopicMessageHandler
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var shuttingDown atomic.Bool
+	var deliverLate, lateStarted sync.Once
+	late := make(chan struct{})
+
+	storage := &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			step("save " + id)
+
+			// a message for the other function arrives while the states are
+			// being saved, after the message handlers have been drained
+			if shuttingDown.Load() && id == "fid1" {
+				deliverLate.Do(func() {
+					go topicMessageHandler(context.Background(), &messaging.IncomingTopicMessageMock{
+						BodyFunc: func() []byte { return newStateJSON("sensor2", true) },
+					}, l)
+
+					select {
+					case <-late:
+					case <-time.After(5 * time.Second):
+						t.Error("timed out waiting for the late message to be handled")
+					}
+				})
+			}
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
+			if id == "fid2" {
+				lateStarted.Do(func() { close(late) })
+			}
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fconf := bytes.NewBufferString("fid1;name;counter;overflow;sensor1;false\nfid2;name;counter;overflow;sensor2;false")
+	shutdown, _, err := initialize(ctx, dmClient, nil, msgCtx, fconf, storage, allowTenants("default"))
+	is.NoErr(err)
+
+	topicMessageHandler = msgCtx.RegisterTopicMessageHandlerCalls()[0].Handler
+
+	topicMessageHandler(ctx, &messaging.IncomingTopicMessageMock{
+		BodyFunc: func() []byte { return newStateJSON("sensor1", true) },
+	}, l)
+
+	cancel()
+	shuttingDown.Store(true)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+
+	err = shutdown(shutdownCtx)
+	is.NoErr(err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// the late message should have been handled and published, and the
+	// messaging context should only be closed once that and the saving of the
+	// function states is done
+	is.Equal(steps[:2], []string{"save fid1", "publish function.updated"})
+	is.Equal(steps[len(steps)-1], "close")
+	is.Equal(strings.Count(strings.Join(steps, ","), "publish function.updated"), 2)
+}
+
+// testInitialize initializes the service like initialize does, and shuts it
+// down when the test is done so that its workers do not outlive the test
+func testInitialize(t *testing.T, dmClient client.DeviceManagementClient, msgCtx *messaging.MsgContextMock, fconf io.Reader, storage *database.StorageMock, authenticator func(http.Handler) http.Handler) (api.API, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	shutdown, api_, err := initialize(ctx, dmClient, nil, msgCtx, fconf, storage, authenticator)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	t.Cleanup(func() {
+		cancel()
+
+		// the shutdown saves the function states and closes the messaging
+		// context, which the tests have no need to mock
+		if storage.SaveStateFunc == nil {
+			storage.SaveStateFunc = func(context.Context, string, []byte, time.Time) error { return nil }
+		}
+		if msgCtx.CloseFunc == nil {
+			msgCtx.CloseFunc = func() {}
+		}
+
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelShutdown()
+
+		if err := shutdown(shutdownCtx); err != nil {
+			t.Errorf("failed to shut down: %s", err.Error())
+		}
+	})
+
+	return api_, nil
+}
+
+func allowTenants(tenants ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(auth.WithAllowedTenants(r.Context(), tenants)))
+		})
+	}
+}
+
 func testRequest(ts *httptest.Server, method, path string, body io.Reader) (*http.Response, string) {
 	req, _ := http.NewRequest(method, ts.URL+path, body)
 	resp, _ := http.DefaultClient.Do(req)
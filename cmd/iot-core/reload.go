@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/application/functions"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay is how long to wait for more changes to the functions config
+// before it is reloaded, since editors and config maps write files in steps
+const reloadDelay time.Duration = 500 * time.Millisecond
+
+// configReloader reloads the functions config into the registry when the file
+// changes or the process receives SIGHUP
+type configReloader struct {
+	path     string
+	registry functions.Registry
+
+	// loaded is the content of the config that was applied last, so that
+	// changes to other files in the same directory are ignored
+	loaded []byte
+}
+
+func newConfigReloader(path string, registry functions.Registry) *configReloader {
+	loaded, _ := os.ReadFile(path)
+	return &configReloader{path: path, registry: registry, loaded: loaded}
+}
+
+// Run watches the directory of the config file, rather than the file itself,
+// so that files that are replaced rather than written to, such as mounted
+// config maps, keep being watched. It returns when ctx is done.
+func (cr *configReloader) Run(ctx context.Context) {
+	logger := logging.GetFromContext(ctx)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// the channels stay nil, and are never selected, if the config can not be watched
+	var events chan fsnotify.Event
+	var errs chan error
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("failed to watch functions config, reload on SIGHUP only", "err", err.Error())
+	} else {
+		defer watcher.Close()
+
+		err = watcher.Add(filepath.Dir(cr.path))
+		if err != nil {
+			logger.Error("failed to watch functions config, reload on SIGHUP only", "path", cr.path, "err", err.Error())
+		} else {
+			events = watcher.Events
+			errs = watcher.Errors
+		}
+	}
+
+	delay := time.NewTimer(reloadDelay)
+	delay.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("received SIGHUP, reloading functions config", "path", cr.path)
+			cr.reload(ctx, true)
+		case <-events:
+			delay.Reset(reloadDelay)
+		case <-delay.C:
+			cr.reload(ctx, false)
+		case err := <-errs:
+			logger.Error("error while watching functions config", "err", err.Error())
+		}
+	}
+}
+
+// reload loads the config and applies it to the registry, unless the config
+// is invalid or, when not forced, its content is the same as last time
+func (cr *configReloader) reload(ctx context.Context, force bool) {
+	logger := logging.GetFromContext(ctx).With("path", cr.path)
+
+	data, err := os.ReadFile(cr.path)
+	if err != nil {
+		logger.Error("failed to read functions config, keeping current functions", "err", err.Error())
+		return
+	}
+
+	if !force && bytes.Equal(data, cr.loaded) {
+		return
+	}
+
+	settings, err := functions.LoadConfig(bytes.NewReader(data))
+	if err != nil {
+		logger.Error("invalid functions config, keeping current functions", "err", err.Error())
+		return
+	}
+
+	changes, err := cr.registry.Reload(ctx, settings)
+	if err != nil {
+		logger.Error("failed to reload functions config, keeping current functions", "err", err.Error())
+		return
+	}
+
+	cr.loaded = data
+
+	logger.Info("reloaded functions config",
+		"added", changes.Added, "updated", changes.Updated, "removed", changes.Removed,
+		"skipped", changes.Skipped, "unchanged", changes.Unchanged,
+	)
+}
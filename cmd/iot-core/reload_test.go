@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/application/functions"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestConfigIsReloadedWhenTheFileChanges(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "functions.csv")
+	is.NoErr(os.WriteFile(path, []byte("c1;Ett;counter;overflow;sensor1;false"), 0644))
+
+	registry := newReloadTestRegistry(ctx, t, path)
+
+	reloader := newConfigReloader(path, registry)
+	go reloader.Run(ctx)
+
+	time.Sleep(100 * time.Millisecond) // let the watcher start
+	is.NoErr(os.WriteFile(path, []byte("c1;Ett;counter;overflow;sensor1;false\nc2;Två;counter;overflow;sensor2;false"), 0644))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := registry.Get(ctx, "c2"); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatal("the added function was not loaded")
+}
+
+func TestInvalidConfigIsNotReloaded(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "functions.csv")
+	is.NoErr(os.WriteFile(path, []byte("c1;Ett;counter;overflow;sensor1;false"), 0644))
+
+	registry := newReloadTestRegistry(ctx, t, path)
+	reloader := newConfigReloader(path, registry)
+
+	is.NoErr(os.WriteFile(path, []byte("c2;Två;nosuchtype;overflow;sensor2;false"), 0644))
+	reloader.reload(ctx, false)
+
+	_, err := registry.Get(ctx, "c1")
+	is.NoErr(err) // the current functions should be kept
+
+	is.NoErr(os.WriteFile(path, []byte("c2;Två;counter;overflow;sensor2;false"), 0644))
+	reloader.reload(ctx, false)
+
+	_, err = registry.Get(ctx, "c1")
+	is.True(err != nil)
+	_, err = registry.Get(ctx, "c2")
+	is.NoErr(err)
+}
+
+func newReloadTestRegistry(ctx context.Context, t *testing.T, path string) functions.Registry {
+	config, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.Close()
+
+	registry, err := functions.NewRegistry(ctx, config, &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+	}, clock.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return registry
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/diwise/iot-core/internal/pkg/application/functions"
+)
+
+// validateConfig implements the validate-config subcommand, that validates a
+// functions config without starting the service. Every error that is found is
+// printed along with its line, and the returned exit code is non zero if the
+// config is invalid.
+func validateConfig(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: iot-core validate-config [-functions path] [path]\n")
+		flags.PrintDefaults()
+	}
+
+	path := flags.String("functions", defaultFunctionsConfigPath, "configuration file for functions (yaml, json or csv)")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() > 0 {
+		*path = flags.Arg(0)
+	}
+
+	file, err := os.Open(*path)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to open functions config: %s\n", err.Error())
+		return 1
+	}
+	defer file.Close()
+
+	settings, err := functions.LoadConfig(file)
+	if err != nil {
+		var configErrs functions.ConfigErrors
+		if errors.As(err, &configErrs) {
+			for _, e := range configErrs {
+				fmt.Fprintf(stderr, "%s:%d: %s\n", *path, e.Line, e.Err.Error())
+			}
+			fmt.Fprintf(stderr, "%d errors found\n", len(configErrs))
+		} else {
+			fmt.Fprintf(stderr, "%s: %s\n", *path, err.Error())
+		}
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s: %d functions ok\n", *path, len(settings))
+
+	return 0
+}
@@ -0,0 +1,114 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	defaultWorkerCount int = 16
+	defaultQueueSize   int = 64
+)
+
+// dispatcher runs work on a fixed number of workers. Work is assigned to a
+// worker based on a key, so that work with the same key is handled one at a
+// time and in the order it was dispatched, while work with different keys can
+// be handled in parallel.
+type dispatcher struct {
+	queues  []chan func()
+	workers sync.WaitGroup
+
+	// mu guards closed, and is held while work is added to inflight so that
+	// close does not miss work that is about to be queued
+	mu       sync.RWMutex
+	closed   bool
+	inflight sync.WaitGroup
+
+	stopWorkers sync.Once
+}
+
+var errDispatcherClosed = errors.New("dispatcher is closed")
+
+func newDispatcher(workerCount, queueSize int) *dispatcher {
+	d := &dispatcher{
+		queues: make([]chan func(), workerCount),
+	}
+
+	for i := range d.queues {
+		d.queues[i] = make(chan func(), queueSize)
+		d.workers.Go(func() { d.run(d.queues[i]) })
+	}
+
+	return d
+}
+
+func (d *dispatcher) run(queue chan func()) {
+	for work := range queue {
+		work()
+	}
+}
+
+// dispatch queues work on the worker responsible for key and waits for it to
+// finish. If the worker queue is full dispatch blocks until there is room or
+// the context is cancelled.
+func (d *dispatcher) dispatch(ctx context.Context, key string, work func() error) error {
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		return errDispatcherClosed
+	}
+	d.inflight.Add(1)
+	d.mu.RUnlock()
+
+	defer d.inflight.Done()
+
+	done := make(chan error, 1)
+
+	select {
+	case d.queues[d.worker(key)] <- func() { done <- work() }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return <-done
+}
+
+// close stops new work from being dispatched and waits for the work that has
+// already been dispatched to finish and for the workers to exit, or for the
+// context to be cancelled
+func (d *dispatcher) close(ctx context.Context) error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+
+		// nothing can be queued once the dispatched work has finished, so the
+		// queues can be closed to let the workers exit
+		d.stopWorkers.Do(func() {
+			for _, queue := range d.queues {
+				close(queue)
+			}
+		})
+		d.workers.Wait()
+
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *dispatcher) worker(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(d.queues)))
+}
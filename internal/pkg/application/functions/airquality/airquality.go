@@ -5,8 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"slices"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
 	"github.com/diwise/iot-core/pkg/lwm2m"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/senml"
@@ -17,22 +22,56 @@ const (
 	FunctionTypeName string = "airquality"
 )
 
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "airQuality",
+		DefaultHistoryLabel: "temperature",
+		New: func(env factories.Env) (factories.State, error) {
+			return New(env.Clock, History(env.History)), nil
+		},
+	})
+}
+
 type AirQuality interface {
 	Handle(context.Context, *events.MessageAccepted, func(prop string, value float64, ts time.Time) error) (bool, error)
 	Temperature() float64
+	Average(pollutant string, d time.Duration) (float64, bool)
 }
 
-func New() AirQuality {
+// History returns the last lastN values that have been logged for prop, oldest first
+type History func(ctx context.Context, prop string, lastN int) ([]database.LogValue, error)
+
+// New creates an air quality function that keeps rolling 1 hour and 24 hour
+// averages of each pollutant and calculates the european CAQI and the US AQI
+// from them. The averages are seeded from the logged history of a pollutant
+// the first time that it is measured, so that they survive restarts.
+func New(clk clock.Clock, history History) AirQuality {
 	aq := &airquality{
+		clock:         clk,
+		history:       history,
+		series:        map[string]*series{},
 		Particulates_: particulates{},
 	}
 	return aq
 }
 
 type airquality struct {
-	Particulates_ particulates `json:"particulates"`
-	Temperature_  float64      `json:"temperature"`
-	Timestamp_    time.Time    `json:"timestamp"`
+	Particulates_ particulates        `json:"particulates"`
+	Temperature_  float64             `json:"temperature"`
+	Humidity_     *float64            `json:"humidity,omitempty"`
+	Averages_     map[string]averages `json:"averages,omitempty"`
+	Index_        *index              `json:"index,omitempty"`
+	Timestamp_    time.Time           `json:"timestamp"`
+
+	// Measured_ lists the temperature and the pollutants that have been
+	// measured, since the ones that the sensors do not measure are reported
+	// as zero
+	Measured_ []string `json:"measured,omitempty"`
+
+	clock   clock.Clock
+	history History
+	series  map[string]*series
 }
 
 type particulates struct {
@@ -42,22 +81,69 @@ type particulates struct {
 	NO   float64 `json:"no"`
 	NO2  float64 `json:"no2"`
 	CO2  float64 `json:"co2"`
+	O3   float64 `json:"o3"`
+	SO2  float64 `json:"so2"`
+	CO   float64 `json:"co"`
+	VOC  float64 `json:"voc"`
 }
 
 func (aq *airquality) Temperature() float64 {
 	return aq.Temperature_
 }
 
+// measure marks the temperature or a pollutant as measured and reports
+// whether it had been measured before
+func (aq *airquality) measure(name string) bool {
+	if slices.Contains(aq.Measured_, name) {
+		return true
+	}
+
+	aq.Measured_ = append(aq.Measured_, name)
+	return false
+}
+
+// Average returns the rolling average of a pollutant over the last hour or
+// 24 hours (or anything in between)
+func (aq *airquality) Average(pollutant string, d time.Duration) (float64, bool) {
+	s, ok := aq.series[pollutant]
+	if !ok {
+		return 0, false
+	}
+	return s.average(d)
+}
+
+// pollutants, also used as the history labels
+const (
+	PM1  string = "pm1"
+	PM10 string = "pm10"
+	PM25 string = "pm25"
+	NO   string = "no"
+	NO2  string = "no2"
+	CO2  string = "co2"
+	O3   string = "o3"
+	SO2  string = "so2"
+	CO   string = "co"
+	VOC  string = "voc"
+)
+
 const (
 	lwm2mTemperature string = "5700"
 	lwm2mPM1         string = "5"
 	lwm2mPM10        string = "1"
 	lwm2mPM25        string = "3"
-	lwm2mNO          string = "19"
+	lwm2mCO          string = "7"
+	lwm2mO3          string = "9"
+	lwm2mSO2         string = "11"
 	lwm2mNO2         string = "15"
 	lwm2mCO2         string = "17"
+	lwm2mNO          string = "19"
+	lwm2mVOC         string = "21"
+	lwm2mHumidity    string = "23"
 )
 
+// maxHistory is the max number of logged values to seed the averages with
+const maxHistory int = 1000
+
 func (aq *airquality) Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
 	log := logging.GetFromContext(ctx)
 
@@ -65,75 +151,69 @@ func (aq *airquality) Handle(ctx context.Context, e *events.MessageAccepted, onc
 		return false, events.ErrNoMatch
 	}
 
-	temp, tempOk := e.Pack().GetValue(senml.FindByName(lwm2mTemperature))
-	pm1, pm1Ok := e.Pack().GetValue(senml.FindByName(lwm2mPM1))
-	pm10, pm10Ok := e.Pack().GetValue(senml.FindByName(lwm2mPM10))
-	pm25, pm25Ok := e.Pack().GetValue(senml.FindByName(lwm2mPM25))
-	no, noOk := e.Pack().GetValue(senml.FindByName(lwm2mNO))
-	no2, no2Ok := e.Pack().GetValue(senml.FindByName(lwm2mNO2))
-	co2, co2Ok := e.Pack().GetValue(senml.FindByName(lwm2mCO2))
+	pollutants := []struct {
+		name     string
+		resource string
+		value    *float64
+	}{
+		{PM1, lwm2mPM1, &aq.Particulates_.PM1},
+		{PM10, lwm2mPM10, &aq.Particulates_.PM10},
+		{PM25, lwm2mPM25, &aq.Particulates_.PM25},
+		{NO, lwm2mNO, &aq.Particulates_.NO},
+		{NO2, lwm2mNO2, &aq.Particulates_.NO2},
+		{CO2, lwm2mCO2, &aq.Particulates_.CO2},
+		{O3, lwm2mO3, &aq.Particulates_.O3},
+		{SO2, lwm2mSO2, &aq.Particulates_.SO2},
+		{CO, lwm2mCO, &aq.Particulates_.CO},
+		{VOC, lwm2mVOC, &aq.Particulates_.VOC},
+	}
 
 	hasChanged := false
 	var errs []error
 
-	if tempOk {
-		if aq.Temperature_ != temp {
+	if temp, ok := e.Pack().GetValue(senml.FindByName(lwm2mTemperature)); ok {
+		if known := aq.measure("temperature"); !known || aq.Temperature_ != temp {
 			aq.Temperature_ = temp
-			errs = append(errs, onchange("temperature", temp, getTime(e, lwm2mTemperature)))
+			errs = append(errs, onchange("temperature", temp, aq.getTime(e, lwm2mTemperature)))
 			hasChanged = true
 		}
 	}
 
-	if pm1Ok {
-		if aq.Particulates_.PM1 != pm1 {
-			aq.Particulates_.PM1 = pm1
-			errs = append(errs, onchange("pm1", pm1, getTime(e, lwm2mPM1)))
+	if humidity, ok := e.Pack().GetValue(senml.FindByName(lwm2mHumidity)); ok {
+		if aq.Humidity_ == nil || *aq.Humidity_ != humidity {
+			aq.Humidity_ = &humidity
+			errs = append(errs, onchange("humidity", humidity, aq.getTime(e, lwm2mHumidity)))
 			hasChanged = true
 		}
 	}
 
-	if pm10Ok {
-		if aq.Particulates_.PM10 != pm10 {
-			aq.Particulates_.PM10 = pm10
-			errs = append(errs, onchange("pm10", pm10, getTime(e, lwm2mPM10)))
-			hasChanged = true
-		}
-	}
+	measured := false
 
-	if pm25Ok {
-		if aq.Particulates_.PM25 != pm25 {
-			aq.Particulates_.PM25 = pm25
-			errs = append(errs, onchange("pm25", pm25, getTime(e, lwm2mPM25)))
-			hasChanged = true
+	for _, p := range pollutants {
+		v, ok := e.Pack().GetValue(senml.FindByName(p.resource))
+		if !ok {
+			continue
 		}
-	}
 
-	if noOk {
-		if aq.Particulates_.NO != no {
-			aq.Particulates_.NO = no
-			errs = append(errs, onchange("no", no, getTime(e, lwm2mNO)))
-			hasChanged = true
-		}
-	}
+		ts := aq.getTime(e, p.resource)
+		aq.addToSeries(ctx, p.name, v, ts)
+		measured = true
 
-	if no2Ok {
-		if aq.Particulates_.NO2 != no2 {
-			aq.Particulates_.NO2 = no2
-			errs = append(errs, onchange("no2", no2, getTime(e, lwm2mNO2)))
+		if known := aq.measure(p.name); !known || *p.value != v {
+			*p.value = v
+			errs = append(errs, onchange(p.name, v, ts))
 			hasChanged = true
 		}
 	}
 
-	if co2Ok {
-		if aq.Particulates_.CO2 != co2 {
-			aq.Particulates_.CO2 = co2
-			errs = append(errs, onchange("co2", co2, getTime(e, lwm2mCO2)))
-			hasChanged = true
-		}
+	if measured {
+		changed, err := aq.updateIndex(e, onchange)
+		hasChanged = hasChanged || changed
+		errs = append(errs, err)
 	}
 
 	if hasChanged {
-		aq.Timestamp_ = time.Now().UTC()
+		aq.Timestamp_ = aq.clock.Now().UTC()
 	}
 
 	b, _ := json.Marshal(aq)
@@ -142,10 +222,107 @@ func (aq *airquality) Handle(ctx context.Context, e *events.MessageAccepted, onc
 	return hasChanged, errors.Join(errs...)
 }
 
-func getTime(e *events.MessageAccepted, name string) time.Time {
+func (aq *airquality) addToSeries(ctx context.Context, pollutant string, v float64, ts time.Time) {
+	if aq.series == nil {
+		aq.series = map[string]*series{}
+	}
+
+	s, ok := aq.series[pollutant]
+	if !ok {
+		s = &series{}
+		aq.series[pollutant] = s
+		aq.seed(ctx, pollutant, s, ts)
+	}
+
+	s.add(v, ts)
+}
+
+// seed adds the values that have been logged within 24 hours before ts
+func (aq *airquality) seed(ctx context.Context, pollutant string, s *series, ts time.Time) {
+	if aq.history == nil {
+		return
+	}
+
+	logged, err := aq.history(ctx, pollutant, maxHistory)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("failed to fetch history, averages will start over", "pollutant", pollutant, "err", err.Error())
+		return
+	}
+
+	for _, lv := range logged {
+		// the incoming value may or may not have been logged already
+		if lv.Timestamp.After(ts.Add(-maxAvgRange)) && lv.Timestamp.Before(ts) {
+			s.add(lv.Value, lv.Timestamp)
+		}
+	}
+}
+
+// updateIndex recalculates the averages and the air quality indexes, and
+// reports whether any of the indexes have changed
+func (aq *airquality) updateIndex(e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
+	aq.Averages_ = map[string]averages{}
+
+	for pollutant, s := range aq.series {
+		oneHour, ok := s.average(time.Hour)
+		if !ok {
+			continue
+		}
+
+		twentyFourHours, _ := s.average(maxAvgRange)
+
+		aq.Averages_[pollutant] = averages{
+			OneHour:         round(oneHour),
+			TwentyFourHours: round(twentyFourHours),
+		}
+	}
+
+	idx, ok := calculateIndex(aq.Averages_)
+	if !ok {
+		return false, nil
+	}
+
+	previous := aq.Index_
+	aq.Index_ = &idx
+
+	ts, ok := e.Pack().GetTime(senml.FindByName("0"))
+	if !ok {
+		ts = aq.clock.Now().UTC()
+	}
+
+	changed := false
+	var errs []error
+
+	if previous == nil {
+		previous = &index{}
+	}
+
+	if indexChanged(previous.CAQI, idx.CAQI) {
+		errs = append(errs, onchange("caqi", *idx.CAQI, ts))
+		changed = true
+	}
+
+	if indexChanged(previous.AQI, idx.AQI) {
+		errs = append(errs, onchange("aqi", *idx.AQI, ts))
+		changed = true
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+// indexChanged reports whether an index has a value that differs from the
+// previous one, an index that can no longer be calculated is not a change
+func indexChanged(previous, current *float64) bool {
+	return current != nil && (previous == nil || *previous != *current)
+}
+
+func (aq *airquality) getTime(e *events.MessageAccepted, name string) time.Time {
 	t, tOk := e.Pack().GetTime(senml.FindByName(name))
 	if tOk {
 		return t
 	}
-	return time.Now().UTC()
+	return aq.clock.Now().UTC()
+}
+
+func round(v float64) float64 {
+	return math.Round(v*100) / 100
 }
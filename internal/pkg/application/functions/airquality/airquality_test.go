@@ -7,6 +7,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/matryer/is"
 )
@@ -14,7 +16,7 @@ import (
 func TestAirQuality(t *testing.T) {
 	is := is.New(t)
 
-	aq := New()
+	aq := New(clock.New(), nil)
 	aq.Handle(context.Background(), newAirQuality(1.0, "2023-02-07T21:32:59.682607Z"), func(prop string, value float64, ts time.Time) error {
 		return nil
 	})
@@ -22,6 +24,134 @@ func TestAirQuality(t *testing.T) {
 	is.Equal(aq.Temperature(), 1.0)
 }
 
+func TestMeasuredPollutantsAreListed(t *testing.T) {
+	is := is.New(t)
+
+	aq := New(clock.New(), nil)
+	aq.Handle(context.Background(), newPollutants(time.Now(), map[string]float64{lwm2mPM10: 21}), func(string, float64, time.Time) error {
+		return nil
+	})
+
+	b, err := json.Marshal(aq)
+	is.NoErr(err)
+
+	state := struct {
+		Particulates map[string]float64 `json:"particulates"`
+		Temperature  *float64           `json:"temperature"`
+		Measured     []string           `json:"measured"`
+	}{}
+	is.NoErr(json.Unmarshal(b, &state))
+
+	is.Equal(len(state.Particulates), 10) // all pollutants are always reported
+	is.Equal(state.Particulates[PM10], 21.0)
+	is.True(state.Temperature != nil)
+	is.Equal(state.Measured, []string{PM10}) // but only pm10 has been measured
+}
+
+func TestAirQualityIndex(t *testing.T) {
+	is := is.New(t)
+
+	start := time.Date(2023, 2, 7, 12, 0, 0, 0, time.UTC)
+
+	// the first 24h of PM2.5 have been logged before a restart
+	history := func(ctx context.Context, prop string, lastN int) ([]database.LogValue, error) {
+		if prop != PM25 {
+			return []database.LogValue{}, nil
+		}
+		logged := []database.LogValue{}
+		for h := 23; h > 0; h-- {
+			logged = append(logged, database.LogValue{Value: 12, Timestamp: start.Add(-time.Duration(h) * time.Hour)})
+		}
+		return logged, nil
+	}
+
+	aq := New(clock.NewFake(start), history)
+
+	logged := map[string]float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		logged[prop] = v
+		return nil
+	}
+
+	changed, err := aq.Handle(context.Background(), newPollutants(start, map[string]float64{lwm2mPM25: 12, lwm2mPM10: 37.5, lwm2mNO2: 40}), onchange)
+	is.NoErr(err)
+	is.True(changed)
+
+	a := aq.(*airquality)
+	is.Equal(a.Averages_[PM25], averages{OneHour: 12, TwentyFourHours: 12})
+	is.Equal(*a.Index_, index{CAQI: ptr(38.0), CAQICategory: "low", AQI: ptr(56.0), AQICategory: "moderate", Dominant: PM25})
+	is.Equal(logged["caqi"], 38.0)
+	is.Equal(logged["aqi"], 56.0)
+
+	// a spike of PM2.5 affects the hourly average more than the daily one
+	changed, _ = aq.Handle(context.Background(), newPollutants(start.Add(30*time.Minute), map[string]float64{lwm2mPM25: 60}), onchange)
+	is.True(changed)
+
+	avg, _ := aq.Average(PM25, time.Hour)
+	is.Equal(avg, 36.0)
+	is.Equal(a.Averages_[PM25].TwentyFourHours, 13.92) // (23*12 + 12 + 60) / 25
+	is.Equal(*a.Index_.CAQI, 56.0)                     // the hourly PM2.5 average of 36 is in the medium range
+	is.Equal(a.Index_.CAQICategory, "medium")
+}
+
+func TestAQIWithoutCAQIPollutants(t *testing.T) {
+	is := is.New(t)
+
+	idx, ok := calculateIndex(map[string]averages{CO: {OneHour: 5.7}})
+	is.True(ok) // CO is not part of the CAQI, but the US AQI can still be calculated
+
+	is.True(idx.CAQI == nil)
+	is.Equal(*idx.AQI, 55.0) // 5.7 mg/m³ is 4.9 ppm
+	is.Equal(idx.Dominant, CO)
+	is.True(!idx.AQIOutOfRange)
+}
+
+func TestAQIOutOfRange(t *testing.T) {
+	is := is.New(t)
+
+	idx, _ := calculateIndex(map[string]averages{SO2: {OneHour: 1310}})
+	is.Equal(*idx.AQI, 266.0) // 500 ppb is covered by the extended SO2 breakpoints
+	is.True(!idx.AQIOutOfRange)
+
+	idx, _ = calculateIndex(map[string]averages{SO2: {OneHour: 3000}})
+	is.Equal(*idx.AQI, 500.0) // beyond the highest breakpoint the index is capped
+	is.True(idx.AQIOutOfRange)
+}
+
+func TestSeriesAverages(t *testing.T) {
+	is := is.New(t)
+
+	start := time.Date(2023, 2, 7, 0, 0, 0, 0, time.UTC)
+	s := &series{}
+
+	for m := range 48 * 60 {
+		s.add(float64(m/60), start.Add(time.Duration(m)*time.Minute)) // the value is the number of hours since start
+	}
+
+	is.Equal(len(s.buckets), 24*12) // only 24 hours of buckets are kept
+
+	avg, _ := s.average(time.Hour)
+	is.Equal(avg, 47.0)
+
+	avg, _ = s.average(24 * time.Hour)
+	is.True(avg > 35 && avg < 36)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func newPollutants(ts time.Time, values map[string]float64) *events.MessageAccepted {
+	pack := fmt.Sprintf(`{"bn":"testId/3428/","bt":%d,"n":"0","vs":"urn:oma:lwm2m:ext:3428"}`, ts.Unix())
+	for n, v := range values {
+		pack += fmt.Sprintf(`,{"n":"%s","v":%f}`, n, v)
+	}
+
+	e := &events.MessageAccepted{}
+	json.Unmarshal(fmt.Appendf(nil, `{"pack":[%s],"timestamp":"%s"}`, pack, ts.Format(time.RFC3339)), e)
+	return e
+}
+
 func newAirQuality(t float64, timestamp string) *events.MessageAccepted {
 	e := &events.MessageAccepted{}
 	json.Unmarshal(
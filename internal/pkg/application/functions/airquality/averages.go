@@ -0,0 +1,74 @@
+package airquality
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	bucketSize  time.Duration = 5 * time.Minute
+	maxAvgRange time.Duration = 24 * time.Hour
+)
+
+type bucket struct {
+	start time.Time
+	sum   float64
+	count int
+}
+
+// series keeps the values of a pollutant in buckets of five minutes for up
+// to 24 hours, so that rolling averages can be calculated with bounded memory.
+type series struct {
+	buckets []bucket
+}
+
+func (s *series) add(v float64, ts time.Time) {
+	start := ts.Truncate(bucketSize)
+
+	// values may arrive out of order
+	i := len(s.buckets) - 1
+	for i >= 0 && s.buckets[i].start.After(start) {
+		i--
+	}
+
+	if i >= 0 && s.buckets[i].start.Equal(start) {
+		s.buckets[i].sum += v
+		s.buckets[i].count++
+	} else {
+		s.buckets = slices.Insert(s.buckets, i+1, bucket{start: start, sum: v, count: 1})
+	}
+
+	latest := s.buckets[len(s.buckets)-1].start
+	for len(s.buckets) > 0 && !s.buckets[0].start.After(latest.Add(-maxAvgRange)) {
+		s.buckets = s.buckets[1:]
+	}
+}
+
+// average returns the average of the values within d of the latest value
+func (s *series) average(d time.Duration) (float64, bool) {
+	if len(s.buckets) == 0 {
+		return 0, false
+	}
+
+	from := s.buckets[len(s.buckets)-1].start.Add(-d)
+
+	sum, count := 0.0, 0
+	for _, b := range s.buckets {
+		if b.start.After(from) {
+			sum += b.sum
+			count += b.count
+		}
+	}
+
+	if count == 0 {
+		return 0, false
+	}
+
+	return sum / float64(count), true
+}
+
+// averages are the rolling averages of a pollutant
+type averages struct {
+	OneHour         float64 `json:"1h"`
+	TwentyFourHours float64 `json:"24h"`
+}
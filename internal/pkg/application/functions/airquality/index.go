@@ -0,0 +1,206 @@
+package airquality
+
+import (
+	"math"
+)
+
+// breakpoint maps a concentration range to an index range, with linear
+// interpolation in between
+type breakpoint struct {
+	cLow, cHigh float64
+	iLow, iHigh float64
+}
+
+type scale []breakpoint
+
+// index returns the index for concentration c, and whether c is within the
+// scale. Concentrations above the scale are extrapolated from the last
+// breakpoint when extrapolate is set, otherwise they get the highest index
+// of the scale.
+func (s scale) index(c float64, extrapolate bool) (float64, bool) {
+	if c < 0 {
+		c = 0
+	}
+
+	for _, bp := range s {
+		if c <= bp.cHigh {
+			return bp.iLow + (bp.iHigh-bp.iLow)*(c-bp.cLow)/(bp.cHigh-bp.cLow), true
+		}
+	}
+
+	last := s[len(s)-1]
+	if !extrapolate {
+		return last.iHigh, false
+	}
+
+	return last.iLow + (last.iHigh-last.iLow)*(c-last.cLow)/(last.cHigh-last.cLow), false
+}
+
+// caqiGrid returns the hourly background grid of the european Common Air Quality
+// Index for concentrations in µg/m³, with the limits at index 0, 25, 50, 75 and 100.
+func caqiGrid(limits ...float64) scale {
+	s := scale{}
+	for i := 1; i < len(limits); i++ {
+		s = append(s, breakpoint{limits[i-1], limits[i], float64(i-1) * 25, float64(i) * 25})
+	}
+	return s
+}
+
+var caqi = map[string]scale{
+	NO2:  caqiGrid(0, 50, 100, 200, 400),
+	PM10: caqiGrid(0, 25, 50, 90, 180),
+	O3:   caqiGrid(0, 60, 120, 180, 240),
+	PM25: caqiGrid(0, 15, 30, 55, 110),
+	SO2:  caqiGrid(0, 50, 100, 350, 500),
+}
+
+var caqiCategories = categories{
+	{25, "very low"},
+	{50, "low"},
+	{75, "medium"},
+	{100, "high"},
+	{math.Inf(1), "very high"},
+}
+
+// usAQI holds the US EPA breakpoints, with concentrations in the units of the
+// EPA (µg/m³ for particulates, ppb for NO2 and SO2, ppm for CO)
+var usAQI = map[string]scale{
+	PM25: {
+		{0, 9.0, 0, 50}, {9.1, 35.4, 51, 100}, {35.5, 55.4, 101, 150},
+		{55.5, 125.4, 151, 200}, {125.5, 225.4, 201, 300}, {225.5, 325.4, 301, 500},
+	},
+	PM10: {
+		{0, 54, 0, 50}, {55, 154, 51, 100}, {155, 254, 101, 150},
+		{255, 354, 151, 200}, {355, 424, 201, 300}, {425, 604, 301, 500},
+	},
+	NO2: {
+		{0, 53, 0, 50}, {54, 100, 51, 100}, {101, 360, 101, 150},
+		{361, 649, 151, 200}, {650, 1249, 201, 300}, {1250, 2049, 301, 500},
+	},
+	SO2: {
+		{0, 35, 0, 50}, {36, 75, 51, 100}, {76, 185, 101, 150},
+		{186, 304, 151, 200}, {305, 604, 201, 300}, {605, 1004, 301, 500},
+	},
+	CO: {
+		{0, 4.4, 0, 50}, {4.5, 9.4, 51, 100}, {9.5, 12.4, 101, 150},
+		{12.5, 15.4, 151, 200}, {15.5, 30.4, 201, 300}, {30.5, 50.4, 301, 500},
+	},
+}
+
+// usAQIPrecision is the precision that concentrations are truncated to
+// before looking up the index, as specified by the EPA. The breakpoints
+// leave no gaps for truncated concentrations.
+var usAQIPrecision = map[string]float64{
+	PM25: 10, PM10: 1, NO2: 1, SO2: 1, CO: 10,
+}
+
+// conversion factors from the units that are measured to the units of the EPA
+// breakpoints, at 25°C and 1 atm
+var usAQIConversion = map[string]float64{
+	NO2: 1 / 1.88,  // µg/m³ to ppb
+	SO2: 1 / 2.62,  // µg/m³ to ppb
+	CO:  1 / 1.145, // mg/m³ to ppm
+}
+
+var usAQICategories = categories{
+	{50, "good"},
+	{100, "moderate"},
+	{150, "unhealthy for sensitive groups"},
+	{200, "unhealthy"},
+	{300, "very unhealthy"},
+	{math.Inf(1), "hazardous"},
+}
+
+// index holds the indexes that can be calculated from the pollutants that
+// have been measured, an index is left out if none of its pollutants are
+type index struct {
+	CAQI         *float64 `json:"caqi,omitempty"`
+	CAQICategory string   `json:"caqiCategory,omitempty"`
+	AQI          *float64 `json:"aqi,omitempty"`
+	AQICategory  string   `json:"aqiCategory,omitempty"`
+	// Dominant is the pollutant that determines the US AQI
+	Dominant string `json:"dominant,omitempty"`
+	// AQIOutOfRange is set when a concentration is beyond the highest
+	// breakpoint of the US AQI, which is then capped at 500
+	AQIOutOfRange bool `json:"aqiOutOfRange,omitempty"`
+}
+
+// calculateIndex calculates the european CAQI from the hourly averages and
+// the US AQI from the 24 hour averages of particulates and the hourly averages
+// of gases. The EPA uses 8 hour averages for CO and O3, and 24 hour averages
+// for SO2 above an index of 200, the hourly averages are used as an
+// approximation and O3 is left out of the US AQI.
+func calculateIndex(avgs map[string]averages) (index, bool) {
+	idx := index{}
+
+	for pollutant, s := range caqi {
+		avg, ok := avgs[pollutant]
+		if !ok {
+			continue
+		}
+
+		value, _ := s.index(avg.OneHour, true)
+		value = math.Round(value)
+
+		if idx.CAQI == nil || value > *idx.CAQI {
+			idx.CAQI = &value
+		}
+	}
+
+	for pollutant, s := range usAQI {
+		avg, ok := avgs[pollutant]
+		if !ok {
+			continue
+		}
+
+		c := avg.OneHour
+		if pollutant == PM25 || pollutant == PM10 {
+			c = avg.TwentyFourHours
+		}
+
+		if f, ok := usAQIConversion[pollutant]; ok {
+			c = c * f
+		}
+
+		precision := usAQIPrecision[pollutant]
+		c = math.Floor(c*precision) / precision
+
+		aqi, inRange := s.index(c, false)
+		aqi = math.Round(aqi)
+
+		idx.AQIOutOfRange = idx.AQIOutOfRange || !inRange
+
+		if idx.AQI == nil || aqi > *idx.AQI || (aqi == *idx.AQI && pollutant < idx.Dominant) {
+			idx.AQI = &aqi
+			idx.Dominant = pollutant
+		}
+	}
+
+	if idx.CAQI == nil && idx.AQI == nil {
+		return idx, false
+	}
+
+	if idx.CAQI != nil {
+		idx.CAQICategory = caqiCategories.of(*idx.CAQI)
+	}
+
+	if idx.AQI != nil {
+		idx.AQICategory = usAQICategories.of(*idx.AQI)
+	}
+
+	return idx, true
+}
+
+type categories []struct {
+	limit float64
+	name  string
+}
+
+func (c categories) of(value float64) string {
+	for _, category := range c {
+		if value <= category.limit {
+			return category.name
+		}
+	}
+	return c[len(c)-1].name
+}
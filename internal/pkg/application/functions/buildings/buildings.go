@@ -2,9 +2,15 @@ package buildings
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
 	"github.com/diwise/iot-core/pkg/lwm2m"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/senml"
@@ -14,20 +20,122 @@ const (
 	FunctionTypeName string = "building"
 )
 
+const (
+	Hourly  string = "hourly"
+	Daily   string = "daily"
+	Monthly string = "monthly"
+)
+
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "building",
+		DefaultHistoryLabel: "power",
+		Args: []factories.Arg{
+			{Name: "tz"},
+			{Name: "tariff", Kind: factories.Number},
+			{Name: "rollover", Kind: factories.Number},
+		},
+		New: func(env factories.Env) (factories.State, error) {
+			return New(env.Args)
+		},
+	})
+}
+
 type Building interface {
 	Handle(context.Context, *events.MessageAccepted, func(string, float64, time.Time) error) (bool, error)
+	Tick(context.Context, time.Time, func(string, float64, time.Time) error) (bool, error)
 
 	CurrentPower() float64
 	CurrentEnergy() float64
+	Consumption(period string) float64
 }
 
-func New() Building {
-	return &building{}
+// New creates a building from a config string such as "tz=Europe/Stockholm,tariff=1.25".
+// The consumption per hour, day and month is calculated from the cumulative
+// energy meter in the given time zone (defaults to UTC). A meter that starts
+// over from zero is treated as having been reset, unless the value it rolls
+// over at is configured with "rollover=99999.9" (in kWh) and the previous
+// reading was close to it. When a tariff per kWh is configured, the cost of
+// the consumption is calculated as well.
+//
+// Buildings without a power sensor get an estimated power calculated from
+// the change of the energy meter between two readings.
+func New(config string) (Building, error) {
+	b := &building{
+		location: time.UTC,
+	}
+
+	config = strings.ReplaceAll(config, " ", "")
+
+	for s := range strings.SplitSeq(config, ",") {
+		pair := strings.Split(s, "=")
+		if len(pair) != 2 {
+			continue
+		}
+
+		var err error
+
+		switch pair[0] {
+		case "tz":
+			b.location, err = time.LoadLocation(pair[1])
+		case "tariff":
+			var tariff float64
+			tariff, err = strconv.ParseFloat(pair[1], 64)
+			if err == nil && tariff < 0 {
+				err = fmt.Errorf("tariff must not be negative")
+			}
+			b.tariff = &tariff
+		case "rollover":
+			b.rollover, err = strconv.ParseFloat(pair[1], 64)
+			if err == nil && b.rollover <= 0 {
+				err = fmt.Errorf("rollover must be positive")
+			}
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse building config \"%s\": %w", s, err)
+		}
+	}
+
+	return b, nil
 }
 
 type building struct {
 	Energy float64 `json:"energy"`
 	Power  float64 `json:"power"`
+
+	// Measured lists the quantities that are known, either from sensors or
+	// estimated, since energy and power are reported as zero until they are
+	Measured []string `json:"measured,omitempty"`
+
+	Consumption_ *consumption `json:"consumption,omitempty"`
+
+	// PowerSensor is set when power is received from a sensor, so that it is
+	// not overwritten by the estimated power, also after a restart
+	PowerSensor bool `json:"powerSensor,omitempty"`
+
+	location *time.Location
+	tariff   *float64
+	rollover float64
+}
+
+// consumption keeps track of the energy meter readings and the energy consumed
+// since the start of the current hour, day and month.
+type consumption struct {
+	Timestamp time.Time `json:"timestamp"`
+	Total     float64   `json:"total"`
+	Hour      period    `json:"hour"`
+	Day       period    `json:"day"`
+	Month     period    `json:"month"`
+}
+
+type period struct {
+	Start  time.Time `json:"start"`
+	Energy float64   `json:"energy"`
+	Cost   *float64  `json:"cost,omitempty"`
 }
 
 func (b *building) Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
@@ -43,29 +151,188 @@ func (b *building) Handle(ctx context.Context, e *events.MessageAccepted, onchan
 		value := *r.Value
 
 		if events.Matches(e, lwm2m.Power) {
+			b.PowerSensor = true
+
 			previousValue := b.Power
+			known := b.measure("power")
 			value = value / 1000.0 // convert from Watt to kW
 			b.Power = value
 
-			if hasChanged(previousValue, value) {
+			if !known || hasChanged(previousValue, value) {
 				err := onchange("power", value, ts)
 				return true, err
 			}
 		} else if events.Matches(e, lwm2m.Energy) {
+			if b.Consumption_ != nil && !ts.After(b.Consumption_.Timestamp) {
+				// a late or duplicate reading, that would make the next
+				// reading count the same consumption twice
+				return false, nil
+			}
+
 			previousValue := b.Energy
+			known := b.measure("energy")
 			value = value / 3600000.0 // convert from Joule to kWh
 			b.Energy = value
 
-			if hasChanged(previousValue, value) {
-				err := onchange("energy", value, ts)
-				return true, err
+			errs := []error{}
+			changed := false
+
+			if !known || hasChanged(previousValue, value) {
+				errs = append(errs, onchange("energy", value, ts))
+				changed = true
 			}
+
+			consumed, err := b.consume(previousValue, value, ts, onchange)
+			errs = append(errs, err)
+
+			return changed || consumed, errors.Join(errs...)
 		}
 	}
 
 	return false, nil
 }
 
+// consume adds the energy consumed since the previous meter reading to the
+// current periods, and estimates the power if there is no power sensor.
+//
+// When the readings are on either side of the start of a period, the energy
+// is split pro rata by time, and only the part consumed after the start is
+// added to the new period.
+func (b *building) consume(previous, current float64, ts time.Time, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
+	if b.Consumption_ == nil {
+		b.Consumption_ = &consumption{Timestamp: ts}
+		b.rollPeriods(ts)
+		return true, nil
+	}
+
+	c := b.Consumption_
+
+	delta := current - previous
+	if delta < 0 {
+		if b.rollover > 0 && previous >= 0.9*b.rollover {
+			// the meter has passed its max value and started over
+			delta = b.rollover - previous + current
+		} else {
+			// the meter has been reset or replaced
+			delta = current
+		}
+	}
+
+	errs := []error{}
+
+	if !b.PowerSensor {
+		hours := ts.Sub(c.Timestamp).Hours()
+		power := delta / hours
+		if known := b.measure("power"); !known || hasChanged(b.Power, power) {
+			b.Power = power
+			errs = append(errs, onchange("power", power, ts))
+		}
+	}
+
+	shares := map[string]float64{}
+	for name := range b.periods() {
+		shares[name] = delta
+		if start := periodStart(ts, name, b.location); start.After(c.Timestamp) {
+			shares[name] = delta * ts.Sub(start).Seconds() / ts.Sub(c.Timestamp).Seconds()
+		}
+	}
+
+	c.Timestamp = ts
+	b.rollPeriods(ts)
+
+	if delta == 0 {
+		return false, errors.Join(errs...)
+	}
+
+	c.Total += delta
+
+	for name, p := range b.periods() {
+		p.Energy += shares[name]
+		errs = append(errs, onchange(name+"Consumption", p.Energy, ts))
+
+		if b.tariff != nil {
+			cost := p.Energy * *b.tariff
+			p.Cost = &cost
+			errs = append(errs, onchange(name+"Cost", cost, ts))
+		}
+	}
+
+	return true, errors.Join(errs...)
+}
+
+// Tick starts new periods when the current ones have passed, so that the
+// consumption is reset even if no meter readings are received around the
+// period boundaries.
+func (b *building) Tick(ctx context.Context, now time.Time, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
+	if b.Consumption_ == nil {
+		return false, nil
+	}
+
+	started := b.rollPeriods(now)
+	if len(started) == 0 {
+		return false, nil
+	}
+
+	errs := []error{}
+
+	for _, name := range started {
+		p := b.periods()[name]
+		errs = append(errs, onchange(name+"Consumption", 0, p.Start))
+		if b.tariff != nil {
+			errs = append(errs, onchange(name+"Cost", 0, p.Start))
+		}
+	}
+
+	return true, errors.Join(errs...)
+}
+
+func (b *building) periods() map[string]*period {
+	return map[string]*period{
+		Hourly:  &b.Consumption_.Hour,
+		Daily:   &b.Consumption_.Day,
+		Monthly: &b.Consumption_.Month,
+	}
+}
+
+// rollPeriods moves each period that has passed into the period that contains
+// ts, and returns the names of the periods that were started over
+func (b *building) rollPeriods(ts time.Time) []string {
+	started := []string{}
+
+	for name, p := range b.periods() {
+		start := periodStart(ts, name, b.location)
+		if !start.After(p.Start) {
+			continue
+		}
+
+		if !p.Start.IsZero() {
+			started = append(started, name)
+		}
+
+		p.Start = start
+		p.Energy = 0
+		if b.tariff != nil {
+			p.Cost = new(float64)
+		}
+	}
+
+	return started
+}
+
+func periodStart(ts time.Time, name string, loc *time.Location) time.Time {
+	t := ts.In(loc)
+	year, month, day := t.Date()
+
+	switch name {
+	case Hourly:
+		return time.Date(year, month, day, t.Hour(), 0, 0, 0, loc).UTC()
+	case Monthly:
+		day = 1
+	}
+
+	return time.Date(year, month, day, 0, 0, 0, 0, loc).UTC()
+}
+
 func hasChanged(previousLevel, newLevel float64) bool {
 	return isNotZero(newLevel - previousLevel)
 }
@@ -74,6 +341,16 @@ func isNotZero(value float64) bool {
 	return (math.Abs(value) >= 0.001)
 }
 
+// measure marks the quantity as known and reports whether it was known before
+func (b *building) measure(name string) bool {
+	if slices.Contains(b.Measured, name) {
+		return true
+	}
+
+	b.Measured = append(b.Measured, name)
+	return false
+}
+
 func (b *building) CurrentPower() float64 {
 	return b.Power
 }
@@ -81,3 +358,17 @@ func (b *building) CurrentPower() float64 {
 func (b *building) CurrentEnergy() float64 {
 	return b.Energy
 }
+
+// Consumption returns the energy consumed in kWh since the start of the
+// current hourly, daily or monthly period
+func (b *building) Consumption(name string) float64 {
+	if b.Consumption_ == nil {
+		return 0
+	}
+
+	if p, ok := b.periods()[name]; ok {
+		return p.Energy
+	}
+
+	return 0
+}
@@ -15,7 +15,7 @@ import (
 func TestBuildingPower(t *testing.T) {
 	is := is.New(t)
 
-	b := New()
+	b, _ := New("")
 
 	b.Handle(context.Background(), newValue(lwm2m.Power, 22322.0), func(string, float64, time.Time) error { return nil })
 	is.Equal(b.CurrentPower(), 22.322)
@@ -24,12 +24,180 @@ func TestBuildingPower(t *testing.T) {
 func TestBuildingEnergy(t *testing.T) {
 	is := is.New(t)
 
-	b := New()
+	b, _ := New("")
 
 	b.Handle(context.Background(), newValue(lwm2m.Energy, 3600.0), func(s string, f float64, ts time.Time) error { return nil })
 	is.Equal(b.CurrentEnergy(), 0.001)
 }
 
+func TestBuildingConsumption(t *testing.T) {
+	is := is.New(t)
+
+	b, err := New("tz=Europe/Stockholm,tariff=2")
+	is.NoErr(err)
+
+	logged := map[string]float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		logged[prop] = v
+		return nil
+	}
+
+	// readings in kWh at local time (UTC+1)
+	readings := []struct {
+		kWh float64
+		at  string
+	}{
+		{100, "2023-02-07T22:00:00Z"},
+		{102, "2023-02-07T22:30:00Z"},
+		{105, "2023-02-07T22:45:00Z"},
+		{106, "2023-02-07T23:15:00Z"}, // a new day has started in Stockholm
+	}
+
+	for _, r := range readings {
+		_, err := b.Handle(context.Background(), newEnergy(r.kWh, r.at), onchange)
+		is.NoErr(err)
+	}
+
+	// half of the last 1 kWh was consumed before the new day started
+	is.Equal(b.Consumption(Hourly), 0.5)
+	is.Equal(b.Consumption(Daily), 0.5)
+	is.Equal(b.Consumption(Monthly), 6.0)
+	is.Equal(logged["monthlyCost"], 12.0)
+	is.Equal(logged["power"], 2.0) // estimated from the last 1 kWh over 30 minutes
+
+	changed, err := b.Tick(context.Background(), time.Date(2023, 2, 8, 0, 0, 0, 0, time.UTC), onchange)
+	is.NoErr(err)
+	is.True(changed)
+	is.Equal(b.Consumption(Hourly), 0.0)
+	is.Equal(b.Consumption(Daily), 0.5)
+	is.Equal(logged["hourlyConsumption"], 0.0)
+}
+
+func TestBuildingConsumptionIsSplitAtPeriodBoundaries(t *testing.T) {
+	is := is.New(t)
+
+	b, err := New("")
+	is.NoErr(err)
+
+	onchange := func(string, float64, time.Time) error { return nil }
+	handle := func(kWh float64, at string) {
+		_, err := b.Handle(context.Background(), newEnergy(kWh, at), onchange)
+		is.NoErr(err)
+	}
+
+	handle(100, "2023-01-31T23:00:00Z")
+	handle(102, "2023-01-31T23:45:00Z")
+	handle(110, "2023-02-01T00:15:00Z") // a new hour, day and month has started
+
+	is.Equal(b.Consumption(Hourly), 4.0) // the 4 kWh consumed after midnight
+	is.Equal(b.Consumption(Daily), 4.0)
+	is.Equal(b.Consumption(Monthly), 4.0)
+
+	handle(114, "2023-02-01T01:45:00Z") // a reading that spans a whole hour
+	is.Equal(b.Consumption(Hourly), 2.0)
+	is.Equal(b.Consumption(Daily), 8.0)
+}
+
+func TestBuildingMeterResetAndRollover(t *testing.T) {
+	is := is.New(t)
+
+	b, err := New("rollover=1000")
+	is.NoErr(err)
+
+	onchange := func(string, float64, time.Time) error { return nil }
+	handle := func(kWh float64, at string) {
+		_, err := b.Handle(context.Background(), newEnergy(kWh, at), onchange)
+		is.NoErr(err)
+	}
+
+	handle(990, "2023-02-07T10:00:00Z")
+	handle(5, "2023-02-07T10:10:00Z") // rolled over at 1000
+	is.Equal(b.Consumption(Hourly), 15.0)
+
+	handle(20, "2023-02-07T10:20:00Z")
+	handle(2, "2023-02-07T10:30:00Z") // reset, far from the rollover value
+	is.Equal(b.Consumption(Hourly), 32.0)
+}
+
+func TestBuildingPowerIsNotEstimatedWithPowerSensor(t *testing.T) {
+	is := is.New(t)
+
+	b, _ := New("")
+	onchange := func(string, float64, time.Time) error { return nil }
+
+	b.Handle(context.Background(), newValue(lwm2m.Power, 1500.0), onchange)
+	b.Handle(context.Background(), newEnergy(10, "2023-02-07T21:00:00Z"), onchange)
+	b.Handle(context.Background(), newEnergy(20, "2023-02-07T22:00:00Z"), onchange)
+
+	is.Equal(b.CurrentPower(), 1.5)
+}
+
+func TestBuildingIgnoresLateEnergyReadings(t *testing.T) {
+	is := is.New(t)
+
+	b, _ := New("")
+
+	logged := []string{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		logged = append(logged, prop)
+		return nil
+	}
+
+	b.Handle(context.Background(), newEnergy(100, "2023-02-07T10:00:00Z"), onchange)
+	b.Handle(context.Background(), newEnergy(105, "2023-02-07T10:30:00Z"), onchange)
+
+	logged = logged[:0]
+	changed, err := b.Handle(context.Background(), newEnergy(102, "2023-02-07T10:15:00Z"), onchange)
+	is.NoErr(err)
+	is.True(!changed)
+	is.Equal(len(logged), 0)           // a late reading should not be logged
+	is.Equal(b.CurrentEnergy(), 105.0) // nor replace the current meter value
+
+	b.Handle(context.Background(), newEnergy(106, "2023-02-07T10:45:00Z"), onchange)
+	is.Equal(b.Consumption(Hourly), 6.0) // nor make the next reading count consumption twice
+}
+
+func TestBuildingPowerSensorIsKeptAfterRestart(t *testing.T) {
+	is := is.New(t)
+
+	b, _ := New("")
+	onchange := func(string, float64, time.Time) error { return nil }
+
+	b.Handle(context.Background(), newValue(lwm2m.Power, 1500.0), onchange)
+	b.Handle(context.Background(), newEnergy(10, "2023-02-07T21:00:00Z"), onchange)
+
+	state, err := json.Marshal(b)
+	is.NoErr(err)
+
+	restored, _ := New("")
+	is.NoErr(json.Unmarshal(state, restored))
+
+	restored.Handle(context.Background(), newEnergy(20, "2023-02-07T22:00:00Z"), onchange)
+	is.Equal(restored.CurrentPower(), 1.5) // power should still not be estimated
+}
+
+func TestBuildingReportsUnknownQuantitiesAsZero(t *testing.T) {
+	is := is.New(t)
+
+	b, _ := New("")
+	b.Handle(context.Background(), newValue(lwm2m.Power, 1500.0), func(string, float64, time.Time) error { return nil })
+
+	state, err := json.Marshal(b)
+	is.NoErr(err)
+
+	// energy is still reported, while measured tells that only power is known
+	is.Equal(string(state), `{"energy":0,"power":1.5,"measured":["power"],"powerSensor":true}`)
+}
+
+func newEnergy(kWh float64, at string) *events.MessageAccepted {
+	ts, _ := time.Parse(time.RFC3339, at)
+
+	e := &events.MessageAccepted{}
+	json.Unmarshal(
+		fmt.Appendf(nil, timedMessageJSONFormat, ts.Unix(), lwm2m.Energy, kWh*3600000, at), e)
+	return e
+}
+
 func newValue(baseName string, value float64) *events.MessageAccepted {
 	e := &events.MessageAccepted{}
 	json.Unmarshal(
@@ -44,3 +212,11 @@ const messageJSONFormat string = `{
 	],
 	"timestamp":"2023-02-07T20:17:17.312028Z"
 }`
+
+const timedMessageJSONFormat string = `{
+	"pack":[
+		{"bn":"testid","bt":%d,"n":"0","vs":"%s"},
+		{"n":"5700","u":"J","v":%f}
+	],
+	"timestamp":"%s"
+}`
@@ -0,0 +1,222 @@
+package composites
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/pkg/messaging/events"
+)
+
+const (
+	FunctionTypeName string = "composite"
+)
+
+const (
+	OpSum string = "sum"
+	OpAvg string = "avg"
+	OpMin string = "min"
+	OpMax string = "max"
+	OpAny string = "any"
+	OpAll string = "all"
+)
+
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "composite",
+		DefaultHistoryLabel: "value",
+		Sensorless:          true,
+		Sources: func(args string) []string {
+			c, err := New(args)
+			if err != nil {
+				return nil
+			}
+			return c.Sources()
+		},
+		Args: []factories.Arg{
+			{Name: "sources", Kind: factories.List},
+			{Name: "op", Values: []string{OpSum, OpAvg, OpMin, OpMax, OpAny, OpAll}},
+			{Name: "prop"},
+		},
+		New: func(env factories.Env) (factories.State, error) {
+			c, err := New(env.Args)
+			if err != nil {
+				return nil, err
+			}
+
+			if slices.Contains(c.Sources(), env.ID) {
+				return nil, fmt.Errorf("composite function %s can not be a source of itself", env.ID)
+			}
+
+			return c, nil
+		},
+	})
+}
+
+// Composite combines the values of other functions instead of handling
+// messages from sensors.
+type Composite interface {
+	factories.Combiner
+	Handle(context.Context, *events.MessageAccepted, func(string, float64, time.Time) error) (bool, error)
+	Value() float64
+}
+
+// New creates a composite function from a config string such as
+// "sources=counter1|counter2|counter3,op=sum,prop=count". The value of a
+// composite is the result of applying op to the latest value of prop from
+// each of the source functions, where prop defaults to the property that the
+// source logs by default. The any and all ops treat non zero values as true
+// and result in 1 or 0.
+func New(config string) (Composite, error) {
+	c := &composite{
+		op:     OpSum,
+		Inputs: map[string]float64{},
+	}
+
+	config = strings.ReplaceAll(config, " ", "")
+	settings := strings.Split(config, ",")
+
+	for _, s := range settings {
+		pair := strings.Split(s, "=")
+		if len(pair) != 2 {
+			continue
+		}
+
+		var err error
+
+		switch pair[0] {
+		case "sources":
+			for id := range strings.SplitSeq(pair[1], "|") {
+				if id != "" && !slices.Contains(c.sources, id) {
+					c.sources = append(c.sources, id)
+				}
+			}
+		case "op":
+			if !slices.Contains([]string{OpSum, OpAvg, OpMin, OpMax, OpAny, OpAll}, pair[1]) {
+				err = fmt.Errorf("unknown op")
+			}
+			c.op = pair[1]
+		case "prop":
+			c.property = pair[1]
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse composite config \"%s\": %w", s, err)
+		}
+	}
+
+	if len(c.sources) == 0 {
+		return nil, fmt.Errorf("composite config must contain at least one source function")
+	}
+
+	return c, nil
+}
+
+type composite struct {
+	sources  []string
+	op       string
+	property string
+
+	Value_ *float64 `json:"value,omitempty"`
+	// Inputs holds the latest value from each source function, keyed by function id
+	Inputs map[string]float64 `json:"inputs"`
+}
+
+// Handle never matches, composites are only updated by their source functions
+func (c *composite) Handle(ctx context.Context, e *events.MessageAccepted, onchange func(string, float64, time.Time) error) (bool, error) {
+	return false, events.ErrNoMatch
+}
+
+// Update stores a new value from one of the source functions and recalculates
+// the value of the composite.
+func (c *composite) Update(ctx context.Context, source string, value float64, ts time.Time, onchange func(string, float64, time.Time) error) (bool, error) {
+	if !slices.Contains(c.sources, source) {
+		return false, fmt.Errorf("function %s is not a source of this composite", source)
+	}
+
+	if c.Inputs == nil {
+		c.Inputs = map[string]float64{}
+	}
+
+	c.Inputs[source] = value
+
+	values := make([]float64, 0, len(c.sources))
+	for _, id := range c.sources {
+		if v, ok := c.Inputs[id]; ok {
+			values = append(values, v)
+		}
+	}
+
+	v := c.apply(values)
+
+	if c.Value_ != nil && !hasChanged(*c.Value_, v) {
+		return false, nil
+	}
+
+	c.Value_ = &v
+
+	return true, onchange("value", v, ts)
+}
+
+func (c *composite) apply(values []float64) float64 {
+	switch c.op {
+	case OpAvg:
+		return sum(values) / float64(len(values))
+	case OpMin:
+		return slices.Min(values)
+	case OpMax:
+		return slices.Max(values)
+	case OpAny:
+		return boolValue(slices.ContainsFunc(values, isNotZero))
+	case OpAll:
+		return boolValue(!slices.ContainsFunc(values, func(v float64) bool { return !isNotZero(v) }))
+	default:
+		return sum(values)
+	}
+}
+
+func (c *composite) Sources() []string {
+	return c.sources
+}
+
+func (c *composite) Property() string {
+	return c.property
+}
+
+func (c *composite) Value() float64 {
+	if c.Value_ != nil {
+		return *c.Value_
+	}
+
+	return 0.0
+}
+
+func sum(values []float64) float64 {
+	s := 0.0
+	for _, v := range values {
+		s += v
+	}
+	return s
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func hasChanged(prev, new float64) bool {
+	return isNotZero(new - prev)
+}
+
+func isNotZero(value float64) bool {
+	return (math.Abs(value) >= 0.001)
+}
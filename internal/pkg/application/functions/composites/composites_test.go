@@ -0,0 +1,81 @@
+package composites
+
+import (
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/matryer/is"
+)
+
+func TestCompositeOps(t *testing.T) {
+	is := is.New(t)
+
+	inputs := []struct {
+		source string
+		value  float64
+	}{{"a", 2}, {"b", 0}, {"c", 7}, {"a", 3}}
+
+	expectations := map[string]float64{
+		OpSum: 10, OpAvg: 10.0 / 3.0, OpMin: 0, OpMax: 7, OpAny: 1, OpAll: 0,
+	}
+
+	for op, expected := range expectations {
+		c, err := New("sources=a|b|c,op=" + op)
+		is.NoErr(err)
+
+		for _, in := range inputs {
+			_, err := c.Update(t.Context(), in.source, in.value, time.Now(), func(string, float64, time.Time) error { return nil })
+			is.NoErr(err)
+		}
+
+		is.Equal(c.Value(), expected) // unexpected value for op
+	}
+}
+
+func TestCompositeOnlyReportsChanges(t *testing.T) {
+	is := is.New(t)
+
+	c, err := New("sources=a|b,op=max,prop=temperature")
+	is.NoErr(err)
+	is.Equal(c.Property(), "temperature")
+
+	logged := []float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		is.Equal(prop, "value")
+		logged = append(logged, v)
+		return nil
+	}
+
+	changed, _ := c.Update(t.Context(), "a", 20, time.Now(), onchange)
+	is.True(changed)
+
+	changed, _ = c.Update(t.Context(), "b", 18, time.Now(), onchange)
+	is.True(!changed) // the max is still 20
+
+	changed, _ = c.Update(t.Context(), "b", 21, time.Now(), onchange)
+	is.True(changed)
+
+	is.Equal(logged, []float64{20, 21})
+}
+
+func TestCompositeDoesNotHandleMessages(t *testing.T) {
+	is := is.New(t)
+
+	c, _ := New("sources=a")
+	_, err := c.Handle(t.Context(), &events.MessageAccepted{}, func(string, float64, time.Time) error { return nil })
+	is.Equal(err, events.ErrNoMatch)
+
+	_, err = c.Update(t.Context(), "b", 1, time.Now(), func(string, float64, time.Time) error { return nil })
+	is.True(err != nil) // b is not a source
+}
+
+func TestInvalidCompositeConfig(t *testing.T) {
+	is := is.New(t)
+
+	_, err := New("op=sum")
+	is.True(err != nil) // sources are required
+
+	_, err = New("sources=a|b,op=median")
+	is.True(err != nil)
+}
@@ -0,0 +1,486 @@
+package functions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is an error in a functions config, along with the line that it
+// was found on
+type ConfigError struct {
+	Line int
+	Err  error
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+func (e ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors are all the errors that were found in a functions config
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// configEntry is a function setting along with where it was found in the config
+type configEntry struct {
+	setting Setting
+	// line is the line that the function starts on
+	line int
+	// lines are the lines of the fields of the function, and of its args as "args.<name>"
+	lines map[string]int
+}
+
+func (e configEntry) lineOf(field string) int {
+	if l, ok := e.lines[field]; ok {
+		return l
+	}
+	return e.line
+}
+
+// LoadConfig reads and validates the function settings in a functions config.
+// The config is either a YAML or JSON document with a list of functions, such as
+//
+//	functions:
+//	  - id: level-01
+//	    name: Sandmagasin
+//	    type: level
+//	    subtype: sand
+//	    sensors: [sensor-01, sensor-02]
+//	    args:
+//	      maxd: 3.0
+//	      maxl: 2.5
+//
+// or lines in the older semicolon separated format
+// "functionID;name;type;subtype;sensorIDs;onupdate;args", where a first line with
+// the column names is skipped. The args of each function are validated against
+// the schema of its type, and every error is reported along with its line.
+func LoadConfig(input io.Reader) ([]Setting, error) {
+	if input == nil {
+		return []Setting{}, nil
+	}
+
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read functions config: %w", err)
+	}
+
+	var entries []configEntry
+	var errs ConfigErrors
+
+	if isCSV(data) {
+		entries, errs = parseCSV(data)
+	} else {
+		entries, errs = parseStructured(data)
+	}
+
+	errs = append(errs, validateEntries(entries)...)
+
+	if len(errs) > 0 {
+		slices.SortStableFunc(errs, func(a, b ConfigError) int { return a.Line - b.Line })
+		return nil, errs
+	}
+
+	settings := make([]Setting, 0, len(entries))
+	for _, e := range entries {
+		settings = append(settings, e.setting)
+	}
+
+	return settings, nil
+}
+
+// isCSV tells if the first line with any content is in the semicolon separated format
+func isCSV(data []byte) bool {
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return strings.Contains(line, ";") && !strings.HasPrefix(line, "{") && !strings.HasPrefix(line, "[")
+	}
+	return false
+}
+
+func parseCSV(data []byte) ([]configEntry, ConfigErrors) {
+	entries := []configEntry{}
+	errs := ConfigErrors{}
+
+	lineNo := 0
+
+	for line := range strings.Lines(string(data)) {
+		lineNo++
+
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens := strings.Split(line, ";")
+		tokenCount := len(tokens)
+
+		if lineNo == 1 && tokenCount > 2 && tokens[2] == "type" {
+			continue // the column names
+		}
+
+		if tokenCount < 4 {
+			errs = append(errs, ConfigError{Line: lineNo, Err: fmt.Errorf("expected at least 4 fields separated by ;, got %d", tokenCount)})
+			continue
+		}
+
+		s := Setting{
+			ID:      tokens[0],
+			Name:    tokens[1],
+			Type:    tokens[2],
+			SubType: tokens[3],
+		}
+
+		if tokenCount > 4 {
+			s.SensorID = tokens[4]
+		}
+
+		if tokenCount > 5 && tokens[5] != "" {
+			onupdate, err := strconv.ParseBool(tokens[5])
+			if err != nil {
+				errs = append(errs, ConfigError{Line: lineNo, Err: fmt.Errorf("onupdate must be true or false, got %q", tokens[5])})
+			}
+			s.OnUpdate = onupdate
+		}
+
+		if tokenCount > 6 {
+			s.Args = tokens[6]
+		}
+
+		entries = append(entries, configEntry{setting: s, line: lineNo})
+	}
+
+	return entries, errs
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+func parseStructured(data []byte) ([]configEntry, ConfigErrors) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return []configEntry{}, nil
+	}
+
+	if trimmed[0] == '{' || trimmed[0] == '[' {
+		// JSON is valid YAML, apart from being indented with tabs
+		lines := strings.Split(string(data), "\n")
+		for i, l := range lines {
+			indented := strings.TrimLeft(l, "\t ")
+			lines[i] = strings.Repeat(" ", len(l)-len(indented)) + indented
+		}
+		data = []byte(strings.Join(lines, "\n"))
+	}
+
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		line := 1
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+		}
+		return nil, ConfigErrors{{Line: line, Err: err}}
+	}
+
+	root := &doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+
+	errs := ConfigErrors{}
+
+	list := root
+	if root.Kind == yaml.MappingNode {
+		list = nil
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			key, value := root.Content[i], root.Content[i+1]
+			if key.Value == "functions" {
+				list = value
+			} else {
+				errs = append(errs, ConfigError{Line: key.Line, Err: fmt.Errorf("unknown field %q", key.Value)})
+			}
+		}
+
+		if list == nil {
+			return nil, append(errs, ConfigError{Line: root.Line, Err: errors.New("functions are missing")})
+		}
+	}
+
+	if list.Kind != yaml.SequenceNode {
+		return nil, append(errs, ConfigError{Line: list.Line, Err: errors.New("functions must be a list")})
+	}
+
+	entries := []configEntry{}
+
+	for _, item := range list.Content {
+		e, itemErrs := parseFunctionNode(item)
+		errs = append(errs, itemErrs...)
+		if len(itemErrs) == 0 {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, errs
+}
+
+func parseFunctionNode(node *yaml.Node) (configEntry, ConfigErrors) {
+	e := configEntry{line: node.Line, lines: map[string]int{}}
+	errs := ConfigErrors{}
+
+	if node.Kind != yaml.MappingNode {
+		return e, ConfigErrors{{Line: node.Line, Err: errors.New("a function must be a mapping of fields")}}
+	}
+
+	fail := func(n *yaml.Node, format string, a ...any) {
+		errs = append(errs, ConfigError{Line: n.Line, Err: fmt.Errorf(format, a...)})
+	}
+
+	scalar := func(key, value *yaml.Node, field *string) {
+		if value.Kind != yaml.ScalarNode {
+			fail(value, "%s must be a string", key.Value)
+			return
+		}
+		*field = value.Value
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		e.lines[key.Value] = key.Line
+
+		switch key.Value {
+		case "id":
+			scalar(key, value, &e.setting.ID)
+		case "name":
+			scalar(key, value, &e.setting.Name)
+		case "type":
+			scalar(key, value, &e.setting.Type)
+		case "subtype":
+			scalar(key, value, &e.setting.SubType)
+		case "tenant":
+			scalar(key, value, &e.setting.Tenant)
+		case "sensorID", "sensors":
+			if value.Kind == yaml.SequenceNode {
+				ids := []string{}
+				for _, id := range value.Content {
+					if id.Kind != yaml.ScalarNode {
+						fail(id, "%s must be a list of sensor ids", key.Value)
+						continue
+					}
+					ids = append(ids, id.Value)
+				}
+				e.setting.SensorID = strings.Join(ids, ",")
+			} else {
+				scalar(key, value, &e.setting.SensorID)
+			}
+		case "onupdate":
+			if err := value.Decode(&e.setting.OnUpdate); err != nil {
+				fail(value, "onupdate must be true or false, got %q", value.Value)
+			}
+		case "args":
+			args, argErrs := parseArgsNode(value, e.lines)
+			errs = append(errs, argErrs...)
+			e.setting.Args = args
+		default:
+			fail(key, "unknown field %q", key.Value)
+		}
+	}
+
+	return e, errs
+}
+
+// parseArgsNode converts the args of a function to the key=value format that
+// function types are configured with, where lists are separated by |. The
+// args may also be given as a string in that format.
+func parseArgsNode(node *yaml.Node, lines map[string]int) (string, ConfigErrors) {
+	if node.Kind == yaml.ScalarNode {
+		return node.Value, nil
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return "", ConfigErrors{{Line: node.Line, Err: errors.New("args must be a mapping of settings")}}
+	}
+
+	pairs := []string{}
+	errs := ConfigErrors{}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		lines["args."+key.Value] = key.Line
+
+		switch value.Kind {
+		case yaml.ScalarNode:
+			pairs = append(pairs, key.Value+"="+value.Value)
+		case yaml.SequenceNode:
+			items := []string{}
+			for _, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					errs = append(errs, ConfigError{Line: item.Line, Err: fmt.Errorf("%s must be a list of values", key.Value)})
+					continue
+				}
+				items = append(items, item.Value)
+			}
+			pairs = append(pairs, key.Value+"="+strings.Join(items, "|"))
+		default:
+			errs = append(errs, ConfigError{Line: value.Line, Err: fmt.Errorf("%s must be a value or a list of values", key.Value)})
+		}
+	}
+
+	return strings.Join(pairs, ","), errs
+}
+
+// validateSettings checks settings that are not read from a config file in
+// the same way as LoadConfig does, with the position of each setting in place
+// of its line
+func validateSettings(settings []Setting) error {
+	entries := make([]configEntry, 0, len(settings))
+	for i, s := range settings {
+		entries = append(entries, configEntry{setting: s, line: i + 1})
+	}
+
+	if errs := validateEntries(entries); len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrInvalidSetting, errs)
+	}
+
+	return nil
+}
+
+// validateEntries checks the settings of all functions, including their args
+// against the schema of their type, and reports every error that is found
+func validateEntries(entries []configEntry) ConfigErrors {
+	errs := ConfigErrors{}
+	ids := map[string]int{}
+
+	// graph holds the sources of the composite functions, so that composites
+	// that depend on themselves can be found once every entry is checked
+	graph := map[string][]string{}
+	compositeEntries := map[string]configEntry{}
+
+	for _, e := range entries {
+		s := e.setting
+		numErrs := len(errs)
+
+		fail := func(field string, format string, a ...any) {
+			errs = append(errs, ConfigError{Line: e.lineOf(field), Err: fmt.Errorf(format, a...)})
+		}
+
+		if s.ID == "" {
+			fail("id", "id is missing")
+		} else if first, ok := ids[s.ID]; ok {
+			fail("id", "duplicate function id %q, first defined on line %d", s.ID, first)
+		} else {
+			ids[s.ID] = e.line
+		}
+
+		if s.Type == "" {
+			fail("type", "type is missing")
+			continue
+		}
+
+		factory, ok := factories.Get(s.Type)
+		if !ok {
+			fail("type", "unknown function type %q, expected one of %s", s.Type, strings.Join(factories.Types(), ", "))
+			continue
+		}
+
+		if len(s.SensorIDs()) == 0 && !factory.Sensorless {
+			fail("sensors", "sensor id is missing")
+		}
+
+		if !factory.ArbitraryArgs {
+			for pair := range strings.SplitSeq(strings.ReplaceAll(s.Args, " ", ""), ",") {
+				if pair == "" {
+					continue
+				}
+
+				name, value, ok := strings.Cut(pair, "=")
+				field := "args." + name
+
+				arg, known := factory.Arg(name)
+				if !ok || strings.Contains(value, "=") {
+					fail(field, "expected a setting such as name=value, got %q", pair)
+				} else if !known {
+					fail(field, "unknown setting %q for function type %s", name, s.Type)
+				} else if err := arg.Validate(value); err != nil {
+					fail(field, "%s", err.Error())
+				}
+			}
+		}
+
+		// let the function type check the combination of its settings, unless
+		// the settings have errors already
+		if len(errs) == numErrs {
+			_, err := factory.New(factories.Env{ID: s.ID, Args: s.Args, Clock: clock.New()})
+			if err != nil {
+				fail("args", "%s", err.Error())
+			}
+		}
+
+		if len(errs) == numErrs {
+			if sources := s.SourceIDs(); len(sources) > 0 {
+				graph[s.ID] = sources
+				compositeEntries[s.ID] = e
+			}
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(graph)) {
+		if cycle := compositeCycle(graph, id); cycle != nil {
+			errs = append(errs, ConfigError{
+				Line: compositeEntries[id].lineOf("args.sources"),
+				Err:  fmt.Errorf("composite function %s depends on itself via %s", id, strings.Join(cycle, " -> ")),
+			})
+		}
+	}
+
+	return errs
+}
+
+// compositeCycle returns a path of composite functions through which the
+// function with the given id depends on itself, starting and ending with id, or
+// nil if there is none. sources maps the ids of the composite functions to the
+// ids of their sources.
+func compositeCycle(sources map[string][]string, id string) []string {
+	visited := map[string]bool{}
+
+	var path func(from string) []string
+	path = func(from string) []string {
+		for _, source := range sources[from] {
+			if source == id {
+				return []string{from, source}
+			}
+
+			if visited[source] {
+				continue
+			}
+			visited[source] = true
+
+			if rest := path(source); rest != nil {
+				return append([]string{from}, rest...)
+			}
+		}
+		return nil
+	}
+
+	return path(id)
+}
@@ -0,0 +1,177 @@
+package functions
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestLoadYAMLConfig(t *testing.T) {
+	is := is.New(t)
+
+	config := `
+functions:
+  - id: level-01
+    name: Sandmagasin
+    type: level
+    subtype: sand
+    sensors: [sensor-01, sensor-02]
+    onupdate: true
+    args:
+      maxd: 3.0
+      maxl: 2.5
+      shape: table
+      table: ["0:0", "2.5:1200"]
+  - id: total
+    name: Totalt
+    type: composite
+    args:
+      sources: [counter-01, counter-02]
+      op: sum
+`
+
+	settings, err := LoadConfig(strings.NewReader(config))
+	is.NoErr(err)
+	is.Equal(len(settings), 2)
+
+	is.Equal(settings[0], Setting{
+		ID:       "level-01",
+		Name:     "Sandmagasin",
+		Type:     "level",
+		SubType:  "sand",
+		SensorID: "sensor-01,sensor-02",
+		OnUpdate: true,
+		Args:     "maxd=3.0,maxl=2.5,shape=table,table=0:0|2.5:1200",
+	})
+	is.Equal(settings[1].Args, "sources=counter-01|counter-02,op=sum")
+}
+
+func TestLoadJSONConfig(t *testing.T) {
+	is := is.New(t)
+
+	config := `[
+	{"id": "counter-01", "name": "Entré", "type": "counter", "sensorID": "sensor-01", "args": {"reset": "daily"}},
+	{"id": "counter-02", "name": "Utgång", "type": "counter", "sensorID": "sensor-02", "args": "reset=weekly"}
+]`
+
+	settings, err := LoadConfig(strings.NewReader(config))
+	is.NoErr(err)
+	is.Equal(len(settings), 2)
+	is.Equal(settings[0].Args, "reset=daily")
+	is.Equal(settings[1].Args, "reset=weekly")
+}
+
+func TestLoadConfigReportsEveryError(t *testing.T) {
+	is := is.New(t)
+
+	config := `functions:
+  - id: level-01
+    type: level
+    sensors: [sensor-01]
+    args:
+      maxd: deep
+      colour: red
+  - id: level-01
+    type: lever
+    sensors: [sensor-02]
+  - id: total
+    type: composite
+    args:
+      op: median
+  - id: timer-01
+    type: timer
+    onupdate: maybe
+`
+
+	_, err := LoadConfig(strings.NewReader(config))
+	is.True(err != nil)
+
+	var errs ConfigErrors
+	is.True(errors.As(err, &errs))
+
+	lines := []int{}
+	for _, e := range errs {
+		lines = append(lines, e.Line)
+	}
+
+	// maxd, colour, the duplicate id, the unknown type, op and onupdate
+	is.Equal(lines, []int{6, 7, 8, 9, 14, 17})
+}
+
+func TestLoadConfigRejectsCompositeCycles(t *testing.T) {
+	is := is.New(t)
+
+	config := `functions:
+  - id: a
+    type: composite
+    args:
+      sources: [b, counter-01]
+  - id: b
+    type: composite
+    args:
+      sources: [c]
+  - id: c
+    type: composite
+    args:
+      sources: [a]
+  - id: d
+    type: composite
+    args:
+      sources: [a]
+`
+
+	_, err := LoadConfig(strings.NewReader(config))
+
+	var errs ConfigErrors
+	is.True(errors.As(err, &errs))
+
+	lines := []int{}
+	for _, e := range errs {
+		lines = append(lines, e.Line)
+	}
+
+	is.Equal(lines, []int{5, 9, 13}) // d depends on the cycle, but is not part of it
+	is.True(strings.Contains(errs[0].Error(), "a -> b -> c -> a"))
+}
+
+func TestLoadCSVConfig(t *testing.T) {
+	is := is.New(t)
+
+	config := strings.Join([]string{
+		"functionID;name;type;subtype;sensorID;onupdate;args",
+		"counter-01;Entré;counter;peoplecounter;sensor-01;true;reset=daily",
+		"",
+		"level-01;Nivå;level;sand;sensor-02,sensor-03;false;maxd=3.0,maxl=2.5",
+	}, "\n")
+
+	settings, err := LoadConfig(strings.NewReader(config))
+	is.NoErr(err)
+	is.Equal(len(settings), 2)
+	is.True(settings[0].OnUpdate)
+	is.Equal(settings[1].SensorID, "sensor-02,sensor-03")
+}
+
+func TestLoadCSVConfigReportsEveryError(t *testing.T) {
+	is := is.New(t)
+
+	config := strings.Join([]string{
+		"counter-01;Entré;counter;peoplecounter;sensor-01;true;reset=hourly",
+		"level-01;Nivå",
+		"level-02;Nivå;level;sand;sensor-02;false;maxd",
+		"threshold-01;Larm;threshold;;sensor-03;false;urn=3303",
+	}, "\n")
+
+	_, err := LoadConfig(strings.NewReader(config))
+
+	var errs ConfigErrors
+	is.True(errors.As(err, &errs))
+	is.Equal(len(errs), 4)
+
+	for i, e := range errs {
+		is.Equal(e.Line, i+1) // one error on each line
+	}
+
+	is.True(strings.Contains(errs[3].Error(), "high and/or low limit")) // the function type checks its settings
+}
@@ -2,10 +2,14 @@ package counters
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"math"
+	"strings"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
 	"github.com/diwise/iot-core/pkg/lwm2m"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/senml"
@@ -15,25 +19,121 @@ const (
 	FunctionTypeName string = "counter"
 )
 
+const (
+	ResetDaily   string = "daily"
+	ResetWeekly  string = "weekly"
+	ResetMonthly string = "monthly"
+)
+
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "counter",
+		DefaultHistoryLabel: "count",
+		Args: []factories.Arg{
+			{Name: "reset", Values: []string{ResetDaily, ResetWeekly, ResetMonthly}},
+			{Name: "tz"},
+		},
+		New: func(env factories.Env) (factories.State, error) {
+			return New(env.Args)
+		},
+	})
+}
+
 type Counter interface {
 	Handle(context.Context, *events.MessageAccepted, func(prop string, value float64, ts time.Time) error) (bool, error)
+	Tick(context.Context, time.Time, func(prop string, value float64, ts time.Time) error) (bool, error)
 	Count() int
+	PeriodCount() int
 	State() bool
 }
 
-func New() Counter {
+// New creates a counter from a config string such as "reset=daily,tz=Europe/Stockholm".
+// A counter with a reset period keeps a separate count that starts over at the
+// beginning of each day, week (starting on mondays) or month in the given time
+// zone, while the total count keeps increasing. The time zone defaults to UTC.
+func New(config string) (Counter, error) {
 
 	c := &counter{
-		Count_: 0,
-		State_: false,
+		Count_:   0,
+		State_:   false,
+		location: time.UTC,
 	}
 
-	return c
+	reset := ""
+
+	config = strings.ReplaceAll(config, " ", "")
+	settings := strings.Split(config, ",")
+
+	for _, s := range settings {
+		pair := strings.Split(s, "=")
+		if len(pair) != 2 {
+			continue
+		}
+
+		var err error
+
+		switch pair[0] {
+		case "reset":
+			if pair[1] != ResetDaily && pair[1] != ResetWeekly && pair[1] != ResetMonthly {
+				err = fmt.Errorf("unknown reset period")
+			}
+			reset = pair[1]
+		case "tz":
+			c.location, err = time.LoadLocation(pair[1])
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse counter config \"%s\": %w", s, err)
+		}
+	}
+
+	if reset != "" {
+		c.reset = reset
+		c.Period = &period{Reset: reset}
+	}
+
+	return c, nil
 }
 
 type counter struct {
 	Count_ int  `json:"count"`
 	State_ bool `json:"state"`
+
+	Period *period `json:"period,omitempty"`
+
+	reset    string
+	location *time.Location
+}
+
+// UnmarshalJSON restores the counts from a stored state. The reset period is
+// configuration, so a stored period that was counted with another reset period,
+// or none at all, is started over rather than kept.
+func (c *counter) UnmarshalJSON(data []byte) error {
+	type counterState counter
+	if err := json.Unmarshal(data, (*counterState)(c)); err != nil {
+		return err
+	}
+
+	if c.reset == "" {
+		c.Period = nil
+	} else if c.Period == nil || c.Period.Reset != c.reset {
+		c.Period = &period{Reset: c.reset}
+	}
+
+	return nil
+}
+
+// period keeps track of the count since the start of the current reset period.
+// The start is persisted along with the count so that a restart within the
+// same period does not reset it, and the reset period so that a change of it
+// can be detected.
+type period struct {
+	Reset string     `json:"reset"`
+	Count int        `json:"count"`
+	Start *time.Time `json:"start,omitempty"`
 }
 
 func (c *counter) Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
@@ -77,6 +177,24 @@ func (c *counter) Handle(ctx context.Context, e *events.MessageAccepted, onchang
 	changed := false
 	errs := make([]error, 0)
 
+	if c.Period != nil && (countTimeOk || stateTimeOk) {
+		ts := stateTs
+		if countTimeOk {
+			ts = countTs
+		}
+
+		if c.rollover(ts) {
+			errs = append(errs, onchange("periodCount", 0, *c.Period.Start))
+			changed = true
+		}
+
+		// increments that belong to an earlier period only count towards the total
+		if delta := c.Count_ - previousCount; delta > 0 && !ts.Before(*c.Period.Start) {
+			c.Period.Count += delta
+			errs = append(errs, onchange("periodCount", float64(c.Period.Count), ts))
+		}
+	}
+
 	if countTimeOk && previousCount != c.Count_ {
 		errs = append(errs, onchange("count", float64(c.Count_), countTs))
 		changed = true
@@ -91,10 +209,68 @@ func (c *counter) Handle(ctx context.Context, e *events.MessageAccepted, onchang
 	return changed, errors.Join(errs...)
 }
 
+// Tick starts a new period when the current one has passed, so that the period
+// count is reset even if no messages are received around the period boundary.
+func (c *counter) Tick(ctx context.Context, now time.Time, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
+	if c.Period == nil || c.Period.Start == nil {
+		return false, nil
+	}
+
+	if !c.rollover(now) {
+		return false, nil
+	}
+
+	return true, onchange("periodCount", 0, *c.Period.Start)
+}
+
+// rollover moves the counter into the period that contains ts, if that period
+// is later than the current one. It reports whether the period count was reset.
+func (c *counter) rollover(ts time.Time) bool {
+	start := periodStart(ts, c.Period.Reset, c.location)
+
+	if c.Period.Start == nil {
+		c.Period.Start = &start
+		return false
+	}
+
+	if !start.After(*c.Period.Start) {
+		return false
+	}
+
+	c.Period.Start = &start
+	c.Period.Count = 0
+
+	return true
+}
+
+func periodStart(ts time.Time, reset string, loc *time.Location) time.Time {
+	t := ts.In(loc)
+	year, month, day := t.Date()
+
+	switch reset {
+	case ResetWeekly:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		day -= daysSinceMonday
+	case ResetMonthly:
+		day = 1
+	}
+
+	return time.Date(year, month, day, 0, 0, 0, 0, loc).UTC()
+}
+
 func (c *counter) Count() int {
 	return c.Count_
 }
 
+// PeriodCount returns the count since the start of the current reset period,
+// or the total count if the counter is never reset.
+func (c *counter) PeriodCount() int {
+	if c.Period == nil {
+		return c.Count_
+	}
+	return c.Period.Count
+}
+
 func (c *counter) State() bool {
 	return c.State_
 }
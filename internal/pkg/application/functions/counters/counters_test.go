@@ -14,7 +14,7 @@ import (
 func TestCounter(t *testing.T) {
 	is := is.New(t)
 
-	c := New()
+	c, _ := New("")
 	c.Handle(context.Background(), newState(true), func(string, float64, time.Time) error { return nil })
 
 	is.Equal(c.Count(), 1) // Should have changed one time
@@ -24,7 +24,7 @@ func TestCounter(t *testing.T) {
 func TestCounterDoubleOn(t *testing.T) {
 	is := is.New(t)
 
-	c := New()
+	c, _ := New("")
 	c.Handle(context.Background(), newState(true), func(string, float64, time.Time) error { return nil })
 	c.Handle(context.Background(), newState(true), func(string, float64, time.Time) error { return nil })
 
@@ -34,7 +34,7 @@ func TestCounterDoubleOn(t *testing.T) {
 func TestCounterOnOffOn(t *testing.T) {
 	is := is.New(t)
 
-	c := New()
+	c, _ := New("")
 	c.Handle(context.Background(), newState(true), func(string, float64, time.Time) error { return nil })
 	c.Handle(context.Background(), newState(false), func(string, float64, time.Time) error { return nil })
 	c.Handle(context.Background(), newState(true), func(string, float64, time.Time) error { return nil })
@@ -44,6 +44,88 @@ func TestCounterOnOffOn(t *testing.T) {
 	is.True(c.State() == false)
 }
 
+func TestCounterWithDailyReset(t *testing.T) {
+	is := is.New(t)
+
+	c, err := New("reset=daily,tz=Europe/Stockholm")
+	is.NoErr(err)
+
+	periodCounts := []float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		if prop == "periodCount" {
+			periodCounts = append(periodCounts, v)
+		}
+		return nil
+	}
+
+	// 23:30 UTC is already the next day in Stockholm
+	for _, ts := range []string{"2023-02-07T20:00:00Z", "2023-02-07T21:00:00Z", "2023-02-07T23:30:00Z"} {
+		c.Handle(context.Background(), newStateAt(true, ts), onchange)
+		c.Handle(context.Background(), newStateAt(false, ts), onchange)
+	}
+
+	is.Equal(c.Count(), 3)
+	is.Equal(c.PeriodCount(), 1)
+	is.Equal(periodCounts, []float64{1, 2, 0, 1})
+}
+
+func TestCounterWithWeeklyResetIsResetByTick(t *testing.T) {
+	is := is.New(t)
+
+	c, err := New("reset=weekly")
+	is.NoErr(err)
+
+	onchange := func(string, float64, time.Time) error { return nil }
+
+	c.Handle(context.Background(), newStateAt(true, "2023-02-08T12:00:00Z"), onchange) // a wednesday
+	is.Equal(c.PeriodCount(), 1)
+
+	changed, err := c.Tick(context.Background(), time.Date(2023, 2, 12, 23, 59, 0, 0, time.UTC), onchange)
+	is.NoErr(err)
+	is.True(!changed) // still the same week
+
+	changed, _ = c.Tick(context.Background(), time.Date(2023, 2, 13, 0, 1, 0, 0, time.UTC), onchange)
+	is.True(changed)
+	is.Equal(c.PeriodCount(), 0)
+	is.Equal(c.Count(), 1)
+}
+
+func TestCounterPeriodIsRestoredFromState(t *testing.T) {
+	is := is.New(t)
+
+	c, _ := New("reset=monthly")
+	c.Handle(context.Background(), newStateAt(true, "2023-02-07T12:00:00Z"), func(string, float64, time.Time) error { return nil })
+
+	state, err := json.Marshal(c)
+	is.NoErr(err)
+
+	restored, _ := New("reset=monthly")
+	is.NoErr(json.Unmarshal(state, restored))
+
+	changed, _ := restored.Tick(context.Background(), time.Date(2023, 2, 28, 0, 0, 0, 0, time.UTC), func(string, float64, time.Time) error { return nil })
+	is.True(!changed) // a restart within the period should not reset the period count
+	is.Equal(restored.PeriodCount(), 1)
+}
+
+func TestInvalidCounterConfig(t *testing.T) {
+	is := is.New(t)
+
+	_, err := New("reset=yearly")
+	is.True(err != nil)
+
+	_, err = New("reset=daily,tz=Nowhere/Special")
+	is.True(err != nil)
+}
+
+func newStateAt(on bool, timestamp string) *events.MessageAccepted {
+	ts, _ := time.Parse(time.RFC3339, timestamp)
+
+	e := &events.MessageAccepted{}
+	json.Unmarshal(
+		fmt.Appendf(nil, timedMessageJSONFormat, ts.Unix(), on, timestamp), e)
+	return e
+}
+
 func newState(on bool) *events.MessageAccepted {
 	e := &events.MessageAccepted{}
 	json.Unmarshal(
@@ -58,3 +140,11 @@ const messageJSONFormat string = `{
 	],
 	"timestamp":"2023-02-07T21:32:59.682607Z"
 }`
+
+const timedMessageJSONFormat string = `{
+	"pack":[
+		{"bn":"testid/3200/","bt":%d,"n":"0","vs":"urn:oma:lwm2m:ext:3200"},
+		{"n":"5500","vb":%t}
+	],
+	"timestamp":"%s"
+}`
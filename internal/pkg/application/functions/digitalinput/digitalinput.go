@@ -6,6 +6,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
 	"github.com/diwise/iot-core/pkg/lwm2m"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/senml"
@@ -15,6 +16,18 @@ const (
 	FunctionTypeName string = "digitalinput"
 )
 
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "digitalInput",
+		DefaultHistoryLabel: "digitalinput",
+		RestoreFromHistory:  true,
+		New: func(env factories.Env) (factories.State, error) {
+			return New(env.Last.Value), nil
+		},
+	})
+}
+
 type DigitalInput interface {
 	Handle(context.Context, *events.MessageAccepted, func(string, float64, time.Time) error) (bool, error)
 	State() bool
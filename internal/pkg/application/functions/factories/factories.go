@@ -0,0 +1,216 @@
+package factories
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
+	"github.com/diwise/iot-core/pkg/messaging/events"
+)
+
+// State is the type specific state of a function. It handles the messages
+// from the sensors that the function is bound to and reports the properties
+// that change using onchange, so that they are logged.
+type State interface {
+	Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error)
+}
+
+// Ticker is implemented by states that change with the passing of time, such
+// as timers, and need to update themselves between incoming messages.
+type Ticker interface {
+	Tick(ctx context.Context, now time.Time, onchange func(prop string, value float64, ts time.Time) error) (bool, error)
+}
+
+// Combiner is implemented by states that combine the values of other
+// functions instead of handling messages from sensors. Update is called with
+// the latest value of Property, or of the default property of the source if
+// it is empty, each time one of the Sources changes.
+type Combiner interface {
+	Update(ctx context.Context, source string, value float64, ts time.Time, onchange func(prop string, value float64, ts time.Time) error) (bool, error)
+	Sources() []string
+	Property() string
+}
+
+// Saver is implemented by states that can change without a change that should
+// be published, such as a count of rejected readings. Unsaved reports whether
+// the state has changed in such a way since it was last called, so that the
+// state is saved anyway.
+type Saver interface {
+	Unsaved() bool
+}
+
+// Labeler is implemented by states whose default history label depends on
+// their configuration rather than on their type.
+type Labeler interface {
+	DefaultHistoryLabel() string
+}
+
+// History returns the last lastN values that have been logged for prop by the
+// function, oldest first
+type History func(ctx context.Context, prop string, lastN int) ([]database.LogValue, error)
+
+// Env is what a factory is given to create the state of a function.
+type Env struct {
+	ID   string
+	Args string
+
+	// Last is the last value logged with the default history label, if the
+	// factory restores its state from history. It is the zero value otherwise.
+	Last database.LogValue
+
+	Clock   clock.Clock
+	History History
+}
+
+// FunctionFactory describes a function type and creates the state of the
+// functions of that type.
+type FunctionFactory struct {
+	// Type is the name of the function type in the function config
+	Type string
+	// JSONKey is the name of the property that holds the state when functions
+	// of the type are saved or published
+	JSONKey string
+	// DefaultHistoryLabel is the label that the main value of the function is
+	// logged with, unless the state is a Labeler
+	DefaultHistoryLabel string
+	// RestoreFromHistory tells that the state should be created from the last
+	// value logged with the default history label, for types that were around
+	// before the function states were saved
+	RestoreFromHistory bool
+	// Sensorless tells that functions of the type are updated by other
+	// functions rather than by sensors
+	Sensorless bool
+	// Sources returns the ids of the functions that a function of the type
+	// depends on, given its args, for types whose states are Combiners. It
+	// is used to check for cycles before the functions are created.
+	Sources func(args string) []string
+
+	// Args is the schema of the settings that functions of the type accept,
+	// used to validate function configs before the functions are created
+	Args []Arg
+	// ArbitraryArgs tells that any setting names are accepted, for types
+	// whose settings are named by the user
+	ArbitraryArgs bool
+
+	// New parses the args of a function and creates its state
+	New func(env Env) (State, error)
+}
+
+// ArgKind is the kind of value that a setting accepts
+type ArgKind int
+
+const (
+	String ArgKind = iota
+	Number
+	Integer
+	Bool
+	Duration
+	// List is a list of values, separated by | in args strings
+	List
+)
+
+func (k ArgKind) String() string {
+	return [...]string{"a string", "a number", "an integer", "a boolean", "a duration", "a list"}[k]
+}
+
+// Arg describes a setting in the args of a function
+type Arg struct {
+	Name string
+	Kind ArgKind
+	// Values are the allowed values of the setting, if it is restricted
+	Values []string
+}
+
+// Validate checks that value is of the kind of the setting, and one of its
+// allowed values if there are any
+func (a Arg) Validate(value string) error {
+	var err error
+
+	switch a.Kind {
+	case Number:
+		_, err = strconv.ParseFloat(value, 64)
+	case Integer:
+		_, err = strconv.Atoi(value)
+	case Bool:
+		_, err = strconv.ParseBool(value)
+	case Duration:
+		_, err = time.ParseDuration(value)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s must be %s, got %q", a.Name, a.Kind, value)
+	}
+
+	if len(a.Values) > 0 && !slices.Contains(a.Values, value) {
+		return fmt.Errorf("%s must be one of %s, got %q", a.Name, strings.Join(a.Values, ", "), value)
+	}
+
+	return nil
+}
+
+// Arg returns the schema of the named setting, if the type accepts it
+func (f FunctionFactory) Arg(name string) (Arg, bool) {
+	for _, a := range f.Args {
+		if a.Name == name {
+			return a, true
+		}
+	}
+
+	if f.ArbitraryArgs {
+		return Arg{Name: name, Kind: String}, true
+	}
+
+	return Arg{}, false
+}
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]FunctionFactory{}
+)
+
+// Register makes a function type available by its type name. It is meant to
+// be called from the init function of the package that implements the type,
+// and panics if the type is registered twice or is incomplete.
+func Register(f FunctionFactory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if f.Type == "" || f.JSONKey == "" || f.New == nil {
+		panic(fmt.Sprintf("function factory for type %q is incomplete", f.Type))
+	}
+
+	if _, ok := factories[f.Type]; ok {
+		panic(fmt.Sprintf("function factory for type %q registered twice", f.Type))
+	}
+
+	factories[f.Type] = f
+}
+
+// Get returns the factory of the named function type
+func Get(fnType string) (FunctionFactory, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	f, ok := factories[fnType]
+	return f, ok
+}
+
+// Types returns the names of all registered function types in sorted order
+func Types() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	types := make([]string, 0, len(factories))
+	for t := range factories {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+
+	return types
+}
@@ -0,0 +1,63 @@
+package factories
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/matryer/is"
+)
+
+type state struct{}
+
+func (s *state) Handle(context.Context, *events.MessageAccepted, func(string, float64, time.Time) error) (bool, error) {
+	return false, nil
+}
+
+func TestRegister(t *testing.T) {
+	is := is.New(t)
+
+	Register(FunctionFactory{
+		Type:    "test",
+		JSONKey: "test",
+		New:     func(env Env) (State, error) { return &state{}, nil },
+	})
+
+	f, ok := Get("test")
+	is.True(ok)
+	is.Equal(f.JSONKey, "test")
+	is.True(slices.Contains(Types(), "test"))
+
+	_, ok = Get("unknown")
+	is.True(!ok)
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	is := is.New(t)
+
+	f := FunctionFactory{
+		Type:    "twice",
+		JSONKey: "twice",
+		New:     func(env Env) (State, error) { return &state{}, nil },
+	}
+
+	Register(f)
+
+	defer func() {
+		is.True(recover() != nil) // registering a type twice should panic
+	}()
+
+	Register(f)
+}
+
+func TestRegisterIncompletePanics(t *testing.T) {
+	is := is.New(t)
+
+	defer func() {
+		is.True(recover() != nil) // a factory without New should panic
+	}()
+
+	Register(FunctionFactory{Type: "incomplete", JSONKey: "incomplete"})
+}
@@ -0,0 +1,295 @@
+package formulas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/diwise/senml"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+const (
+	FunctionTypeName string = "formula"
+)
+
+const lwm2mPrefix string = "urn:oma:lwm2m:ext:"
+
+// maxNodes limits the size of each expression
+const maxNodes uint = 500
+
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:    FunctionTypeName,
+		JSONKey: "formula",
+		// the settings are the names of the outputs, along with urn
+		ArbitraryArgs: true,
+		New: func(env factories.Env) (factories.State, error) {
+			return New(env.Args)
+		},
+	})
+}
+
+type Formula interface {
+	Handle(context.Context, *events.MessageAccepted, func(string, float64, time.Time) error) (bool, error)
+	Outputs() []string
+	Value(output string) (float64, bool)
+}
+
+// env is the environment that expressions are evaluated in. Expressions can
+// not call anything outside of it, nor the built in functions of the expression
+// language that are unrelated to calculations.
+type env struct {
+	// R holds the numeric (or boolean, as 1 or 0) values of the incoming pack keyed by
+	// record name. Values are untyped so that a missing record is nil rather than zero.
+	R map[string]any `expr:"r"`
+	// VS holds the string values of the incoming pack keyed by record name
+	VS map[string]string `expr:"vs"`
+	// Prev holds the outputs from the previous evaluation
+	Prev map[string]float64 `expr:"prev"`
+	// Out holds the outputs that have been evaluated so far in this evaluation
+	Out map[string]float64 `expr:"out"`
+	// T is the time of the incoming pack as seconds since the unix epoch
+	T float64 `expr:"t"`
+	// Device is the id of the device that sent the pack
+	Device string `expr:"device"`
+}
+
+type output struct {
+	name    string
+	program *vm.Program
+}
+
+// New creates a formula function from a config string with one or more
+// comma separated outputs such as `v = r["5700"] * 1.8 + 32, above = out.v > 100 ? 1 : 0`,
+// optionally restricted to packs of an object with "urn=3303". Each output
+// is an expression that is evaluated against the incoming pack, the outputs
+// that precede it in this evaluation (out) and the outputs from the previous
+// evaluation (prev), and must result in a number.
+func New(config string) (Formula, error) {
+	f := &formula{
+		Values: map[string]float64{},
+	}
+
+	statements, err := splitStatements(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse formula config: %w", err)
+	}
+
+	for _, s := range statements {
+		name, code, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("failed to parse formula config \"%s\": expected name = expression", s)
+		}
+
+		name = strings.TrimSpace(name)
+		code = strings.TrimSpace(code)
+
+		if name == "urn" {
+			f.objectURN = code
+			if !strings.HasPrefix(f.objectURN, lwm2mPrefix) {
+				f.objectURN = lwm2mPrefix + f.objectURN
+			}
+			continue
+		}
+
+		if !isIdentifier(name) {
+			return nil, fmt.Errorf("invalid formula output name \"%s\"", name)
+		}
+
+		for _, o := range f.outputs {
+			if o.name == name {
+				return nil, fmt.Errorf("formula output \"%s\" is defined more than once", name)
+			}
+		}
+
+		program, err := expr.Compile(code,
+			expr.Env(env{}),
+			expr.AsFloat64(),
+			expr.MaxNodes(maxNodes),
+			expr.DisableBuiltin("now"),
+			expr.DisableBuiltin("date"),
+			expr.DisableBuiltin("duration"),
+			expr.DisableBuiltin("timezone"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile formula output \"%s\": %w", name, err)
+		}
+
+		f.outputs = append(f.outputs, output{name: name, program: program})
+	}
+
+	if len(f.outputs) == 0 {
+		return nil, fmt.Errorf("formula config must contain at least one output")
+	}
+
+	return f, nil
+}
+
+type formula struct {
+	objectURN string
+	outputs   []output
+
+	Values    map[string]float64 `json:"values"`
+	Timestamp time.Time          `json:"timestamp"`
+}
+
+func (f *formula) Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
+	if f.objectURN != "" && !events.Matches(e, f.objectURN) {
+		return false, events.ErrNoMatch
+	}
+
+	ts, ok := e.Pack().GetTime(senml.FindByName("0"))
+	if !ok {
+		ts = e.Timestamp
+	}
+
+	in := env{
+		R:      map[string]any{},
+		VS:     map[string]string{},
+		Prev:   f.Values,
+		Out:    map[string]float64{},
+		T:      float64(ts.Unix()),
+		Device: e.DeviceID(),
+	}
+
+	for _, r := range e.Pack() {
+		if r.Name == "" {
+			continue
+		}
+
+		if v, ok := r.GetValue(); ok {
+			in.R[r.Name] = v
+		} else if r.BoolValue != nil {
+			in.R[r.Name] = map[bool]float64{true: 1, false: 0}[*r.BoolValue]
+		}
+
+		if r.StringValue != "" {
+			in.VS[r.Name] = r.StringValue
+		}
+	}
+
+	for _, o := range f.outputs {
+		result, err := expr.Run(o.program, in)
+		if err != nil {
+			return false, fmt.Errorf("failed to evaluate formula output \"%s\": %w", o.name, err)
+		}
+
+		v, ok := result.(float64)
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			return false, fmt.Errorf("formula output \"%s\" did not evaluate to a number (%v)", o.name, result)
+		}
+
+		in.Out[o.name] = v
+	}
+
+	changed := false
+	var errs []error
+
+	for _, o := range f.outputs {
+		v := in.Out[o.name]
+
+		if previous, ok := f.Values[o.name]; ok && !hasChanged(previous, v) {
+			continue
+		}
+
+		changed = true
+		errs = append(errs, onchange(o.name, v, ts))
+	}
+
+	f.Values = in.Out
+	f.Timestamp = ts
+
+	return changed, errors.Join(errs...)
+}
+
+// DefaultHistoryLabel returns the name of the first output, since formulas
+// have no main value of their own
+func (f *formula) DefaultHistoryLabel() string {
+	return f.outputs[0].name
+}
+
+func (f *formula) Outputs() []string {
+	names := make([]string, 0, len(f.outputs))
+	for _, o := range f.outputs {
+		names = append(names, o.name)
+	}
+	return names
+}
+
+func (f *formula) Value(output string) (float64, bool) {
+	v, ok := f.Values[output]
+	return v, ok
+}
+
+// splitStatements splits the config on commas that are not within quotes,
+// parentheses or brackets, so that expressions may contain commas.
+func splitStatements(config string) ([]string, error) {
+	statements := []string{}
+	depth := 0
+	var quote rune
+	start := 0
+
+	for i, c := range config {
+		switch {
+		case quote != 0:
+			if c == quote && (i == 0 || config[i-1] != '\\') {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced \"%c\" at position %d", c, i)
+			}
+		case c == ',' && depth == 0:
+			statements = append(statements, config[start:i])
+			start = i + 1
+		}
+	}
+
+	if quote != 0 || depth != 0 {
+		return nil, fmt.Errorf("unterminated quote or parenthesis")
+	}
+
+	statements = append(statements, config[start:])
+
+	nonEmpty := statements[:0]
+	for _, s := range statements {
+		if strings.TrimSpace(s) != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+
+	return nonEmpty, nil
+}
+
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, c := range name {
+		isLetter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+
+		if !isLetter && !(isDigit && i > 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasChanged(prev, new float64) bool {
+	return math.Abs(new-prev) >= 0.001
+}
@@ -0,0 +1,129 @@
+package formulas
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/matryer/is"
+)
+
+func TestFormula(t *testing.T) {
+	is := is.New(t)
+
+	f, err := New(`urn=3303, fahrenheit = r["5700"] * 1.8 + 32, hot = out.fahrenheit > 80 ? 1 : 0`)
+	is.NoErr(err)
+	is.Equal(f.Outputs(), []string{"fahrenheit", "hot"})
+
+	logged := map[string]float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		logged[prop] = v
+		return nil
+	}
+
+	changed, err := f.Handle(t.Context(), newTemperature(20), onchange)
+	is.NoErr(err)
+	is.True(changed)
+	is.Equal(logged, map[string]float64{"fahrenheit": 68, "hot": 0})
+
+	clear(logged)
+	changed, _ = f.Handle(t.Context(), newTemperature(30), onchange)
+	is.True(changed)
+	is.Equal(logged, map[string]float64{"fahrenheit": 86, "hot": 1})
+
+	clear(logged)
+	changed, _ = f.Handle(t.Context(), newTemperature(30), onchange)
+	is.True(!changed) // nothing has changed since the last evaluation
+	is.Equal(len(logged), 0)
+}
+
+func TestFormulaUsingPreviousState(t *testing.T) {
+	is := is.New(t)
+
+	f, err := New(`delta = "delta" in prev ? r["5700"] - prev.current : 0, current = r["5700"]`)
+	is.NoErr(err)
+
+	onchange := func(string, float64, time.Time) error { return nil }
+
+	f.Handle(t.Context(), newTemperature(20), onchange)
+	f.Handle(t.Context(), newTemperature(23.5), onchange)
+
+	v, ok := f.Value("delta")
+	is.True(ok)
+	is.Equal(v, 3.5)
+}
+
+func TestFormulaStateIsRestored(t *testing.T) {
+	is := is.New(t)
+
+	f, _ := New(`max = max(r["5700"], prev.max ?? 0)`)
+	f.Handle(t.Context(), newTemperature(30), func(string, float64, time.Time) error { return nil })
+
+	state, err := json.Marshal(f)
+	is.NoErr(err)
+
+	restored, _ := New(`max = max(r["5700"], prev.max ?? 0)`)
+	is.NoErr(json.Unmarshal(state, restored))
+
+	restored.Handle(t.Context(), newTemperature(20), func(string, float64, time.Time) error { return nil })
+	v, _ := restored.Value("max")
+	is.Equal(v, 30.0)
+}
+
+func TestFormulaIgnoresOtherObjects(t *testing.T) {
+	is := is.New(t)
+
+	f, err := New(`urn=3304, v = r["5700"]`)
+	is.NoErr(err)
+
+	_, err = f.Handle(t.Context(), newTemperature(20), func(string, float64, time.Time) error { return nil })
+	is.Equal(err, events.ErrNoMatch)
+}
+
+func TestFormulaMustEvaluateToANumber(t *testing.T) {
+	is := is.New(t)
+
+	f, err := New(`v = r["5800"] * 2`)
+	is.NoErr(err)
+
+	_, err = f.Handle(t.Context(), newTemperature(20), func(string, float64, time.Time) error { return nil })
+	is.True(err != nil) // there is no 5800 record in the pack
+}
+
+func TestInvalidFormulaConfig(t *testing.T) {
+	is := is.New(t)
+
+	_, err := New(``)
+	is.True(err != nil) // at least one output is required
+
+	_, err = New(`r["5700"] * 2`)
+	is.True(err != nil) // outputs must be named
+
+	_, err = New(`v = vs["0"]`)
+	is.True(err != nil) // outputs must be numbers
+
+	_, err = New(`v = now().Unix()`)
+	is.True(err != nil) // expressions may not depend on the current time
+
+	_, err = New(`v = r["5700"], v = 1`)
+	is.True(err != nil)
+
+	_, err = New(`v = max(r["5700"], 1`)
+	is.True(err != nil)
+}
+
+func newTemperature(temp float64) *events.MessageAccepted {
+	e := &events.MessageAccepted{}
+	json.Unmarshal(fmt.Appendf(nil, temperatureJSONFormat, temp), e)
+	return e
+}
+
+const temperatureJSONFormat string = `{
+	"pack":[
+		{"bn":"testid/3303/","bt":1675801037,"n":"0","vs":"urn:oma:lwm2m:ext:3303"},
+		{"n":"5700","u":"Cel","v":%f}
+	],
+	"timestamp":"2023-02-07T20:17:17.312028Z"
+}`
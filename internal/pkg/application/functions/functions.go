@@ -2,21 +2,17 @@ package functions
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/diwise/iot-core/internal/pkg/application/functions/airquality"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/buildings"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/counters"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/digitalinput"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/levels"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/presences"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/stopwatch"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/timers"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/waterqualities"
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
 	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/messaging-golang/pkg/messaging"
@@ -27,9 +23,12 @@ import (
 type Function interface {
 	ID() string
 	Name() string
+	Tenant() string
+	Setting() Setting
 
 	Handle(context.Context, *events.MessageAccepted, messaging.MsgContext) error
 	History(context.Context, string, int) ([]LogValue, error)
+	QueryHistory(context.Context, HistoryQuery) (HistoryResult, error)
 }
 
 type location struct {
@@ -44,25 +43,33 @@ type fnct struct {
 	SubType   string    `json:"subtype"`
 	DeviceID  string    `json:"deviceID"`
 	Location  *location `json:"location,omitempty"`
-	Tenant    string    `json:"tenant,omitempty"`
+	Tenant_   string    `json:"tenant,omitempty"`
 	Source    string    `json:"source,omitempty"`
 	OnUpdate  bool      `json:"onupdate"`
 	Timestamp time.Time `json:"timestamp"`
 
-	Counter      counters.Counter            `json:"counter,omitempty"`
-	Level        levels.Level                `json:"level,omitempty"`
-	Presence     presences.Presence          `json:"presence,omitempty"`
-	Timer        timers.Timer                `json:"timer,omitempty"`
-	WaterQuality waterqualities.WaterQuality `json:"waterquality,omitempty"`
-	Building     buildings.Building          `json:"building,omitempty"`
-	AirQuality   airquality.AirQuality       `json:"airQuality,omitempty"`
-	Stopwatch    stopwatch.Stopwatch         `json:"stopwatch,omitempty"`
-	DigitalInput digitalinput.DigitalInput   `json:"digitalInput,omitempty"`
+	// state is the type specific part of the function, created by the factory
+	// of its type and marshalled as the JSON key of the factory
+	state   factories.State
+	factory factories.FunctionFactory
 
 	handle func(context.Context, *events.MessageAccepted, func(prop string, value float64, ts time.Time) error) (bool, error)
+	tick   func(context.Context, time.Time, func(prop string, value float64, ts time.Time) error) (bool, error)
+
+	// mu serializes the handling of messages, since a function bound to
+	// several sensors may receive messages from more than one worker
+	mu sync.Mutex
+
+	// changes collects the properties that are logged while the function is
+	// updated, so that composite functions that depend on it can be updated
+	// once the update is published
+	changes []change
+	notify  func(ctx context.Context, msgctx messaging.MsgContext, source, label string, changes []change)
 
 	defaultHistoryLabel string
+	setting             Setting
 	storage             database.Storage
+	clock               clock.Clock
 }
 
 func (f *fnct) ID() string {
@@ -73,33 +80,45 @@ func (f *fnct) Name() string {
 	return f.Name_
 }
 
+// DefaultTenant is the tenant of functions that have not been given one, either
+// in their setting or by the first message from one of their sensors, such as
+// composite functions from the config file
+const DefaultTenant string = "default"
+
+func (f *fnct) Tenant() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.tenant()
+}
+
+func (f *fnct) tenant() string {
+	if f.Tenant_ == "" {
+		return DefaultTenant
+	}
+	return f.Tenant_
+}
+
+func (f *fnct) Setting() Setting {
+	return f.setting
+}
+
 func (f *fnct) Handle(ctx context.Context, e *events.MessageAccepted, msgctx messaging.MsgContext) error {
 	log := logging.GetFromContext(ctx)
 	log = log.With(slog.String("function_id", f.ID()), slog.String("device_id", e.DeviceID()))
 	ctx = logging.NewContextWithLogger(ctx, log)
 
-	if e.Timestamp.After(time.Now()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if e.Timestamp.After(f.clock.Now()) {
 		log.Error("ignoring messages that claim to have been accepted in the future", "timestamp", e.Timestamp.Format(time.RFC3339))
 		return nil
 	}
 
 	f.DeviceID = e.DeviceID()
 
-	onchange := func(prop string, value float64, ts time.Time) error {
-		log.Debug(fmt.Sprintf("property %s changed to %f with time %s", prop, value, ts.Format(time.RFC3339)))
-
-		err := f.storage.Add(ctx, f.ID(), prop, value, ts)
-		if err != nil {
-			log.Error("failed to add values to database", "err", err.Error())
-			return err
-		}
-
-		if ts.After(f.Timestamp) {
-			f.Timestamp = ts.UTC()
-		}
-
-		return nil
-	}
+	onchange := f.onchange(ctx)
 
 	changed := false
 
@@ -107,9 +126,9 @@ func (f *fnct) Handle(ctx context.Context, e *events.MessageAccepted, msgctx mes
 	// 	     so this lazy init version wont work in the long run ...
 	if tenant, ok := e.Pack().GetStringValue(senml.FindByName("tenant")); ok {
 		// Temporary fix to force an update the first time a function is called
-		if f.Tenant == "" {
+		if f.Tenant_ == "" {
 			log.Debug("add tenant to function")
-			f.Tenant = tenant
+			f.Tenant_ = tenant
 			changed = true
 		}
 	}
@@ -134,7 +153,9 @@ func (f *fnct) Handle(ctx context.Context, e *events.MessageAccepted, msgctx mes
 		}
 	}
 
-	changed, err := f.handle(ctx, e, onchange)
+	f.changes = nil
+
+	handled, err := f.handle(ctx, e, onchange)
 	if err != nil {
 		if errors.Is(err, events.ErrNoMatch) {
 			log.Debug(fmt.Sprintf("%s function should not handle this message type (%s)", f.Type, e.ObjectID()))
@@ -143,24 +164,32 @@ func (f *fnct) Handle(ctx context.Context, e *events.MessageAccepted, msgctx mes
 		return err
 	}
 
+	// the tenant, source or location may have been learned from the message
+	// even if the state of the function did not change
+	changed = changed || handled
+
+	unsaved := false
+	if saver, ok := f.state.(factories.Saver); ok {
+		unsaved = saver.Unsaved()
+	}
+
+	if changed || unsaved {
+		if err := f.saveState(ctx); err != nil {
+			log.Error("failed to save function state", "err", err.Error())
+		}
+	}
+
 	if changed || f.OnUpdate {
 		if !changed {
 			f.Timestamp = e.Timestamp.UTC()
 		}
 
-		fumsg := NewFunctionUpdatedMessage(f)
-
-		log.Debug("publishing message",
-			slog.String("body", string(fumsg.Body())),
-			slog.String("topic", fumsg.TopicName()),
-			slog.String("content-type", fumsg.ContentType()),
-			slog.Bool("changed", changed),
-			slog.Bool("onupdate", f.OnUpdate))
-
-		err := msgctx.PublishOnTopic(ctx, fumsg)
+		err := f.publish(ctx, msgctx)
 		if err != nil {
 			return err
 		}
+
+		f.notifyDependents(ctx, msgctx)
 	} else {
 		log.Debug(fmt.Sprintf("no message published, change is %t, onUpdate %t", changed, f.OnUpdate))
 	}
@@ -170,6 +199,266 @@ func (f *fnct) Handle(ctx context.Context, e *events.MessageAccepted, msgctx mes
 	return nil
 }
 
+// Tick lets functions whose state depends on the passing of time, such as
+// timers, update themselves between incoming messages. Functions without
+// a tick handler ignore it.
+func (f *fnct) Tick(ctx context.Context, now time.Time, msgctx messaging.MsgContext) error {
+	if f.tick == nil {
+		return nil
+	}
+
+	log := logging.GetFromContext(ctx)
+	log = log.With(slog.String("function_id", f.ID()))
+	ctx = logging.NewContextWithLogger(ctx, log)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.changes = nil
+
+	changed, err := f.tick(ctx, now, f.onchange(ctx))
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err := f.saveState(ctx); err != nil {
+		log.Error("failed to save function state", "err", err.Error())
+	}
+
+	err = f.publish(ctx, msgctx)
+	if err != nil {
+		return err
+	}
+
+	f.notifyDependents(ctx, msgctx)
+
+	return nil
+}
+
+type change struct {
+	prop  string
+	value float64
+	ts    time.Time
+}
+
+// notifyDependents passes the properties that were logged during the latest
+// update on to the composite functions that depend on this function. Callers
+// must hold the function lock.
+func (f *fnct) notifyDependents(ctx context.Context, msgctx messaging.MsgContext) {
+	changes := f.changes
+	f.changes = nil
+
+	if f.notify == nil || len(changes) == 0 {
+		return
+	}
+
+	f.notify(ctx, msgctx, f.ID_, f.defaultHistoryLabel, changes)
+}
+
+type compositeChainKey struct{}
+
+// updateComposite updates a composite function with the latest value of its
+// property among the changes of a source function, and publishes the composite
+// if its value changed. label is the default history label of the source.
+func (f *fnct) updateComposite(ctx context.Context, msgctx messaging.MsgContext, source, label string, changes []change) error {
+	comp, ok := f.state.(factories.Combiner)
+	if !ok {
+		return nil
+	}
+
+	prop := comp.Property()
+	if prop == "" {
+		prop = label
+	}
+
+	var latest *change
+	for i := range slices.Backward(changes) {
+		if changes[i].prop == prop {
+			latest = &changes[i]
+			break
+		}
+	}
+
+	if latest == nil {
+		return nil
+	}
+
+	// composites may depend on other composites, make sure that a misconfigured
+	// cycle of composites does not update itself forever
+	chain, _ := ctx.Value(compositeChainKey{}).([]string)
+	if slices.Contains(chain, f.ID_) {
+		return fmt.Errorf("composite function %s depends on itself via %s", f.ID_, strings.Join(chain, ", "))
+	}
+	ctx = context.WithValue(ctx, compositeChainKey{}, append(slices.Clone(chain), f.ID_))
+
+	log := logging.GetFromContext(ctx).With(slog.String("function_id", f.ID()), slog.String("source_id", source))
+	ctx = logging.NewContextWithLogger(ctx, log)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.changes = nil
+
+	changed, err := comp.Update(ctx, source, latest.value, latest.ts, f.onchange(ctx))
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err := f.saveState(ctx); err != nil {
+		log.Error("failed to save function state", "err", err.Error())
+	}
+
+	err = f.publish(ctx, msgctx)
+	if err != nil {
+		return err
+	}
+
+	f.notifyDependents(ctx, msgctx)
+
+	return nil
+}
+
+// onchange returns the callback used by function types to log changed
+// property values. Callers must hold the function lock.
+func (f *fnct) onchange(ctx context.Context) func(prop string, value float64, ts time.Time) error {
+	log := logging.GetFromContext(ctx)
+
+	return func(prop string, value float64, ts time.Time) error {
+		log.Debug(fmt.Sprintf("property %s changed to %f with time %s", prop, value, ts.Format(time.RFC3339)))
+
+		err := f.storage.Add(ctx, f.ID(), prop, value, ts)
+		if err != nil {
+			log.Error("failed to add values to database", "err", err.Error())
+			return err
+		}
+
+		if ts.After(f.Timestamp) {
+			f.Timestamp = ts.UTC()
+		}
+
+		f.changes = append(f.changes, change{prop: prop, value: value, ts: ts})
+
+		return nil
+	}
+}
+
+func (f *fnct) publish(ctx context.Context, msgctx messaging.MsgContext) error {
+	fumsg := NewFunctionUpdatedMessage(f)
+
+	logging.GetFromContext(ctx).Debug("publishing message",
+		slog.String("body", string(fumsg.Body())),
+		slog.String("topic", fumsg.TopicName()),
+		slog.String("content-type", fumsg.ContentType()),
+		slog.Bool("onupdate", f.OnUpdate))
+
+	return msgctx.PublishOnTopic(ctx, fumsg)
+}
+
+// saveState stores a snapshot of the complete function state so that it can
+// be restored after a restart
+func (f *fnct) saveState(ctx context.Context) error {
+	state, err := f.marshal()
+	if err != nil {
+		return err
+	}
+
+	ts := f.Timestamp
+	if ts.IsZero() {
+		ts = f.clock.Now().UTC()
+	}
+
+	return f.storage.SaveState(ctx, f.ID_, state, ts)
+}
+
+// restore rehydrates the function from a previously saved state snapshot. The
+// configured setting always takes precedence over what is found in the snapshot.
+func (f *fnct) restore(state []byte) error {
+	err := json.Unmarshal(state, f)
+
+	f.ID_ = f.setting.ID
+	f.Name_ = f.setting.Name
+	f.Type = f.setting.Type
+	f.SubType = f.setting.SubType
+	f.OnUpdate = f.setting.OnUpdate
+
+	if f.setting.Tenant != "" {
+		f.Tenant_ = f.setting.Tenant
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to restore state for function %s: %w", f.ID_, err)
+	}
+
+	return nil
+}
+
+// fnctJSON has the same fields as fnct, but not its methods, so that the
+// metadata of a function can be marshalled without recursing into MarshalJSON
+type fnctJSON fnct
+
+// MarshalJSON marshals the function while holding its lock, since the function
+// may be updated by the workers that handle messages at the same time
+func (f *fnct) MarshalJSON() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.marshal()
+}
+
+// marshal marshals the metadata of the function followed by its type specific
+// state, keyed by the JSON key of its type. Callers must hold the function lock.
+func (f *fnct) marshal() ([]byte, error) {
+	b, err := json.Marshal((*fnctJSON)(f))
+	if err != nil || f.state == nil {
+		return b, err
+	}
+
+	state, err := json.Marshal(f.state)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _ := json.Marshal(f.factory.JSONKey)
+
+	b = append(b[:len(b)-1], ',')
+	b = append(b, key...)
+	b = append(b, ':')
+	b = append(b, state...)
+	return append(b, '}'), nil
+}
+
+// UnmarshalJSON unmarshals the metadata of the function and the state found
+// under the JSON key of its type into the state that the function already has
+func (f *fnct) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*fnctJSON)(f)); err != nil {
+		return err
+	}
+
+	if f.state == nil {
+		return nil
+	}
+
+	props := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &props); err != nil {
+		return err
+	}
+
+	state, ok := props[f.factory.JSONKey]
+	if !ok || string(state) == "null" {
+		return nil
+	}
+
+	return json.Unmarshal(state, f.state)
+}
+
 func (f *fnct) History(ctx context.Context, label string, lastN int) ([]LogValue, error) {
 	if label == "" {
 		label = f.defaultHistoryLabel
@@ -192,6 +481,44 @@ func (f *fnct) History(ctx context.Context, label string, lastN int) ([]LogValue
 	return loggedValues, nil
 }
 
+func (f *fnct) QueryHistory(ctx context.Context, q HistoryQuery) (HistoryResult, error) {
+	if q.Label == "" {
+		q.Label = f.defaultHistoryLabel
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = DefaultHistoryLimit
+	}
+
+	result, err := f.storage.QueryHistory(ctx, f.ID(), database.HistoryQuery{
+		Label:     q.Label,
+		TimeRel:   q.TimeRel,
+		TimeAt:    q.TimeAt,
+		EndTimeAt: q.EndTimeAt,
+		Aggregate: q.Aggregate,
+		Interval:  q.Interval,
+		Offset:    q.Offset,
+		Limit:     q.Limit,
+	})
+	if err != nil {
+		return HistoryResult{}, err
+	}
+
+	loggedValues := make([]LogValue, len(result.Values))
+	for i, v := range result.Values {
+		loggedValues[i] = LogValue{Timestamp: v.Timestamp, Value: v.Value}
+	}
+
+	return HistoryResult{
+		Values:     loggedValues,
+		Offset:     result.Offset,
+		Limit:      result.Limit,
+		TotalCount: result.TotalCount,
+	}, nil
+}
+
+// NewFunctionUpdatedMessage creates the function.updated message that is
+// published when the function changes. Callers must hold the function lock.
 func NewFunctionUpdatedMessage(f *fnct) messaging.TopicMessage {
 	subType := ""
 	if len(f.SubType) > 0 {
@@ -199,11 +526,12 @@ func NewFunctionUpdatedMessage(f *fnct) messaging.TopicMessage {
 	}
 
 	if f.Timestamp.IsZero() {
-		f.Timestamp = time.Now().UTC()
+		f.Timestamp = f.clock.Now().UTC()
 	}
 
 	contentType := strings.ToLower(fmt.Sprintf("application/vnd.diwise.%s%s+json", f.Type, subType))
-	m, _ := messaging.NewTopicMessageJSON("function.updated", contentType, *f)
+	body, _ := f.marshal()
+	m, _ := messaging.NewTopicMessageJSON("function.updated", contentType, json.RawMessage(body))
 	return m
 }
 
@@ -211,3 +539,30 @@ type LogValue struct {
 	Value     float64   `json:"v"`
 	Timestamp time.Time `json:"ts"`
 }
+
+const DefaultHistoryLimit int = 1000
+
+// HistoryQuery selects logged values within a time window, optionally
+// aggregated into buckets of Interval. See database.HistoryQuery for details.
+type HistoryQuery struct {
+	Label     string
+	TimeRel   string
+	TimeAt    time.Time
+	EndTimeAt time.Time
+	Aggregate string
+	Interval  time.Duration
+	Offset    int
+	Limit     int
+}
+
+// IsSupportedAggregate reports whether aggr can be used to aggregate history.
+func IsSupportedAggregate(aggr string) bool {
+	return database.IsSupportedAggregate(aggr)
+}
+
+type HistoryResult struct {
+	Values     []LogValue
+	Offset     int
+	Limit      int
+	TotalCount int64
+}
@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
 	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
 	"github.com/diwise/iot-core/pkg/lwm2m"
 	"github.com/diwise/iot-core/pkg/messaging/events"
@@ -31,10 +32,19 @@ func TestCounter(t *testing.T) {
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 			return nil
 		},
-	})
+	}, clock.New())
 
 	f, _ := reg.Find(ctx, MatchSensor(sensorId))
 
@@ -53,6 +63,97 @@ func TestCounter(t *testing.T) {
 	is.Equal(string(generatedMessagePayload), expectation)
 }
 
+func TestLearnedTenantIsSavedWithoutAChange(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	sensorId := "testId"
+
+	config := "functionID;name;counter;overflow;" + sensorId + ";false"
+	input := bytes.NewBufferString(config)
+
+	saved := []string{}
+
+	reg, _ := NewRegistry(ctx, input, &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			saved = append(saved, string(state))
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
+			return nil
+		},
+	}, clock.New())
+
+	f, _ := reg.Find(ctx, MatchSensor(sensorId))
+
+	ts, _ := time.Parse(time.RFC3339, "2024-03-20T12:19:48+01:00")
+
+	err := f[0].Handle(ctx, events.NewMessageAccepted(NewSenMLPack(sensorId, lwm2m.DigitalInput, ts, BoolValue("5500", true, 0))), msgctx)
+	is.NoErr(err)
+
+	// the counter is unchanged by the second message, but it carries the tenant
+	pack := NewSenMLPack(sensorId, lwm2m.DigitalInput, ts.Add(time.Minute), BoolValue("5500", true, 0))
+	err = f[0].Handle(ctx, events.NewMessageAccepted(pack, events.Tenant("default")), msgctx)
+	is.NoErr(err)
+
+	is.Equal(len(saved), 2)
+	is.True(strings.Contains(saved[1], `"tenant":"default"`))
+}
+
+func TestFunctionCanBeMarshalledWhileHandlingMessages(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	sensorId := "testId"
+
+	reg, _ := NewRegistry(ctx, bytes.NewBufferString("functionID;name;counter;overflow;"+sensorId+";false"), &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
+			return nil
+		},
+	}, clock.New())
+
+	f, _ := reg.Find(ctx, MatchSensor(sensorId))
+
+	ts, _ := time.Parse(time.RFC3339, "2024-03-20T12:19:48+01:00")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 100 {
+			pack := NewSenMLPack(sensorId, lwm2m.DigitalInput, ts.Add(time.Duration(i)*time.Second), BoolValue("5500", i%2 == 0, 0))
+			f[0].Handle(ctx, events.NewMessageAccepted(pack), msgctx)
+		}
+	}()
+
+	// the api marshals functions while they are being updated by the workers,
+	// which the race detector reports unless the function is locked
+	for range 100 {
+		_, err := json.Marshal(f[0])
+		is.NoErr(err)
+	}
+
+	<-done
+}
+
 func TestLevel(t *testing.T) {
 	is, ctx, msgctx := testSetup(t)
 
@@ -64,13 +165,22 @@ func TestLevel(t *testing.T) {
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 			return nil
 		},
 		HistoryFunc: func(ctx context.Context, id, label string, lastN int) ([]database.LogValue, error) {
 			return []database.LogValue{}, nil
 		},
-	})
+	}, clock.New())
 
 	ts, _ := time.Parse(time.RFC3339, "2024-03-20T12:19:48+01:00")
 
@@ -91,6 +201,54 @@ func TestLevel(t *testing.T) {
 	is.Equal(string(generatedMessagePayload), expectation)
 }
 
+func TestRejectedLevelIsSavedWithoutAChange(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	sensorId := "testId"
+
+	input := bytes.NewBufferString("functionID;name;level;sand;" + sensorId + ";false;maxd=4,maxjump=0.3")
+
+	saved := []string{}
+
+	reg, _ := NewRegistry(ctx, input, &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			saved = append(saved, string(state))
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
+			return nil
+		},
+		HistoryFunc: func(ctx context.Context, id, label string, lastN int) ([]database.LogValue, error) {
+			return []database.LogValue{}, nil
+		},
+	}, clock.New())
+
+	f, _ := reg.Find(ctx, MatchSensor(sensorId))
+
+	ts, _ := time.Parse(time.RFC3339, "2024-03-20T12:19:48+01:00")
+
+	// an accepted reading, a spike that is rejected, and an accepted reading
+	// that leaves the level unchanged
+	for i, d := range []float64{3.0, 0.5, 3.0} {
+		pack := NewSenMLPack(sensorId, lwm2m.Distance, ts.Add(time.Duration(i)*time.Minute), Rec("5700", &d, nil, "", nil, senml.UnitMeter, nil))
+		err := f[0].Handle(ctx, events.NewMessageAccepted(pack), msgctx)
+		is.NoErr(err)
+	}
+
+	is.Equal(len(msgctx.PublishOnTopicCalls()), 1) // only the first reading changes the level
+	is.Equal(len(saved), 2)
+	is.True(strings.Contains(saved[1], `"rejected":1`))
+}
+
 func TestLevelFromAnAngle(t *testing.T) {
 	is, ctx, msgctx := testSetup(t)
 
@@ -100,13 +258,22 @@ func TestLevelFromAnAngle(t *testing.T) {
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 			return nil
 		},
 		HistoryFunc: func(ctx context.Context, id, label string, lastN int) ([]database.LogValue, error) {
 			return []database.LogValue{}, nil
 		},
-	})
+	}, clock.New())
 
 	ts, _ := time.Parse(time.RFC3339, "2024-03-20T12:19:48+01:00")
 
@@ -139,10 +306,19 @@ func TestTimer(t *testing.T) {
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 			return nil
 		},
-	})
+	}, clock.New())
 
 	f, _ := reg.Find(ctx, MatchSensor(sensorId))
 
@@ -171,9 +347,18 @@ func TestWaterQuality(t *testing.T) {
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 			return nil
-		}})
+		}}, clock.New())
 
 	v := 2.34
 	ts, _ := time.Parse(time.RFC3339, "2023-06-05T11:26:57Z")
@@ -189,7 +374,7 @@ func TestWaterQuality(t *testing.T) {
 	is.Equal(len(msgctx.PublishOnTopicCalls()), 1)
 	generatedMessagePayload := msgctx.PublishOnTopicCalls()[0].Message.Body()
 
-	const expectation string = `{"id":"functionID","name":"name","type":"waterquality","subtype":"beach","deviceID":"testId","onupdate":false,"timestamp":"2023-06-05T11:26:57Z","waterquality":{"temperature":2.3,"timestamp":"2023-06-05T11:26:57Z"}}`
+	const expectation string = `{"id":"functionID","name":"name","type":"waterquality","subtype":"beach","deviceID":"testId","onupdate":false,"timestamp":"2023-06-05T11:26:57Z","waterquality":{"temperature":2.3,"timestamp":"2023-06-05T11:26:57Z","measured":["temperature"]}}`
 	is.Equal(string(generatedMessagePayload), expectation)
 }
 
@@ -203,6 +388,15 @@ func TestAddToHistory(t *testing.T) {
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 			store = append(store, database.LogValue{Timestamp: timestamp, Value: value})
 			return nil
@@ -210,7 +404,7 @@ func TestAddToHistory(t *testing.T) {
 		HistoryFunc: func(ctx context.Context, id, label string, lastN int) ([]database.LogValue, error) {
 			return store, nil
 		},
-	})
+	}, clock.New())
 
 	newMessageAccepted := func(v float64, t time.Time) *events.MessageAccepted {
 		pack := NewSenMLPack(sensorId, lwm2m.Temperature, t, Rec("5700", &v, nil, "", nil, senml.UnitCelsius, nil))
@@ -230,6 +424,61 @@ func TestAddToHistory(t *testing.T) {
 	is.Equal(6, len(h))
 }
 
+func TestCompositeSumOfCounters(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	logged := []float64{}
+
+	config := strings.Join([]string{
+		"counter1;entrance;counter;peoplecounter;s1;false",
+		"counter2;exit;counter;peoplecounter;s2;false",
+		"total;occupancy;composite;peoplecounter;;false;sources=counter1|counter2,op=sum",
+	}, "\n")
+
+	reg, err := NewRegistry(ctx, bytes.NewBufferString(config), &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
+			if id == "total" {
+				is.Equal(label, "value")
+				logged = append(logged, value)
+			}
+			return nil
+		},
+	}, clock.New())
+	is.NoErr(err)
+
+	ts, _ := time.Parse(time.RFC3339, "2024-03-20T12:19:48+01:00")
+
+	count := func(sensorID string, c float64) {
+		pack := NewSenMLPack(sensorID, lwm2m.DigitalInput, ts, BoolValue("5500", true, 0), Rec("5501", &c, nil, "", nil, "", nil))
+		f, _ := reg.Find(ctx, MatchSensor(sensorID))
+		is.NoErr(f[0].Handle(ctx, events.NewMessageAccepted(pack), msgctx))
+	}
+
+	count("s1", 3)
+	count("s2", 4)
+	count("s1", 5)
+
+	is.Equal(logged, []float64{3, 7, 9})
+
+	calls := msgctx.PublishOnTopicCalls()
+	is.Equal(len(calls), 6) // one message per counter update and one per composite update
+
+	const expectation string = `{"id":"total","name":"occupancy","type":"composite","subtype":"peoplecounter","deviceID":"","onupdate":false,"timestamp":"2024-03-20T11:19:48Z","composite":{"value":9,"inputs":{"counter1":5,"counter2":4}}}`
+	is.Equal(string(calls[5].Message.Body()), expectation)
+}
+
 func TestStopwatch(t *testing.T) {
 	is := is.New(t)
 	ctx := context.Background()
@@ -248,8 +497,17 @@ func TestStopwatch(t *testing.T) {
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error { return nil },
-	})
+	}, clock.New())
 	is.NoErr(err)
 
 	newDigitalInput := func(vb bool, ts time.Time) *events.MessageAccepted {
@@ -309,6 +567,64 @@ func TestStopwatch(t *testing.T) {
 	is.Equal(getCumulativeTime(4, msgctx), float64(2*60*60))
 }
 
+func TestStopwatchStateIsRestored(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	states := map[string][]byte{}
+
+	storage := &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			states[id] = state
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return states, nil
+		},
+		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error { return nil },
+	}
+
+	config := `xyz123;Förrådet BPN;stopwatch;overflow;abc123;false`
+
+	reg, err := NewRegistry(ctx, bytes.NewBufferString(config), storage, clock.New())
+	is.NoErr(err)
+
+	newDigitalInput := func(vb bool, ts time.Time) *events.MessageAccepted {
+		return events.NewMessageAccepted(objects.ToPack(objects.NewDigitalInput("abc123", vb, ts)))
+	}
+
+	now := time.Now()
+
+	f, _ := reg.Find(ctx, MatchSensor("abc123"))
+	is.NoErr(f[0].Handle(ctx, newDigitalInput(true, now.Add(-2*time.Hour)), msgctx))
+	is.NoErr(f[0].Handle(ctx, newDigitalInput(false, now.Add(-1*time.Hour)), msgctx))
+
+	is.Equal(len(states), 1) // the state should have been saved
+
+	// create a new registry, as if the service has been restarted
+	reg, err = NewRegistry(ctx, bytes.NewBufferString(config), storage, clock.New())
+	is.NoErr(err)
+
+	f, _ = reg.Find(ctx, MatchSensor("abc123"))
+	is.NoErr(f[0].Handle(ctx, newDigitalInput(true, now.Add(-30*time.Minute)), msgctx))
+	is.NoErr(f[0].Handle(ctx, newDigitalInput(false, now), msgctx))
+
+	sw := struct {
+		Stopwatch struct {
+			CumulativeTime time.Duration `json:"cumulativeTime"`
+		} `json:"stopwatch"`
+	}{}
+
+	calls := msgctx.PublishOnTopicCalls()
+	json.Unmarshal(calls[len(calls)-1].Message.Body(), &sw)
+	is.Equal(sw.Stopwatch.CumulativeTime, 90*time.Minute) // cumulative time should survive the restart
+}
+
 func testSetup(t *testing.T) (*is.I, context.Context, *messaging.MsgContextMock) {
 	is := is.New(t)
 	msgctx := &messaging.MsgContextMock{
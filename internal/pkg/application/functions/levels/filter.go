@@ -0,0 +1,97 @@
+package levels
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// filter rejects and smooths implausible distance based levels, such as when
+// a bird or a splash is picked up by an ultrasonic sensor.
+type filter struct {
+	// medianSize is the number of recent levels that the median is taken from
+	medianSize int
+	// maxJump is the largest change of level that is accepted at once, unless
+	// confirmed by a consecutive reading
+	maxJump float64
+
+	window  []float64
+	pending *float64
+}
+
+// parseMedian parses a filter setting such as "median:5"
+func parseMedian(value string) (int, error) {
+	kind, size, ok := strings.Cut(value, ":")
+	if !ok || kind != "median" {
+		return 0, fmt.Errorf("unknown filter %q", value)
+	}
+
+	n, err := strconv.Atoi(size)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 1 {
+		return 0, fmt.Errorf("median window size must be at least 1")
+	}
+
+	return n, nil
+}
+
+// apply feeds a new level to the filter and returns the filtered level, or
+// false if the level was rejected. A level that differs more than maxJump
+// from the previous accepted level is only accepted if the next level agrees
+// with it, so that actual sudden changes (such as emptying a container) are let
+// through one reading late.
+func (f *filter) apply(level float64) (float64, bool) {
+	if f.maxJump > 0 && len(f.window) > 0 {
+		previous := f.window[len(f.window)-1]
+
+		if math.Abs(level-previous) > f.maxJump {
+			if f.pending == nil || math.Abs(level-*f.pending) > f.maxJump {
+				f.pending = &level
+				return 0, false
+			}
+
+			// the jump has been confirmed, start over from the new level
+			f.window = []float64{*f.pending}
+		}
+	}
+
+	f.pending = nil
+	f.window = append(f.window, level)
+
+	// without a median only the last accepted level is needed for the max jump
+	size := max(f.medianSize, 1)
+	if len(f.window) > size {
+		f.window = f.window[len(f.window)-size:]
+	}
+
+	if f.medianSize < 1 {
+		return level, true
+	}
+
+	return median(f.window), true
+}
+
+// seed starts the filter over from a level that was accepted before, such as
+// the level restored after a restart, so that the next level is checked
+// against it rather than accepted as is
+func (f *filter) seed(level float64) {
+	f.window = []float64{level}
+	f.pending = nil
+}
+
+func median(values []float64) float64 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+
+	return sorted[mid]
+}
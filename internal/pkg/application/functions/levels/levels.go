@@ -2,6 +2,7 @@ package levels
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -10,6 +11,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
 	"github.com/diwise/iot-core/pkg/lwm2m"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/senml"
@@ -20,23 +24,97 @@ const (
 	FunctionTypeName string = "level"
 )
 
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "level",
+		DefaultHistoryLabel: "level",
+		RestoreFromHistory:  true,
+		Args: []factories.Arg{
+			{Name: "angle", Kind: factories.Number},
+			{Name: "maxd", Kind: factories.Number},
+			{Name: "maxl", Kind: factories.Number},
+			{Name: "mean", Kind: factories.Number},
+			{Name: "offset", Kind: factories.Number},
+			{Name: "filter"},
+			{Name: "maxjump", Kind: factories.Number},
+			{Name: "window", Kind: factories.Duration},
+			{Name: "shape", Values: []string{ShapeHorizontalCylinder, ShapeVerticalCylinder, ShapeCone, ShapeTable}},
+			{Name: "table", Kind: factories.List},
+			{Name: "diameter", Kind: factories.Number},
+			{Name: "length", Kind: factories.Number},
+			{Name: "height", Kind: factories.Number},
+		},
+		New: func(env factories.Env) (factories.State, error) {
+			lvl, err := newLevel(env.Args, env.Last.Value, env.Clock, History(env.History))
+			if err != nil {
+				return nil, err
+			}
+
+			// a level restored from history is checked for spikes just like
+			// one that is restored from a stored state
+			if !env.Last.Timestamp.IsZero() {
+				lvl.seedFilter()
+			}
+
+			return lvl, nil
+		},
+	})
+}
+
 type Level interface {
 	Handle(context.Context, *events.MessageAccepted, func(string, float64, time.Time) error) (bool, error)
 	Current() float64
 	Offset() float64
 	Percent() float64
+	Rate() float64
+	Volume() float64
 }
 
-func New(config string, current float64) (Level, error) {
+// History returns the last lastN values that have been logged for prop, oldest first
+type History func(ctx context.Context, prop string, lastN int) ([]database.LogValue, error)
+
+const (
+	DefaultRateWindow time.Duration = 24 * time.Hour
+	maxRateSamples    int           = 100
+)
+
+// New creates a level function. Besides the current level, the rate at which
+// the level changes is estimated with a linear regression over the levels
+// logged within the rate window (config "window", defaults to 24h), and used
+// to predict when the level will reach the max level or zero.
+//
+// Levels calculated from distances can be filtered with a rolling median
+// (config "filter=median:5") and/or by rejecting levels that change more than
+// a max jump (config "maxjump=0.3") compared to the previous level.
+//
+// For tanks and wells that are not straight walled, a shape such as
+// "shape=hcylinder,diameter=2,length=5" or a lookup table of levels and
+// volumes such as "shape=table,table=0:0|0.5:120|1:400" can be configured. The
+// volume is then calculated in litres and the percent is based on the volume
+// instead of the level.
+func New(config string, current float64, clk clock.Clock, history History) (Level, error) {
+	lvl, err := newLevel(config, current, clk, history)
+	if err != nil {
+		return nil, err
+	}
+
+	return lvl, nil
+}
 
+func newLevel(config string, current float64, clk clock.Clock, history History) (*level, error) {
 	lvl := &level{
-		cosAlpha: 1.0,
+		cosAlpha:   1.0,
+		rateWindow: DefaultRateWindow,
+		clock:      clk,
+		history:    history,
 	}
 
 	config = strings.ReplaceAll(config, " ", "")
 	settings := strings.Split(config, ",")
 
 	var err error
+	var sc shapeConfig
 
 	for _, s := range settings {
 		pair := strings.Split(s, "=")
@@ -71,15 +149,72 @@ func New(config string, current float64) (Level, error) {
 				if err != nil {
 					return nil, fmt.Errorf("failed to parse offset config \"%s\": %w", s, err)
 				}
+			} else if pair[0] == "filter" {
+				if lvl.filter == nil {
+					lvl.filter = &filter{}
+				}
+				lvl.filter.medianSize, err = parseMedian(pair[1])
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse level config \"%s\": %w", s, err)
+				}
+			} else if pair[0] == "maxjump" {
+				if lvl.filter == nil {
+					lvl.filter = &filter{}
+				}
+				lvl.filter.maxJump, err = strconv.ParseFloat(pair[1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse level config \"%s\": %w", s, err)
+				}
+				if lvl.filter.maxJump <= 0 {
+					return nil, fmt.Errorf("level max jump %f must be positive", lvl.filter.maxJump)
+				}
+			} else if pair[0] == "shape" {
+				sc.name = pair[1]
+			} else if pair[0] == "table" {
+				sc.table = pair[1]
+			} else if pair[0] == "diameter" {
+				sc.diameter, err = strconv.ParseFloat(pair[1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse level config \"%s\": %w", s, err)
+				}
+			} else if pair[0] == "length" {
+				sc.length, err = strconv.ParseFloat(pair[1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse level config \"%s\": %w", s, err)
+				}
+			} else if pair[0] == "height" {
+				sc.height, err = strconv.ParseFloat(pair[1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse level config \"%s\": %w", s, err)
+				}
+			} else if pair[0] == "window" {
+				lvl.rateWindow, err = time.ParseDuration(pair[1])
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse level config \"%s\": %w", s, err)
+				}
+				if lvl.rateWindow <= 0 {
+					return nil, fmt.Errorf("level rate window %s must be positive", lvl.rateWindow)
+				}
 			} else {
 				return nil, fmt.Errorf("failed to parse level config \"%s\": %w", s, err)
 			}
 		}
 	}
 
+	lvl.shape, err = sc.create()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse level config: %w", err)
+	}
+
+	if lvl.shape != nil && !isNotZero(lvl.maxLevel) {
+		lvl.maxLevel = lvl.shape.height()
+	}
+
 	lvl.Current_ = current
+	lvl.updateVolume()
+
 	if isNotZero(lvl.maxLevel) {
-		pct := math.Min((lvl.Current_*100.0)/lvl.maxLevel, 100.0)
+		pct := lvl.calculatePercent()
 		if pct < 0 {
 			pct = 0
 		}
@@ -95,15 +230,64 @@ func New(config string, current float64) (Level, error) {
 }
 
 type level struct {
+	clock   clock.Clock
+	history History
+
 	cosAlpha    float64
 	maxDistance float64
 	maxLevel    float64
 	meanLevel   float64
 	offsetLevel float64
+	rateWindow  time.Duration
+	filter      *filter
+	shape       shape
 
 	Current_ float64  `json:"current"`
 	Percent_ *float64 `json:"percent,omitempty"`
 	Offset_  *float64 `json:"offset,omitempty"`
+	// Volume_ is the volume in litres, if the shape of the tank is known
+	Volume_ *float64 `json:"volume,omitempty"`
+
+	// Rate_ is the change of the level per hour, positive when filling up
+	Rate_ *float64 `json:"rate,omitempty"`
+	// EstimatedFull and EstimatedEmpty are the times at which the level is
+	// expected to reach the max level or zero at the current rate
+	EstimatedFull  *time.Time `json:"estimatedFull,omitempty"`
+	EstimatedEmpty *time.Time `json:"estimatedEmpty,omitempty"`
+
+	// Rejected is the number of distance readings that have been rejected by the filter
+	Rejected int `json:"rejected,omitempty"`
+
+	// unsaved is set when a reading is rejected, since that changes the state
+	// without changing the level
+	unsaved bool
+}
+
+// UnmarshalJSON restores the level from a stored state. The filter window is
+// not stored, so it is seeded with the restored level.
+func (l *level) UnmarshalJSON(data []byte) error {
+	type levelState level
+	if err := json.Unmarshal(data, (*levelState)(l)); err != nil {
+		return err
+	}
+
+	l.seedFilter()
+
+	return nil
+}
+
+// Unsaved reports whether a reading has been rejected since it was last called,
+// so that the count of rejected readings is saved even though it is not published
+func (l *level) Unsaved() bool {
+	unsaved := l.unsaved
+	l.unsaved = false
+	return unsaved
+}
+
+func (l *level) seedFilter() {
+	if l.filter != nil {
+		l.filter.seed(l.Current_)
+	}
 }
 
 func (l *level) Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
@@ -180,7 +364,7 @@ func (l *level) handleFillingLevel(ctx context.Context, e *events.MessageAccepte
 
 		ts, timeOk := percent.GetTime()
 		if !timeOk {
-			ts = time.Now().UTC()
+			ts = l.clock.Now().UTC()
 		}
 
 		if previousPercent == nil {
@@ -212,7 +396,7 @@ func (l *level) handleFillingLevel(ctx context.Context, e *events.MessageAccepte
 
 		ts, timeOk := level.GetTime()
 		if !timeOk {
-			ts = time.Now().UTC()
+			ts = l.clock.Now().UTC()
 		}
 
 		if !hasChanged(previousLevel, v) {
@@ -222,10 +406,11 @@ func (l *level) handleFillingLevel(ctx context.Context, e *events.MessageAccepte
 		log.Debug("level is changed", slog.Float64("old_value", l.Current_), slog.Float64("new_value", v))
 
 		l.Current_ = v
+		errs = append(errs, l.logVolume(ts, onchange)...)
 
 		if isNotZero(l.maxLevel) {
 			previousPercent := l.Percent_
-			pct := math.Min((l.Current_*100.0)/l.maxLevel, 100.0)
+			pct := l.calculatePercent()
 			l.Percent_ = &pct
 
 			if previousPercent == nil {
@@ -245,6 +430,7 @@ func (l *level) handleFillingLevel(ctx context.Context, e *events.MessageAccepte
 
 		changed = true
 		errs = append(errs, onchange("level", l.Current_, ts))
+		errs = append(errs, l.updateRate(ctx, ts, onchange)...)
 	}
 
 	return changed, errors.Join(errs...)
@@ -273,10 +459,26 @@ func (l *level) handleDistance(ctx context.Context, e *events.MessageAccepted, o
 	var errs []error
 
 	// Calculate the current level using the configured angle (if any) and round to two decimals
-	l.Current_ = math.Round((l.maxDistance-distance)*l.cosAlpha*100) / 100.0
+	current := math.Round((l.maxDistance-distance)*l.cosAlpha*100) / 100.0
 
 	log.Debug("calculate level using distance", slog.Float64("max_distance", l.maxDistance), slog.Float64("max_level", l.maxLevel), slog.Float64("angle", l.cosAlpha), slog.Float64("distance", distance))
 
+	if l.filter != nil {
+		filtered, accepted := l.filter.apply(current)
+		if !accepted {
+			l.Rejected++
+			l.unsaved = true
+			log.Info("rejected implausible level", slog.Float64("level", current), slog.Float64("previous_level", previousLevel), slog.Int("rejected", l.Rejected))
+			// the level is unchanged, so nothing is published for a rejected
+			// reading, but the state is saved to keep the count
+			return false, nil
+		}
+
+		current = math.Round(filtered*100) / 100.0
+	}
+
+	l.Current_ = current
+
 	if !hasChanged(previousLevel, l.Current_) {
 		log.Debug(fmt.Sprintf("distance has not changed (%f meters)", previousLevel))
 		return false, nil
@@ -285,13 +487,15 @@ func (l *level) handleDistance(ctx context.Context, e *events.MessageAccepted, o
 	ts, ok := sensorValue.GetTime()
 	if !ok {
 		log.Debug("could not get time from sensor value in distance pack, will use Now().UTC()")
-		ts = time.Now().UTC()
+		ts = l.clock.Now().UTC()
 	}
 
 	errs = append(errs, onchange("level", l.Current_, ts))
+	errs = append(errs, l.updateRate(ctx, ts, onchange)...)
+	errs = append(errs, l.logVolume(ts, onchange)...)
 
 	if isNotZero(l.maxLevel) {
-		pct := math.Min((l.Current_*100.0)/l.maxLevel, 100.0)
+		pct := l.calculatePercent()
 		l.Percent_ = &pct
 
 		if previousPercent == nil {
@@ -318,6 +522,118 @@ func (l *level) handleDistance(ctx context.Context, e *events.MessageAccepted, o
 
 }
 
+// calculatePercent returns how full the tank is, based on the volume if the
+// shape of the tank is known and on the level otherwise. Requires maxLevel.
+func (l *level) calculatePercent() float64 {
+	if l.shape != nil {
+		capacity := l.shape.volume(l.maxLevel)
+		if capacity > 0 {
+			return math.Min((l.shape.volume(l.Current_)*100.0)/capacity, 100.0)
+		}
+	}
+
+	return math.Min((l.Current_*100.0)/l.maxLevel, 100.0)
+}
+
+func (l *level) updateVolume() {
+	if l.shape == nil {
+		return
+	}
+
+	volume := math.Round(l.shape.volume(l.Current_)*100) / 100.0
+	l.Volume_ = &volume
+}
+
+func (l *level) logVolume(ts time.Time, onchange func(prop string, value float64, ts time.Time) error) []error {
+	if l.shape == nil {
+		return nil
+	}
+
+	l.updateVolume()
+
+	return []error{onchange("volume", *l.Volume_, ts)}
+}
+
+// updateRate estimates the rate of change from the levels logged within the rate
+// window before ts together with the current level, and predicts the time until
+// the level reaches the max level (when filling up) or zero (when draining).
+func (l *level) updateRate(ctx context.Context, ts time.Time, onchange func(prop string, value float64, ts time.Time) error) []error {
+	if l.history == nil {
+		return nil
+	}
+
+	log := logging.GetFromContext(ctx)
+
+	logged, err := l.history(ctx, "level", maxRateSamples)
+	if err != nil {
+		log.Error("failed to fetch level history, unable to calculate rate", "err", err.Error())
+		return nil
+	}
+
+	windowStart := ts.Add(-l.rateWindow)
+	samples := make([]database.LogValue, 0, len(logged)+1)
+
+	for _, lv := range logged {
+		// the current level may or may not have been logged already
+		if lv.Timestamp.After(windowStart) && lv.Timestamp.Before(ts) {
+			samples = append(samples, lv)
+		}
+	}
+	samples = append(samples, database.LogValue{Value: l.Current_, Timestamp: ts})
+
+	rate, ok := linearRegression(samples)
+	if !ok {
+		l.Rate_, l.EstimatedFull, l.EstimatedEmpty = nil, nil, nil
+		return nil
+	}
+
+	l.Rate_ = &rate
+	l.EstimatedFull, l.EstimatedEmpty = nil, nil
+
+	errs := []error{onchange("rate", rate, ts)}
+
+	if rate > 0 && isNotZero(rate) && isNotZero(l.maxLevel) && l.Current_ < l.maxLevel {
+		hours := (l.maxLevel - l.Current_) / rate
+		full := ts.Add(time.Duration(hours * float64(time.Hour))).UTC()
+		l.EstimatedFull = &full
+		errs = append(errs, onchange("timeToFull", hours, ts))
+	} else if rate < 0 && isNotZero(rate) && l.Current_ > 0 {
+		hours := l.Current_ / -rate
+		empty := ts.Add(time.Duration(hours * float64(time.Hour))).UTC()
+		l.EstimatedEmpty = &empty
+		errs = append(errs, onchange("timeToEmpty", hours, ts))
+	}
+
+	return errs
+}
+
+// linearRegression returns the least squares slope of the samples in units
+// per hour. At least two samples at different times are required.
+func linearRegression(samples []database.LogValue) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+
+	n := float64(len(samples))
+	t0 := samples[0].Timestamp
+
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range samples {
+		x := s.Timestamp.Sub(t0).Hours()
+		sumX += x
+		sumY += s.Value
+		sumXY += x * s.Value
+		sumXX += x * x
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if math.Abs(denominator) < 1e-9 {
+		return 0, false
+	}
+
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
+
 func (l *level) Current() float64 {
 	return l.Current_
 }
@@ -338,6 +654,22 @@ func (l *level) Percent() float64 {
 	return 0.0
 }
 
+func (l *level) Volume() float64 {
+	if l.Volume_ != nil {
+		return *l.Volume_
+	}
+
+	return 0.0
+}
+
+func (l *level) Rate() float64 {
+	if l.Rate_ != nil {
+		return *l.Rate_
+	}
+
+	return 0.0
+}
+
 func hasChanged(prev, new float64) bool {
 	return isNotZero(new - prev)
 }
@@ -1,11 +1,16 @@
 package levels
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"testing"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/matryer/is"
 )
@@ -13,7 +18,7 @@ import (
 func TestLevel(t *testing.T) {
 	is := is.New(t)
 
-	lvl, err := New("maxd=4", 0)
+	lvl, err := New("maxd=4", 0, clock.New(), nil)
 	is.NoErr(err)
 
 	lvl.Handle(t.Context(), newDistance(1.27), func(string, float64, time.Time) error { return nil })
@@ -24,7 +29,7 @@ func TestLevel(t *testing.T) {
 func TestLevelWithOffset(t *testing.T) {
 	is := is.New(t)
 
-	lvl, err := New("maxd=4,offset=1,maxl=4", 0)
+	lvl, err := New("maxd=4,offset=1,maxl=4", 0, clock.New(), nil)
 	is.NoErr(err)
 
 	lvl.Handle(t.Context(), newDistance(1.27), func(string, float64, time.Time) error { return nil })
@@ -36,7 +41,7 @@ func TestLevelWithOffset(t *testing.T) {
 func TestLevelWithOffsetFillingLevel(t *testing.T) {
 	is := is.New(t)
 
-	lvl, err := New("maxd=4,offset=1", 0)
+	lvl, err := New("maxd=4,offset=1", 0, clock.New(), nil)
 	is.NoErr(err)
 
 	// Offset = 1
@@ -54,7 +59,7 @@ func TestLevelWithOffsetFillingLevel(t *testing.T) {
 func TestLevelWithKnownMax(t *testing.T) {
 	is := is.New(t)
 
-	lvl, err := New("maxd=4,maxl=3", 0)
+	lvl, err := New("maxd=4,maxl=3", 0, clock.New(), nil)
 	is.NoErr(err)
 
 	lvl.Handle(t.Context(), newDistance(1.27), func(string, float64, time.Time) error { return nil })
@@ -65,7 +70,7 @@ func TestLevelWithKnownMax(t *testing.T) {
 func TestLevelWithOverflowCapsPctTo100(t *testing.T) {
 	is := is.New(t)
 
-	lvl, err := New("maxd=4,maxl=3", 0)
+	lvl, err := New("maxd=4,maxl=3", 0, clock.New(), nil)
 	is.NoErr(err)
 
 	lvl.Handle(t.Context(), newDistance(0.5), func(string, float64, time.Time) error { return nil })
@@ -76,7 +81,7 @@ func TestLevelWithOverflowCapsPctTo100(t *testing.T) {
 func TestFillingLevel(t *testing.T) {
 	is := is.New(t)
 
-	lvl, err := New("maxd=4,maxl=3", 0)
+	lvl, err := New("maxd=4,maxl=3", 0, clock.New(), nil)
 	is.NoErr(err)
 
 	lvl.Handle(t.Context(), newFillingLevel(53, 0, 80, false, false), func(string, float64, time.Time) error { return nil })
@@ -86,7 +91,7 @@ func TestFillingLevel(t *testing.T) {
 
 func TestLevelWithMaxDAndMaxL(t *testing.T) {
 	is := is.New(t)
-	lvl, err := New("maxd=0.94,maxl=0.79", 0)
+	lvl, err := New("maxd=0.94,maxl=0.79", 0, clock.New(), nil)
 	is.NoErr(err)
 	lvl.Handle(t.Context(), newDistance(0.4), func(s string, f float64, t time.Time) error {
 		return nil
@@ -95,6 +100,260 @@ func TestLevelWithMaxDAndMaxL(t *testing.T) {
 	is.Equal(lvl.Percent(), 68.35443037974683)
 }
 
+func TestLevelRateAndTimeToFull(t *testing.T) {
+	is := is.New(t)
+
+	ts := time.Unix(1675801037, 0).UTC()
+	history := func(ctx context.Context, prop string, lastN int) ([]database.LogValue, error) {
+		is.Equal(prop, "level")
+		return []database.LogValue{
+			{Value: 0.2, Timestamp: ts.Add(-30 * time.Hour)}, // outside of the rate window
+			{Value: 1.0, Timestamp: ts.Add(-4 * time.Hour)},
+			{Value: 1.5, Timestamp: ts.Add(-2 * time.Hour)},
+		}, nil
+	}
+
+	lvl, err := New("maxd=4,maxl=3", 0, clock.New(), history)
+	is.NoErr(err)
+
+	logged := map[string]float64{}
+	lvl.Handle(t.Context(), newDistance(2), func(prop string, v float64, _ time.Time) error {
+		logged[prop] = v
+		return nil
+	})
+
+	is.Equal(lvl.Current(), 2.0)
+	is.Equal(lvl.Rate(), 0.25)          // 0.25 meters per hour
+	is.Equal(logged["timeToFull"], 4.0) // one meter left to fill
+	is.Equal(*lvl.(*level).EstimatedFull, ts.Add(4*time.Hour))
+	is.True(lvl.(*level).EstimatedEmpty == nil)
+}
+
+func TestLevelRateAndTimeToEmpty(t *testing.T) {
+	is := is.New(t)
+
+	ts := time.Unix(1675801037, 0).UTC()
+	history := func(ctx context.Context, prop string, lastN int) ([]database.LogValue, error) {
+		return []database.LogValue{
+			{Value: 3.0, Timestamp: ts.Add(-2 * time.Hour)},
+			{Value: 2.0, Timestamp: ts}, // the current level has already been logged
+		}, nil
+	}
+
+	lvl, err := New("maxd=4,maxl=3,window=6h", 0, clock.New(), history)
+	is.NoErr(err)
+
+	lvl.Handle(t.Context(), newDistance(2), func(string, float64, time.Time) error { return nil })
+
+	is.Equal(lvl.Rate(), -0.5)
+	is.Equal(*lvl.(*level).EstimatedEmpty, ts.Add(4*time.Hour))
+	is.True(lvl.(*level).EstimatedFull == nil)
+}
+
+func TestLevelRateRequiresHistory(t *testing.T) {
+	is := is.New(t)
+
+	history := func(ctx context.Context, prop string, lastN int) ([]database.LogValue, error) {
+		return []database.LogValue{}, nil
+	}
+
+	lvl, err := New("maxd=4,maxl=3", 0, clock.New(), history)
+	is.NoErr(err)
+
+	lvl.Handle(t.Context(), newDistance(2), func(string, float64, time.Time) error { return nil })
+
+	is.True(lvl.(*level).Rate_ == nil)
+}
+
+func TestLevelRejectsSpikes(t *testing.T) {
+	is := is.New(t)
+
+	lvl, err := New("maxd=4,maxjump=0.3", 0, clock.New(), nil)
+	is.NoErr(err)
+
+	levels := []float64{}
+	onchange := func(prop string, v float64, _ time.Time) error {
+		if prop == "level" {
+			levels = append(levels, v)
+		}
+		return nil
+	}
+
+	changes := []bool{}
+	for _, d := range []float64{3.0, 2.9, 0.5, 2.8, 1.5, 1.4} {
+		changed, err := lvl.Handle(t.Context(), newDistance(d), onchange)
+		is.NoErr(err)
+		changes = append(changes, changed)
+	}
+
+	is.Equal(changes, []bool{true, true, false, true, false, true}) // rejected readings should not be published
+
+	is.Equal(levels, []float64{1.0, 1.1, 1.2, 2.6}) // the spike is rejected, the confirmed jump is accepted one reading late
+	is.Equal(lvl.(*level).Rejected, 2)
+}
+
+func TestLevelFilterOnlyKeepsTheLastLevelWithoutMedian(t *testing.T) {
+	is := is.New(t)
+
+	lvl, err := New("maxd=4,maxjump=0.3", 0, clock.New(), nil)
+	is.NoErr(err)
+
+	for _, d := range []float64{3.0, 2.9, 2.8, 2.7} {
+		lvl.Handle(t.Context(), newDistance(d), func(string, float64, time.Time) error { return nil })
+	}
+
+	is.Equal(lvl.(*level).filter.window, []float64{1.3})
+}
+
+func TestRestoredLevelIsCheckedForSpikes(t *testing.T) {
+	is := is.New(t)
+
+	lvl, err := New("maxd=4,maxjump=0.3", 0, clock.New(), nil)
+	is.NoErr(err)
+
+	err = json.Unmarshal([]byte(`{"current":1.0}`), lvl)
+	is.NoErr(err)
+
+	_, err = lvl.Handle(t.Context(), newDistance(0.5), func(string, float64, time.Time) error { return nil })
+	is.NoErr(err)
+
+	is.Equal(lvl.Current(), 1.0) // the spike after the restart is rejected
+	is.Equal(lvl.(*level).Rejected, 1)
+}
+
+func TestLevelRestoredFromHistoryIsCheckedForSpikes(t *testing.T) {
+	is := is.New(t)
+
+	factory, ok := factories.Get(FunctionTypeName)
+	is.True(ok)
+
+	lvl, err := factory.New(factories.Env{
+		Args:  "maxd=4,maxjump=0.3",
+		Last:  database.LogValue{Value: 1.0, Timestamp: time.Now().UTC()},
+		Clock: clock.New(),
+	})
+	is.NoErr(err)
+
+	_, err = lvl.Handle(t.Context(), newDistance(0.5), func(string, float64, time.Time) error { return nil })
+	is.NoErr(err)
+
+	is.Equal(lvl.(*level).Current(), 1.0) // the spike after the restart is rejected
+	is.Equal(lvl.(*level).Rejected, 1)
+}
+
+func TestRejectedReadingsAreSavedButNotPublished(t *testing.T) {
+	is := is.New(t)
+
+	lvl, err := New("maxd=4,maxjump=0.3", 0, clock.New(), nil)
+	is.NoErr(err)
+
+	onchange := func(string, float64, time.Time) error { return nil }
+	saver := lvl.(factories.Saver)
+
+	changed, _ := lvl.Handle(t.Context(), newDistance(3.0), onchange)
+	is.True(changed)
+	is.True(!saver.Unsaved())
+
+	changed, _ = lvl.Handle(t.Context(), newDistance(0.5), onchange)
+	is.True(!changed)        // a rejected reading does not change the level
+	is.True(saver.Unsaved()) // but the count of rejected readings should be saved
+	is.True(!saver.Unsaved())
+
+	changed, _ = lvl.Handle(t.Context(), newDistance(3.0), onchange)
+	is.True(!changed)
+	is.True(!saver.Unsaved())
+	is.Equal(lvl.(*level).Rejected, 1)
+}
+
+func TestLevelWithMedianFilter(t *testing.T) {
+	is := is.New(t)
+
+	lvl, err := New("maxd=4,filter=median:3", 0, clock.New(), nil)
+	is.NoErr(err)
+
+	for _, d := range []float64{3.0, 2.9, 0.5} {
+		lvl.Handle(t.Context(), newDistance(d), func(string, float64, time.Time) error { return nil })
+	}
+
+	is.Equal(lvl.Current(), 1.1) // median of 1.0, 1.1 and 3.5
+	is.Equal(lvl.(*level).Rejected, 0)
+}
+
+func TestInvalidLevelFilterConfig(t *testing.T) {
+	is := is.New(t)
+
+	_, err := New("maxd=4,filter=mean:3", 0, clock.New(), nil)
+	is.True(err != nil)
+
+	_, err = New("maxd=4,filter=median:0", 0, clock.New(), nil)
+	is.True(err != nil)
+
+	_, err = New("maxd=4,maxjump=-1", 0, clock.New(), nil)
+	is.True(err != nil)
+}
+
+func TestLevelInHorizontalCylinder(t *testing.T) {
+	is := is.New(t)
+
+	lvl, err := New("maxd=2.5,shape=hcylinder,diameter=2,length=5", 0, clock.New(), nil)
+	is.NoErr(err)
+
+	volumes := []float64{}
+	lvl.Handle(t.Context(), newDistance(1.5), func(prop string, v float64, _ time.Time) error {
+		if prop == "volume" {
+			volumes = append(volumes, v)
+		}
+		return nil
+	})
+
+	is.Equal(lvl.Current(), 1.0)
+	is.Equal(lvl.Volume(), 7853.98) // half of pi * 1² * 5 m³
+	is.Equal(volumes, []float64{7853.98})
+	is.Equal(math.Round(lvl.Percent()), 50.0)
+
+	lvl.Handle(t.Context(), newDistance(2.0), func(string, float64, time.Time) error { return nil })
+	is.Equal(lvl.Current(), 0.5)
+	is.Equal(math.Round(lvl.Percent()*100)/100, 19.55) // less than a quarter of the volume is in the bottom quarter
+}
+
+func TestLevelInCone(t *testing.T) {
+	is := is.New(t)
+
+	lvl, err := New("maxd=3,shape=cone,diameter=2,height=3", 1.5, clock.New(), nil)
+	is.NoErr(err)
+
+	is.Equal(lvl.Percent(), 12.5) // half the height holds an eighth of the volume
+}
+
+func TestLevelWithLookupTable(t *testing.T) {
+	is := is.New(t)
+
+	lvl, err := New("maxd=2,shape=table,table=1:400|0:0|0.5:100", 0, clock.New(), nil)
+	is.NoErr(err)
+
+	lvl.Handle(t.Context(), newDistance(1.25), func(string, float64, time.Time) error { return nil })
+
+	is.Equal(lvl.Current(), 0.75)
+	is.Equal(lvl.Volume(), 250.0) // interpolated between 0.5 and 1 meters
+	is.Equal(lvl.Percent(), 62.5) // max level defaults to the last entry in the table
+}
+
+func TestInvalidLevelShapeConfig(t *testing.T) {
+	is := is.New(t)
+
+	_, err := New("shape=sphere,diameter=2", 0, clock.New(), nil)
+	is.True(err != nil)
+
+	_, err = New("shape=hcylinder,diameter=2", 0, clock.New(), nil)
+	is.True(err != nil) // length is required
+
+	_, err = New("shape=table,table=0:0", 0, clock.New(), nil)
+	is.True(err != nil)
+
+	_, err = New("shape=table,table=0:0|1:x", 0, clock.New(), nil)
+	is.True(err != nil)
+}
+
 func newDistance(distance float64) *events.MessageAccepted {
 	e := &events.MessageAccepted{}
 
@@ -0,0 +1,199 @@
+package levels
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// shape calculates the volume of a tank or well, in litres, that is filled to
+// a level given in meters.
+type shape interface {
+	volume(level float64) float64
+	// height returns the height of a full tank, or zero if it is unknown
+	height() float64
+}
+
+const (
+	ShapeHorizontalCylinder string = "hcylinder"
+	ShapeVerticalCylinder   string = "vcylinder"
+	ShapeCone               string = "cone"
+	ShapeTable              string = "table"
+)
+
+const litresPerCubicMeter float64 = 1000.0
+
+// shapeConfig collects the shape related level settings so that the shape
+// can be created once all settings have been parsed, regardless of order.
+type shapeConfig struct {
+	name     string
+	diameter float64
+	length   float64
+	height   float64
+	table    string
+}
+
+func (c shapeConfig) create() (shape, error) {
+	switch c.name {
+	case "":
+		return nil, nil
+	case ShapeHorizontalCylinder:
+		if c.diameter <= 0 || c.length <= 0 {
+			return nil, fmt.Errorf("shape %s requires a positive diameter and length", c.name)
+		}
+		return &horizontalCylinder{radius: c.diameter / 2, length: c.length}, nil
+	case ShapeVerticalCylinder:
+		if c.diameter <= 0 {
+			return nil, fmt.Errorf("shape %s requires a positive diameter", c.name)
+		}
+		return &verticalCylinder{radius: c.diameter / 2, height_: c.height}, nil
+	case ShapeCone:
+		if c.diameter <= 0 || c.height <= 0 {
+			return nil, fmt.Errorf("shape %s requires a positive diameter and height", c.name)
+		}
+		return &cone{radius: c.diameter / 2, height_: c.height}, nil
+	case ShapeTable:
+		return parseLookupTable(c.table)
+	default:
+		return nil, fmt.Errorf("unknown shape %q", c.name)
+	}
+}
+
+// horizontalCylinder is a cylinder lying on its side, such as a fuel tank
+type horizontalCylinder struct {
+	radius float64
+	length float64
+}
+
+func (c *horizontalCylinder) volume(level float64) float64 {
+	h := math.Max(0, math.Min(level, 2*c.radius))
+	r := c.radius
+
+	// the area of the circular segment that is below the level
+	area := r*r*math.Acos((r-h)/r) - (r-h)*math.Sqrt(2*r*h-h*h)
+
+	return area * c.length * litresPerCubicMeter
+}
+
+func (c *horizontalCylinder) height() float64 {
+	return 2 * c.radius
+}
+
+type verticalCylinder struct {
+	radius  float64
+	height_ float64
+}
+
+func (c *verticalCylinder) volume(level float64) float64 {
+	h := math.Max(0, level)
+	if c.height_ > 0 {
+		h = math.Min(h, c.height_)
+	}
+
+	return math.Pi * c.radius * c.radius * h * litresPerCubicMeter
+}
+
+func (c *verticalCylinder) height() float64 {
+	return c.height_
+}
+
+// cone is an upright cone with its apex at the bottom
+type cone struct {
+	radius  float64
+	height_ float64
+}
+
+func (c *cone) volume(level float64) float64 {
+	h := math.Max(0, math.Min(level, c.height_))
+	r := c.radius * h / c.height_
+
+	return math.Pi * r * r * h / 3 * litresPerCubicMeter
+}
+
+func (c *cone) height() float64 {
+	return c.height_
+}
+
+type tableEntry struct {
+	level  float64
+	volume float64
+}
+
+// lookupTable interpolates the volume linearly between user supplied
+// level→volume pairs
+type lookupTable struct {
+	entries []tableEntry
+}
+
+// parseLookupTable parses a table such as "0:0|0.5:120|1.2:400" where each
+// entry is a level in meters and the volume in litres at that level.
+func parseLookupTable(table string) (shape, error) {
+	if table == "" {
+		return nil, fmt.Errorf("shape %s requires a lookup table", ShapeTable)
+	}
+
+	t := &lookupTable{}
+
+	for entry := range strings.SplitSeq(table, "|") {
+		level, volume, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid lookup table entry %q", entry)
+		}
+
+		l, err := strconv.ParseFloat(level, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lookup table entry %q: %w", entry, err)
+		}
+
+		v, err := strconv.ParseFloat(volume, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lookup table entry %q: %w", entry, err)
+		}
+
+		t.entries = append(t.entries, tableEntry{level: l, volume: v})
+	}
+
+	if len(t.entries) < 2 {
+		return nil, fmt.Errorf("lookup table requires at least two entries")
+	}
+
+	slices.SortFunc(t.entries, func(a, b tableEntry) int {
+		return cmp.Compare(a.level, b.level)
+	})
+
+	for i := 1; i < len(t.entries); i++ {
+		if t.entries[i].level == t.entries[i-1].level {
+			return nil, fmt.Errorf("lookup table contains more than one entry for level %f", t.entries[i].level)
+		}
+	}
+
+	return t, nil
+}
+
+func (t *lookupTable) volume(level float64) float64 {
+	first, last := t.entries[0], t.entries[len(t.entries)-1]
+
+	if level <= first.level {
+		return first.volume
+	}
+
+	if level >= last.level {
+		return last.volume
+	}
+
+	i, _ := slices.BinarySearchFunc(t.entries, level, func(e tableEntry, l float64) int {
+		return cmp.Compare(e.level, l)
+	})
+
+	lo, hi := t.entries[i-1], t.entries[i]
+	fraction := (level - lo.level) / (hi.level - lo.level)
+
+	return lo.volume + fraction*(hi.volume-lo.volume)
+}
+
+func (t *lookupTable) height() float64 {
+	return t.entries[len(t.entries)-1].level
+}
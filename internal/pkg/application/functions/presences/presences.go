@@ -5,6 +5,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
 	"github.com/diwise/iot-core/pkg/lwm2m"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/senml"
@@ -14,6 +15,18 @@ const (
 	FunctionTypeName string = "presence"
 )
 
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "presence",
+		DefaultHistoryLabel: "presence",
+		RestoreFromHistory:  true,
+		New: func(env factories.Env) (factories.State, error) {
+			return New(env.Last.Value), nil
+		},
+	})
+}
+
 type Presence interface {
 	Handle(context.Context, *events.MessageAccepted, func(string, float64, time.Time) error) (bool, error)
 	State() bool
@@ -1,139 +1,281 @@
 package functions
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
+	"sync"
 
-	"github.com/diwise/iot-core/internal/pkg/application/functions/airquality"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/buildings"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/counters"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/digitalinput"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/levels"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/presences"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/stopwatch"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/timers"
-	"github.com/diwise/iot-core/internal/pkg/application/functions/waterqualities"
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
 	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
+	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 )
 
 type Registry interface {
 	Find(ctx context.Context, matchers ...RegistryMatcherFunc) ([]Function, error)
 	Get(ctx context.Context, functionID string) (Function, error)
+
+	Add(ctx context.Context, s Setting) (Function, error)
+	Update(ctx context.Context, s Setting) (Function, error)
+	Remove(ctx context.Context, functionID string) error
+
+	Reload(ctx context.Context, settings []Setting) (ConfigChanges, error)
+	SaveStates(ctx context.Context) error
 }
 
-func NewRegistry(ctx context.Context, input io.Reader, storage database.Storage) (Registry, error) {
+// ConfigChanges are the function ids that were affected when the functions
+// config was reloaded
+type ConfigChanges struct {
+	Added   []string
+	Updated []string
+	Removed []string
+	// Skipped are the functions that have changed in the config, but that have
+	// been added or updated at runtime which takes precedence
+	Skipped   []string
+	Unchanged int
+}
 
-	r := &reg{
-		f: make(map[string]Function),
+// Empty tells if the reload did not change any functions
+func (c ConfigChanges) Empty() bool {
+	return len(c.Added)+len(c.Updated)+len(c.Removed) == 0
+}
+
+var ErrNotFound = errors.New("no such function")
+var ErrAlreadyExists = errors.New("function already exists")
+var ErrInvalidSetting = errors.New("invalid function setting")
+var ErrConfigured = errors.New("function is defined in the functions config")
+
+var errUnknownFunctionType = errors.New("unknown function type")
+
+// Setting holds the configuration of a single function, either parsed from
+// a line in the functions config file or supplied through the API. A function
+// may be bound to several sensors by separating their ids with a comma.
+type Setting struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	SubType  string `json:"subtype"`
+	SensorID string `json:"sensorID"`
+	Tenant   string `json:"tenant,omitempty"`
+	OnUpdate bool   `json:"onupdate"`
+	Args     string `json:"args,omitempty"`
+}
+
+func (s Setting) validate() error {
+	if s.ID == "" {
+		return fmt.Errorf("%w: id is missing", ErrInvalidSetting)
+	}
+	if s.Type == "" {
+		return fmt.Errorf("%w: type is missing", ErrInvalidSetting)
+	}
+	// some function types are updated by other functions rather than by sensors
+	if factory, ok := factories.Get(s.Type); ok && factory.Sensorless {
+		return nil
+	}
+	if len(s.SensorIDs()) == 0 {
+		return fmt.Errorf("%w: sensorID is missing", ErrInvalidSetting)
+	}
+	return nil
+}
+
+// SensorIDs returns the lowercased ids of the sensors the function is bound to
+func (s Setting) SensorIDs() []string {
+	ids := make([]string, 0, 1)
+	for id := range strings.SplitSeq(s.SensorID, ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if id != "" && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// SourceIDs returns the ids of the functions that the function combines the
+// values of, if its type combines the values of other functions and its args
+// are valid
+func (s Setting) SourceIDs() []string {
+	factory, ok := factories.Get(s.Type)
+	if !ok || factory.Sources == nil {
+		return nil
 	}
 
-	var err error
+	return factory.Sources(s.Args)
+}
+
+func NewRegistry(ctx context.Context, input io.Reader, storage database.Storage, clk clock.Clock) (Registry, error) {
 
-	numErrors := 0
-	numFunctions := 0
+	r := &reg{
+		f:          make(map[string]Function),
+		sensors:    make(map[string][]Function),
+		storage:    storage,
+		clock:      clk,
+		composites: make(map[string][]*fnct),
+		config:     make(map[string]Setting),
+		runtime:    make(map[string]bool),
+	}
 
 	logger := logging.GetFromContext(ctx)
 
-	scanner := bufio.NewScanner(input)
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		tokens := strings.Split(line, ";")
-		tokenCount := len(tokens)
-
-		if tokenCount >= 4 {
-			f := &fnct{
-				ID_:      tokens[0],
-				Name_:    tokens[1],
-				Type:     tokens[2],
-				SubType:  tokens[3],
-				OnUpdate: (tokenCount > 5 && tokens[5] == "true"),
-				storage:  storage,
-			}
+	settings, err := LoadConfig(input)
+	if err != nil {
+		return nil, fmt.Errorf("invalid functions config: %w", err)
+	}
 
-			if f.Type == counters.FunctionTypeName {
-				f.Counter = counters.New()
-				f.handle = f.Counter.Handle
-				f.defaultHistoryLabel = "count"
-			} else if f.Type == levels.FunctionTypeName {
-				levelConfig := ""
-				if tokenCount > 6 {
-					levelConfig = tokens[6]
-				}
-				f.defaultHistoryLabel = "level"
-				l := lastLogValue(ctx, storage, f)
-
-				logger.Debug("new level created", "function_id", f.ID_, "value", l.Value)
-
-				f.Level, err = levels.New(levelConfig, l.Value)
-				if err != nil {
-					return nil, err
-				}
-
-				f.handle = f.Level.Handle
-			} else if f.Type == presences.FunctionTypeName {
-				f.defaultHistoryLabel = "presence"
-				l := lastLogValue(ctx, storage, f)
-
-				logger.Debug("new presence created", "function_id", f.ID_, "value", l.Value)
-
-				f.Presence = presences.New(l.Value)
-				f.handle = f.Presence.Handle
-			} else if f.Type == timers.FunctionTypeName {
-				f.Timer = timers.New()
-				f.handle = f.Timer.Handle
-				f.defaultHistoryLabel = "time"
-			} else if f.Type == waterqualities.FunctionTypeName {
-				f.WaterQuality = waterqualities.New()
-				f.handle = f.WaterQuality.Handle
-				f.defaultHistoryLabel = "temperature"
-			} else if f.Type == buildings.FunctionTypeName {
-				f.Building = buildings.New()
-				f.handle = f.Building.Handle
-				f.defaultHistoryLabel = "power"
-			} else if f.Type == airquality.FunctionTypeName {
-				f.AirQuality = airquality.New()
-				f.handle = f.AirQuality.Handle
-				f.defaultHistoryLabel = "temperature"
-			} else if f.Type == stopwatch.FunctionTypeName {
-				f.Stopwatch = stopwatch.New()
-				f.handle = f.Stopwatch.Handle
-				f.defaultHistoryLabel = "duration"
-			} else if f.Type == digitalinput.FunctionTypeName {
-				f.defaultHistoryLabel = "digitalinput"
-				l := lastLogValue(ctx, storage, f)
-
-				logger.Debug("new digital input created", "function_id", f.ID_, "value", l.Value)
-
-				f.DigitalInput = digitalinput.New(l.Value)
-				f.handle = f.DigitalInput.Handle
-			} else {
-				numErrors++
-				if numErrors > 1 {
-					return nil, fmt.Errorf("unable to parse function config line: \"%s\"", line)
-				}
-				continue
-			}
+	for _, s := range settings {
+		f, err := newFunction(ctx, s, storage, clk)
+		if err != nil {
+			return nil, err
+		}
+
+		storage.AddFnct(ctx, f.ID_, f.Type, f.SubType, f.Tenant_, f.Source, 0, 0)
+
+		r.add(f)
+		r.config[s.ID] = s
+	}
+
+	logger.Info("loaded functions from config file", "count", len(r.f))
 
-			storage.AddFnct(ctx, f.ID_, f.Type, f.SubType, f.Tenant, f.Source, 0, 0)
+	stored, err := storage.Fncts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stored functions: %w", err)
+	}
+
+	for _, fs := range stored {
+		s := Setting{
+			ID:       fs.ID,
+			Name:     fs.Name,
+			Type:     fs.Type,
+			SubType:  fs.SubType,
+			SensorID: fs.SensorID,
+			Tenant:   fs.Tenant,
+			OnUpdate: fs.OnUpdate,
+			Args:     fs.Args,
+		}
+
+		f, err := newFunction(ctx, s, storage, clk)
+		if err != nil {
+			logger.Error("failed to restore stored function", "function_id", s.ID, "err", err.Error())
+			continue
+		}
+
+		// functions that have been changed at runtime take precedence over the config file
+		if existing, ok := r.get(s.ID); ok {
+			r.remove(existing)
+		}
+
+		r.add(f)
+		r.runtime[s.ID] = true
+	}
+
+	logger.Info("loaded stored functions", "count", len(stored))
+
+	states, err := storage.States(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load function states: %w", err)
+	}
+
+	numRestored := 0
+
+	for _, f := range r.f {
+		state, ok := states[f.ID()]
+		if !ok {
+			continue
+		}
 
-			r.f[strings.ToLower(tokens[4])] = f
-			numFunctions++
+		err = f.(*fnct).restore(state)
+		if err != nil {
+			logger.Error("failed to restore function state", "function_id", f.ID(), "err", err.Error())
+			continue
 		}
+
+		numRestored++
 	}
 
-	logger.Info("loaded functions from config file", "count", numFunctions)
+	logger.Info("restored function states", "count", numRestored)
 
 	return r, nil
 }
 
+func newFunction(ctx context.Context, s Setting, storage database.Storage, clk clock.Clock) (*fnct, error) {
+	logger := logging.GetFromContext(ctx)
+
+	f := &fnct{
+		ID_:      s.ID,
+		Name_:    s.Name,
+		Type:     s.Type,
+		SubType:  s.SubType,
+		Tenant_:  s.Tenant,
+		OnUpdate: s.OnUpdate,
+		setting:  s,
+		storage:  storage,
+		clock:    clk,
+	}
+
+	factory, ok := factories.Get(s.Type)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownFunctionType, f.Type)
+	}
+
+	f.factory = factory
+	f.defaultHistoryLabel = factory.DefaultHistoryLabel
+
+	env := factories.Env{
+		ID:    s.ID,
+		Args:  s.Args,
+		Clock: clk,
+		History: func(ctx context.Context, prop string, lastN int) ([]database.LogValue, error) {
+			return storage.History(ctx, f.ID_, prop, lastN)
+		},
+	}
+
+	if factory.RestoreFromHistory {
+		env.Last = lastLogValue(ctx, storage, f)
+		logger.Debug("new function created from history", "function_id", f.ID_, "type", f.Type, "value", env.Last.Value)
+	}
+
+	state, err := factory.New(env)
+	if err != nil {
+		return nil, err
+	}
+
+	f.state = state
+	f.handle = state.Handle
+
+	if ticker, ok := state.(factories.Ticker); ok {
+		f.tick = ticker.Tick
+	}
+
+	if labeler, ok := state.(factories.Labeler); ok {
+		f.defaultHistoryLabel = labeler.DefaultHistoryLabel()
+	}
+
+	return f, nil
+}
+
 type reg struct {
-	f map[string]Function
+	f       map[string]Function   // functions keyed by function id
+	sensors map[string][]Function // functions keyed by the (lowercased) ids of the sensors they are bound to
+	storage database.Storage
+	clock   clock.Clock
+	mu      sync.RWMutex
+
+	// composites are the composite functions keyed by the ids of their source
+	// functions. It has a lock of its own since it is used while function locks
+	// are held, and mu is held while function locks are taken by Update.
+	composites map[string][]*fnct
+	compMu     sync.RWMutex
+
+	// config are the settings of the functions config that was loaded last,
+	// keyed by function id
+	config map[string]Setting
+	// runtime are the ids of the functions that have been added or updated
+	// through the API, and so take precedence over the config
+	runtime map[string]bool
 }
 
 func (r *reg) Find(ctx context.Context, matchers ...RegistryMatcherFunc) ([]Function, error) {
@@ -142,24 +284,449 @@ func (r *reg) Find(ctx context.Context, matchers ...RegistryMatcherFunc) ([]Func
 		return nil, fmt.Errorf("at least one matcher must be supplied to Find")
 	}
 
-	var result []Function
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// all matchers must match for a function to be part of the result
+	result := matchers[0](r)
+
+	for _, match := range matchers[1:] {
+		if len(result) == 0 {
+			break
+		}
 
-	// TODO: Handle multiple chained matchers
-	for _, match := range matchers {
-		result = match(r)
+		matched := match(r)
+		result = slices.DeleteFunc(result, func(f Function) bool {
+			return !slices.Contains(matched, f)
+		})
 	}
 
 	return result, nil
 }
 
 func (r *reg) Get(ctx context.Context, functionID string) (Function, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	f, ok := r.get(functionID)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return f, nil
+}
+
+func (r *reg) Add(ctx context.Context, s Setting) (Function, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.get(s.ID); ok {
+		return nil, ErrAlreadyExists
+	}
+
+	if err := r.checkCompositeCycles([]Setting{s}, nil); err != nil {
+		return nil, err
+	}
+
+	f, err := r.create(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	r.add(f)
+	r.runtime[s.ID] = true
+
+	logging.GetFromContext(ctx).Info("function added", "function_id", s.ID, "type", s.Type)
+
+	return f, nil
+}
+
+func (r *reg) Update(ctx context.Context, s Setting) (Function, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.get(s.ID)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if err := r.checkCompositeCycles([]Setting{s}, nil); err != nil {
+		return nil, err
+	}
+
+	f, err := r.create(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	keepState(ctx, existing, f)
+
+	r.remove(existing)
+	r.add(f)
+	r.runtime[s.ID] = true
+
+	logging.GetFromContext(ctx).Info("function updated", "function_id", s.ID, "type", s.Type)
+
+	return f, nil
+}
+
+// Remove removes a function that has been added at runtime. A function from
+// the config that has been updated at runtime is reverted to the config
+// instead, while one that has not can only be removed from the config.
+func (r *reg) Remove(ctx context.Context, functionID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.get(functionID)
+	if !ok {
+		return ErrNotFound
+	}
+
+	configured, isConfigured := r.config[functionID]
+
+	// a function from the config would be loaded again on the next restart or
+	// reload, so it has to be removed from the config instead
+	if isConfigured && !r.runtime[functionID] {
+		return fmt.Errorf("%w: %s", ErrConfigured, functionID)
+	}
+
+	var reverted *fnct
+
+	if isConfigured {
+		if err := r.checkCompositeCycles([]Setting{configured}, nil); err != nil {
+			return err
+		}
+
+		var err error
+		reverted, err = newFunction(ctx, configured, r.storage, r.clock)
+		if err != nil {
+			return fmt.Errorf("failed to revert function %s to the config: %w", functionID, err)
+		}
+	}
+
+	if reverted != nil {
+		// the configured function keeps its history and state, only the
+		// settings that were changed at runtime are dropped
+		err := r.storage.ResetFnct(ctx, functionID)
+		if err != nil {
+			return fmt.Errorf("failed to revert function %s to the config: %w", functionID, err)
+		}
+	} else {
+		err := r.storage.DeleteFnct(ctx, functionID)
+		if err != nil {
+			return fmt.Errorf("failed to delete function %s: %w", functionID, err)
+		}
+	}
+
+	r.remove(f)
+	delete(r.runtime, functionID)
+
+	if reverted != nil {
+		keepState(ctx, f, reverted)
+		r.add(reverted)
+
+		logging.GetFromContext(ctx).Info("function reverted to the config", "function_id", functionID)
+		return nil
+	}
+
+	logging.GetFromContext(ctx).Info("function removed", "function_id", functionID)
+
+	return nil
+}
+
+// Reload applies the settings of a reloaded functions config. Only the
+// functions whose settings differ from the previously loaded config are added,
+// reconfigured or removed, and the state of reconfigured functions is kept.
+// Functions that have been changed at runtime take precedence over the config
+// and are left as they are. No changes are made if any setting is invalid or
+// any function fails to be created.
+func (r *reg) Reload(ctx context.Context, settings []Setting) (ConfigChanges, error) {
+	changes := ConfigChanges{}
+
+	if err := validateSettings(settings); err != nil {
+		return ConfigChanges{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config := make(map[string]Setting, len(settings))
+	created := map[string]*fnct{}
+
+	for _, s := range settings {
+		config[s.ID] = s
+
+		previous, ok := r.config[s.ID]
+		if ok && previous == s {
+			changes.Unchanged++
+			continue
+		}
+
+		if r.runtime[s.ID] {
+			changes.Skipped = append(changes.Skipped, s.ID)
+			continue
+		}
+
+		f, err := newFunction(ctx, s, r.storage, r.clock)
+		if err != nil {
+			return ConfigChanges{}, fmt.Errorf("failed to create function %s: %w", s.ID, err)
+		}
+		created[s.ID] = f
+
+		if ok {
+			changes.Updated = append(changes.Updated, s.ID)
+		} else {
+			changes.Added = append(changes.Added, s.ID)
+		}
+	}
+
+	for id := range r.config {
+		if _, ok := config[id]; ok {
+			continue
+		}
+
+		if r.runtime[id] {
+			changes.Skipped = append(changes.Skipped, id)
+			continue
+		}
+
+		changes.Removed = append(changes.Removed, id)
+	}
+
+	// the config has no cycles of its own, but its composites may form one
+	// with composites that have been added at runtime
+	changed := make([]Setting, 0, len(created))
+	for _, f := range created {
+		changed = append(changed, f.setting)
+	}
+
+	if err := r.checkCompositeCycles(changed, changes.Removed); err != nil {
+		return ConfigChanges{}, err
+	}
+
+	for _, id := range changes.Removed {
+		if existing, ok := r.get(id); ok {
+			r.remove(existing)
+		}
+	}
+
+	for id, f := range created {
+		if existing, ok := r.get(id); ok {
+			keepState(ctx, existing, f)
+			r.remove(existing)
+		} else {
+			r.storage.AddFnct(ctx, f.ID_, f.Type, f.SubType, f.Tenant_, f.Source, 0, 0)
+		}
+
+		r.add(f)
+	}
+
+	r.config = config
+
+	slices.Sort(changes.Added)
+	slices.Sort(changes.Updated)
+	slices.Sort(changes.Removed)
+	slices.Sort(changes.Skipped)
+
+	return changes, nil
+}
+
+// SaveStates stores a snapshot of the state of every function, so that the
+// functions can be restored as they are when the service is stopped
+func (r *reg) SaveStates(ctx context.Context) error {
+	r.mu.RLock()
+	registered := make([]*fnct, 0, len(r.f))
 	for _, f := range r.f {
-		if f.ID() == functionID {
-			return f, nil
+		if fn, ok := f.(*fnct); ok {
+			registered = append(registered, fn)
+		}
+	}
+	r.mu.RUnlock()
+
+	errs := []error{}
+
+	for _, f := range registered {
+		f.mu.Lock()
+		err := f.saveState(ctx)
+		f.mu.Unlock()
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to save state of function %s: %w", f.ID_, err))
+		}
+	}
+
+	logging.GetFromContext(ctx).Info("saved function states", "count", len(registered)-len(errs))
+
+	return errors.Join(errs...)
+}
+
+// keepState keeps the state of a reconfigured function, or at least the
+// metadata that has been learned from incoming messages if the type has changed
+func keepState(ctx context.Context, existing Function, f *fnct) {
+	prev, ok := existing.(*fnct)
+	if !ok {
+		return
+	}
+
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+
+	if prev.Type == f.Type {
+		state, _ := prev.marshal()
+
+		if err := f.restore(state); err != nil {
+			logging.GetFromContext(ctx).Error("failed to keep function state", "function_id", f.ID_, "err", err.Error())
+		}
+		return
+	}
+
+	f.DeviceID = prev.DeviceID
+	f.Location = prev.Location
+	if f.Tenant_ == "" {
+		f.Tenant_ = prev.Tenant_
+	}
+	f.Source = prev.Source
+	f.Timestamp = prev.Timestamp
+}
+
+// checkCompositeCycles returns an error if the changed settings, with the
+// functions with the removed ids gone, would make composite functions depend on
+// themselves. Only cycles through the changed functions are reported, so that a
+// cycle that is already in the registry does not prevent other changes. Callers
+// must hold the lock.
+func (r *reg) checkCompositeCycles(changed []Setting, removed []string) error {
+	graph := map[string][]string{}
+	for id, f := range r.f {
+		if fn, ok := f.(*fnct); ok {
+			if sources := fn.setting.SourceIDs(); len(sources) > 0 {
+				graph[id] = sources
+			}
 		}
 	}
 
-	return nil, errors.New("no such function")
+	for _, id := range removed {
+		delete(graph, id)
+	}
+
+	for _, s := range changed {
+		delete(graph, s.ID)
+		if sources := s.SourceIDs(); len(sources) > 0 {
+			graph[s.ID] = sources
+		}
+	}
+
+	for _, s := range changed {
+		if cycle := compositeCycle(graph, s.ID); cycle != nil {
+			return fmt.Errorf("%w: composite function %s would depend on itself via %s", ErrInvalidSetting, s.ID, strings.Join(cycle, " -> "))
+		}
+	}
+
+	return nil
+}
+
+// create builds a new function from the setting and persists the setting
+// so that the function can be restored after a restart
+func (r *reg) create(ctx context.Context, s Setting) (*fnct, error) {
+	f, err := newFunction(ctx, s, r.storage, r.clock)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSetting, err.Error())
+	}
+
+	err = r.storage.SaveFnct(ctx, database.Fnct{
+		ID:       s.ID,
+		Name:     s.Name,
+		Type:     s.Type,
+		SubType:  s.SubType,
+		SensorID: s.SensorID,
+		Tenant:   s.Tenant,
+		OnUpdate: s.OnUpdate,
+		Args:     s.Args,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store function %s: %w", s.ID, err)
+	}
+
+	return f, nil
+}
+
+// get returns the function with the given id. Callers must hold the lock.
+func (r *reg) get(functionID string) (Function, bool) {
+	f, ok := r.f[functionID]
+	return f, ok
+}
+
+// add adds the function to the registry and binds it to its sensors. Callers must hold the lock.
+func (r *reg) add(f Function) {
+	r.f[f.ID()] = f
+	for _, sensorID := range f.Setting().SensorIDs() {
+		r.sensors[sensorID] = append(r.sensors[sensorID], f)
+	}
+
+	if fn, ok := f.(*fnct); ok {
+		fn.notify = r.notifyComposites
+
+		if comp, ok := fn.state.(factories.Combiner); ok {
+			r.compMu.Lock()
+			for _, source := range comp.Sources() {
+				r.composites[source] = append(r.composites[source], fn)
+			}
+			r.compMu.Unlock()
+		}
+	}
+}
+
+// remove removes the function from the registry. Callers must hold the lock.
+func (r *reg) remove(f Function) {
+	delete(r.f, f.ID())
+	for _, sensorID := range f.Setting().SensorIDs() {
+		bound := slices.DeleteFunc(slices.Clone(r.sensors[sensorID]), func(rf Function) bool { return rf == f })
+		if len(bound) == 0 {
+			delete(r.sensors, sensorID)
+		} else {
+			r.sensors[sensorID] = bound
+		}
+	}
+
+	fn, ok := f.(*fnct)
+	if !ok {
+		return
+	}
+
+	if comp, ok := fn.state.(factories.Combiner); ok {
+		r.compMu.Lock()
+		for _, source := range comp.Sources() {
+			dependents := slices.DeleteFunc(slices.Clone(r.composites[source]), func(c *fnct) bool { return c == fn })
+			if len(dependents) == 0 {
+				delete(r.composites, source)
+			} else {
+				r.composites[source] = dependents
+			}
+		}
+		r.compMu.Unlock()
+	}
+}
+
+// notifyComposites updates the composite functions that depend on the source
+// function with the changes from its latest update
+func (r *reg) notifyComposites(ctx context.Context, msgctx messaging.MsgContext, source, label string, changes []change) {
+	r.compMu.RLock()
+	dependents := slices.Clone(r.composites[source])
+	r.compMu.RUnlock()
+
+	for _, c := range dependents {
+		err := c.updateComposite(ctx, msgctx, source, label, changes)
+		if err != nil {
+			logging.GetFromContext(ctx).Error("failed to update composite function", "function_id", c.ID(), "source_id", source, "err", err.Error())
+		}
+	}
 }
 
 type RegistryMatcherFunc func(r *reg) []Function
@@ -176,15 +743,73 @@ func MatchAll() RegistryMatcherFunc {
 
 func MatchSensor(sensorId string) RegistryMatcherFunc {
 	return func(r *reg) []Function {
-		f, ok := r.f[strings.ToLower(sensorId)]
+		bound, ok := r.sensors[strings.ToLower(sensorId)]
 		if !ok {
 			return []Function{}
 		}
 
-		return []Function{f}
+		return slices.Clone(bound)
 	}
 }
 
+func MatchType(fnType string) RegistryMatcherFunc {
+	return matchFnct(func(f *fnct) bool {
+		return f.Type == fnType
+	})
+}
+
+func MatchSubType(subType string) RegistryMatcherFunc {
+	return matchFnct(func(f *fnct) bool {
+		return f.SubType == subType
+	})
+}
+
+func MatchTenant(tenant string) RegistryMatcherFunc {
+	return matchFnct(func(f *fnct) bool {
+		return f.tenant() == tenant
+	})
+}
+
+func MatchSource(source string) RegistryMatcherFunc {
+	return matchFnct(func(f *fnct) bool {
+		return f.Source == source
+	})
+}
+
+// MatchWithinBoundingBox matches functions with a known location inside, or on
+// the edge of, the box spanned by the south west and north east corners.
+func MatchWithinBoundingBox(minLat, minLon, maxLat, maxLon float64) RegistryMatcherFunc {
+	return matchFnct(func(f *fnct) bool {
+		if f.Location == nil {
+			return false
+		}
+		return f.Location.Latitude >= minLat && f.Location.Latitude <= maxLat &&
+			f.Location.Longitude >= minLon && f.Location.Longitude <= maxLon
+	})
+}
+
+// matchFnct matches the functions that satisfy the predicate, which is called
+// with the lock of the function held since its tenant, source and location may
+// be set while it handles a message
+func matchFnct(predicate func(f *fnct) bool) RegistryMatcherFunc {
+	return func(r *reg) []Function {
+		result := make([]Function, 0)
+		for _, f := range r.f {
+			if fn, ok := f.(*fnct); ok && fn.matches(predicate) {
+				result = append(result, f)
+			}
+		}
+		return result
+	}
+}
+
+func (f *fnct) matches(predicate func(f *fnct) bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return predicate(f)
+}
+
 func lastLogValue(ctx context.Context, s database.Storage, f *fnct) database.LogValue {
 	lv, err := s.History(ctx, f.ID_, f.defaultHistoryLabel, 1)
 	if err != nil {
@@ -3,10 +3,18 @@ package functions
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/counters"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
 	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
+	"github.com/diwise/iot-core/pkg/lwm2m"
+	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/matryer/is"
 )
 
@@ -19,13 +27,22 @@ func TestCreateRegistry(t *testing.T) {
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 			return nil
 		},
 		InitializeFunc: func(contextMoqParam context.Context) error {
 			return nil
 		},
-	})
+	}, clock.New())
 	is.NoErr(err)
 
 	matches, err := reg.Find(context.Background(), MatchSensor(sensorId))
@@ -42,13 +59,22 @@ func TestFindNonMatchingFunctionReturnsEmptySlice(t *testing.T) {
 		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 			return nil
 		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
 		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 			return nil
 		},
 		InitializeFunc: func(contextMoqParam context.Context) error {
 			return nil
 		},
-	})
+	}, clock.New())
 	is.NoErr(err)
 
 	matches, err := reg.Find(context.Background(), MatchSensor("noSuchSensor"))
@@ -56,3 +82,516 @@ func TestFindNonMatchingFunctionReturnsEmptySlice(t *testing.T) {
 
 	is.Equal(len(matches), 0) // should not find any matching functions
 }
+
+func TestAddUpdateAndRemoveFunction(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	storage := &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		SaveFnctFunc: func(ctx context.Context, f database.Fnct) error {
+			return nil
+		},
+		DeleteFnctFunc: func(ctx context.Context, id string) error {
+			return nil
+		},
+	}
+
+	reg, err := NewRegistry(ctx, bytes.NewBufferString(""), storage, clock.New())
+	is.NoErr(err)
+
+	_, err = reg.Add(ctx, Setting{ID: "fid1", Name: "name", Type: "counter", SubType: "overflow", SensorID: "sensor1"})
+	is.NoErr(err)
+	is.Equal(len(storage.SaveFnctCalls()), 1) // the new function should be persisted
+
+	_, err = reg.Add(ctx, Setting{ID: "fid1", Type: "counter", SensorID: "sensor1"})
+	is.True(errors.Is(err, ErrAlreadyExists)) // adding the same function twice should fail
+
+	_, err = reg.Add(ctx, Setting{ID: "fid2", Type: "nosuchtype", SensorID: "sensor2"})
+	is.True(errors.Is(err, ErrInvalidSetting)) // unknown function types should be rejected
+
+	f, err := reg.Update(ctx, Setting{ID: "fid1", Name: "new name", Type: "counter", SubType: "overflow", SensorID: "sensor2"})
+	is.NoErr(err)
+	is.Equal(f.Name(), "new name")
+
+	matches, _ := reg.Find(ctx, MatchSensor("sensor1"))
+	is.Equal(len(matches), 0) // the function should no longer be bound to the old sensor
+
+	matches, _ = reg.Find(ctx, MatchSensor("sensor2"))
+	is.Equal(len(matches), 1) // the function should be bound to the new sensor
+
+	err = reg.Remove(ctx, "fid1")
+	is.NoErr(err)
+	is.Equal(len(storage.DeleteFnctCalls()), 1)
+
+	_, err = reg.Get(ctx, "fid1")
+	is.True(errors.Is(err, ErrNotFound))
+
+	err = reg.Remove(ctx, "fid1")
+	is.True(errors.Is(err, ErrNotFound))
+}
+
+func TestStoredFunctionsAreRestored(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	config := "functionID;name;counter;overflow;sensorId;false"
+	reg, err := NewRegistry(ctx, bytes.NewBufferString(config), &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return []database.Fnct{
+				{ID: "functionID", Name: "changed", Type: "counter", SubType: "overflow", SensorID: "otherSensorId"},
+				{ID: "runtimeID", Name: "runtime", Type: "counter", SubType: "overflow", SensorID: "runtimeSensorId"},
+			}, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+	}, clock.New())
+	is.NoErr(err)
+
+	f, err := reg.Get(ctx, "functionID")
+	is.NoErr(err)
+	is.Equal(f.Name(), "changed") // stored settings should take precedence over the config file
+
+	matches, _ := reg.Find(ctx, MatchSensor("sensorId"))
+	is.Equal(len(matches), 0)
+
+	_, err = reg.Get(ctx, "runtimeID")
+	is.NoErr(err)
+}
+
+func TestSensorsAndFunctionsCanBeBoundManyToMany(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	config := "stopwatchID;stopwatch;stopwatch;;sensorA;false\n" +
+		"levelID;level;level;sand;sensorB,sensorC;false;maxd=3.0,maxl=2.5"
+
+	reg, err := NewRegistry(ctx, bytes.NewBufferString(config), &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		HistoryFunc: func(ctx context.Context, id, label string, lastN int) ([]database.LogValue, error) {
+			return []database.LogValue{}, nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		SaveFnctFunc: func(ctx context.Context, f database.Fnct) error {
+			return nil
+		},
+		DeleteFnctFunc: func(ctx context.Context, id string) error {
+			return nil
+		},
+	}, clock.New())
+	is.NoErr(err)
+
+	_, err = reg.Add(ctx, Setting{ID: "counterID", Name: "counter", Type: "counter", SubType: "overflow", SensorID: "sensorA"})
+	is.NoErr(err)
+
+	matches, _ := reg.Find(ctx, MatchSensor("sensorA"))
+	is.Equal(len(matches), 2) // one sensor should feed both the counter and the stopwatch
+
+	matches, _ = reg.Find(ctx, MatchSensor("sensorB"))
+	is.Equal(len(matches), 1)
+	is.Equal(matches[0].ID(), "levelID")
+
+	matches, _ = reg.Find(ctx, MatchSensor("SENSORC"))
+	is.Equal(len(matches), 1) // sensor ids should be matched case insensitively
+	is.Equal(matches[0].ID(), "levelID")
+
+	err = reg.Remove(ctx, "counterID")
+	is.NoErr(err)
+
+	matches, _ = reg.Find(ctx, MatchSensor("sensorA"))
+	is.Equal(len(matches), 1) // removing one function should not unbind the others
+	is.Equal(matches[0].ID(), "stopwatchID")
+}
+
+func TestFunctionsFromConfigCanNotBeRemoved(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	storage := &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		SaveFnctFunc: func(ctx context.Context, f database.Fnct) error {
+			return nil
+		},
+		DeleteFnctFunc: func(ctx context.Context, id string) error {
+			return nil
+		},
+		ResetFnctFunc: func(ctx context.Context, id string) error {
+			return nil
+		},
+	}
+
+	reg, err := NewRegistry(ctx, bytes.NewBufferString("c1;Ett;counter;overflow;sensor1;false"), storage, clock.New())
+	is.NoErr(err)
+
+	err = reg.Remove(ctx, "c1")
+	is.True(errors.Is(err, ErrConfigured)) // the config would bring the function back
+	is.Equal(len(storage.DeleteFnctCalls()), 0)
+
+	_, err = reg.Update(ctx, Setting{ID: "c1", Name: "Uppdaterad", Type: "counter", SubType: "overflow", SensorID: "sensor1"})
+	is.NoErr(err)
+
+	err = reg.Remove(ctx, "c1")
+	is.NoErr(err) // removing an updated function reverts it to the config
+	is.Equal(len(storage.ResetFnctCalls()), 1)
+	is.Equal(len(storage.DeleteFnctCalls()), 0) // the configured function is kept in the database
+
+	f, err := reg.Get(ctx, "c1")
+	is.NoErr(err)
+	is.Equal(f.Name(), "Ett")
+
+	err = reg.Remove(ctx, "c1")
+	is.True(errors.Is(err, ErrConfigured)) // once reverted, there is no update left to remove
+
+	_, err = reg.Update(ctx, Setting{ID: "c1", Name: "Uppdaterad", Type: "counter", SubType: "overflow", SensorID: "sensor1"})
+	is.NoErr(err)
+
+	_, err = reg.Reload(ctx, []Setting{})
+	is.NoErr(err)
+
+	err = reg.Remove(ctx, "c1")
+	is.NoErr(err) // once removed from the config, the function is only kept because it was updated at runtime
+	is.Equal(len(storage.DeleteFnctCalls()), 1)
+
+	_, err = reg.Get(ctx, "c1")
+	is.True(errors.Is(err, ErrNotFound))
+}
+
+func TestRevertedFunctionKeepsItsHistoryAndState(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	// the storage mimics the foreign keys of the history and state tables
+	fncts := map[string]bool{}
+	history := map[string]int{}
+
+	storage := &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			fncts[id] = true
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		SaveFnctFunc: func(ctx context.Context, f database.Fnct) error {
+			fncts[f.ID] = true
+			return nil
+		},
+		DeleteFnctFunc: func(ctx context.Context, id string) error {
+			delete(fncts, id)
+			delete(history, id)
+			return nil
+		},
+		ResetFnctFunc: func(ctx context.Context, id string) error {
+			return nil
+		},
+		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
+			if !fncts[id] {
+				return fmt.Errorf("no function %s", id)
+			}
+			history[id]++
+			return nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			if !fncts[id] {
+				return fmt.Errorf("no function %s", id)
+			}
+			return nil
+		},
+	}
+
+	reg, err := NewRegistry(ctx, bytes.NewBufferString("c1;Ett;counter;overflow;sensor1;false"), storage, clock.New())
+	is.NoErr(err)
+
+	ts, _ := time.Parse(time.RFC3339, "2024-03-20T12:19:48+01:00")
+
+	f, _ := reg.Get(ctx, "c1")
+	err = f.Handle(ctx, events.NewMessageAccepted(NewSenMLPack("sensor1", lwm2m.DigitalInput, ts, BoolValue("5500", true, 0))), msgctx)
+	is.NoErr(err)
+	logged := history["c1"]
+	is.True(logged > 0)
+
+	_, err = reg.Update(ctx, Setting{ID: "c1", Name: "Uppdaterad", Type: "counter", SubType: "overflow", SensorID: "sensor1"})
+	is.NoErr(err)
+
+	err = reg.Remove(ctx, "c1")
+	is.NoErr(err)
+	is.Equal(history["c1"], logged) // the history should survive the revert
+
+	f, _ = reg.Get(ctx, "c1")
+	err = f.Handle(ctx, events.NewMessageAccepted(NewSenMLPack("sensor1", lwm2m.DigitalInput, ts.Add(time.Minute), BoolValue("5500", false, 0))), msgctx)
+	is.NoErr(err)
+	is.True(history["c1"] > logged) // values should still be added to the history
+
+	is.NoErr(reg.SaveStates(ctx)) // and the state should still be saved
+}
+
+func TestReloadRejectsInvalidSettings(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	storage := &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+	}
+
+	reg, err := NewRegistry(ctx, bytes.NewBufferString("c1;Ett;counter;overflow;sensor1;false"), storage, clock.New())
+	is.NoErr(err)
+
+	_, err = reg.Reload(ctx, []Setting{
+		{ID: "c2", Name: "Två", Type: "counter", SubType: "overflow", SensorID: "sensor2"},
+		{ID: "c3", Name: "Tre", Type: "counter", SubType: "overflow"},
+	})
+	is.True(errors.Is(err, ErrInvalidSetting)) // c3 is missing its sensor
+
+	_, err = reg.Get(ctx, "c2")
+	is.True(errors.Is(err, ErrNotFound)) // the whole reload should be rejected
+
+	_, err = reg.Get(ctx, "c1")
+	is.NoErr(err)
+}
+
+func TestCompositeCyclesAreRejected(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	storage := &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		SaveFnctFunc: func(ctx context.Context, f database.Fnct) error {
+			return nil
+		},
+	}
+
+	config := strings.Join([]string{
+		"c1;Ett;counter;overflow;sensor1;false",
+		"total;Totalt;composite;;;false;sources=c1|later",
+	}, "\n")
+
+	reg, err := NewRegistry(ctx, bytes.NewBufferString(config), storage, clock.New())
+	is.NoErr(err)
+
+	_, err = reg.Add(ctx, Setting{ID: "extra", Type: "composite", Args: "sources=total"})
+	is.NoErr(err)
+
+	_, err = reg.Add(ctx, Setting{ID: "later", Type: "composite", Args: "sources=extra"})
+	is.True(errors.Is(err, ErrInvalidSetting)) // later would depend on itself through total and extra
+
+	_, err = reg.Update(ctx, Setting{ID: "total", Type: "composite", Args: "sources=c1|extra"})
+	is.True(errors.Is(err, ErrInvalidSetting))
+	is.Equal(len(storage.SaveFnctCalls()), 1) // rejected settings should not be persisted
+
+	settings, err := LoadConfig(strings.NewReader(strings.Join([]string{
+		"c1;Ett;counter;overflow;sensor1;false",
+		"total;Totalt;composite;;;false;sources=extra",
+		"other;Annan;composite;;;false;sources=c1",
+	}, "\n")))
+	is.NoErr(err) // the config has no cycles of its own
+
+	_, err = reg.Reload(ctx, settings)
+	is.True(errors.Is(err, ErrInvalidSetting)) // but would form one with extra
+
+	_, err = reg.Get(ctx, "other")
+	is.True(errors.Is(err, ErrNotFound)) // and should not be applied at all
+}
+
+func TestChainedMatchersMustAllMatch(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	r := &reg{
+		f:       make(map[string]Function),
+		sensors: make(map[string][]Function),
+	}
+
+	r.add(&fnct{ID_: "fid1", Type: "counter", SubType: "overflow", Tenant_: "default", Source: "src1", Location: &location{Latitude: 62.39, Longitude: 17.30}, setting: Setting{SensorID: "s1"}})
+	r.add(&fnct{ID_: "fid2", Type: "counter", SubType: "door", Tenant_: "default", Location: &location{Latitude: 59.33, Longitude: 18.06}, setting: Setting{SensorID: "s2"}})
+	r.add(&fnct{ID_: "fid3", Type: "level", SubType: "sand", Tenant_: "other", Source: "src1", setting: Setting{SensorID: "s3"}})
+
+	matches, err := r.Find(ctx, MatchAll(), MatchType("counter"))
+	is.NoErr(err)
+	is.Equal(len(matches), 2)
+
+	matches, _ = r.Find(ctx, MatchType("counter"), MatchSubType("door"))
+	is.Equal(len(matches), 1)
+	is.Equal(matches[0].ID(), "fid2")
+
+	matches, _ = r.Find(ctx, MatchSource("src1"), MatchTenant("other"))
+	is.Equal(len(matches), 1)
+	is.Equal(matches[0].ID(), "fid3")
+
+	matches, _ = r.Find(ctx, MatchTenant("default"), MatchWithinBoundingBox(62.0, 17.0, 63.0, 18.0))
+	is.Equal(len(matches), 1)
+	is.Equal(matches[0].ID(), "fid1")
+
+	matches, _ = r.Find(ctx, MatchSensor("s3"), MatchType("counter"))
+	is.Equal(len(matches), 0) // no function should match all matchers
+}
+
+func TestReloadOnlyChangesFunctionsThatDiffer(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	storage := &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return map[string][]byte{
+				"c2": []byte(`{"id":"c2","counter":{"count":5,"state":true}}`),
+			}, nil
+		},
+		SaveFnctFunc: func(ctx context.Context, f database.Fnct) error {
+			return nil
+		},
+	}
+
+	config := strings.Join([]string{
+		"c1;Ett;counter;overflow;sensor1;false",
+		"c2;Två;counter;overflow;sensor2;false",
+		"c3;Tre;counter;overflow;sensor3;false",
+	}, "\n")
+
+	reg, err := NewRegistry(ctx, bytes.NewBufferString(config), storage, clock.New())
+	is.NoErr(err)
+
+	_, err = reg.Add(ctx, Setting{ID: "r1", Name: "runtime", Type: "counter", SubType: "overflow", SensorID: "sensor5"})
+	is.NoErr(err)
+
+	c1, _ := reg.Get(ctx, "c1")
+
+	settings, err := LoadConfig(strings.NewReader(strings.Join([]string{
+		"c1;Ett;counter;overflow;sensor1;false",
+		"c2;Två;counter;overflow;sensor2,sensor4;false",
+		"c4;Fyra;counter;overflow;sensor4;false",
+		"r1;Från fil;counter;overflow;sensor6;false",
+	}, "\n")))
+	is.NoErr(err)
+
+	changes, err := reg.Reload(ctx, settings)
+	is.NoErr(err)
+
+	is.Equal(changes, ConfigChanges{
+		Added:     []string{"c4"},
+		Updated:   []string{"c2"},
+		Removed:   []string{"c3"},
+		Skipped:   []string{"r1"},
+		Unchanged: 1,
+	})
+
+	f, _ := reg.Get(ctx, "c1")
+	is.True(f == c1) // untouched functions should be left as they are
+
+	f, _ = reg.Get(ctx, "c2")
+	is.Equal(f.(*fnct).state.(counters.Counter).Count(), 5) // reconfigured functions should keep their state
+
+	matches, _ := reg.Find(ctx, MatchSensor("sensor4"))
+	is.Equal(len(matches), 2)
+
+	_, err = reg.Get(ctx, "c3")
+	is.True(errors.Is(err, ErrNotFound))
+
+	f, _ = reg.Get(ctx, "r1")
+	is.Equal(f.Name(), "runtime") // functions changed at runtime take precedence over the config
+
+	changes, err = reg.Reload(ctx, settings)
+	is.NoErr(err)
+	is.True(changes.Empty()) // reloading the same config should not change anything
+}
+
+func TestChangedResetPeriodIsNotOverriddenByTheState(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	storage := &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return map[string][]byte{
+				"c1": []byte(`{"id":"c1","counter":{"count":5,"state":true,"period":{"reset":"daily","count":3,"start":"2023-02-07T00:00:00Z"}}}`),
+			}, nil
+		},
+	}
+
+	config := "c1;Ett;counter;overflow;sensor1;false;reset=weekly"
+
+	reg, err := NewRegistry(ctx, bytes.NewBufferString(config), storage, clock.New())
+	is.NoErr(err)
+
+	f, _ := reg.Get(ctx, "c1")
+	c := f.(*fnct).state.(counters.Counter)
+	is.Equal(c.Count(), 5)       // the total count should be restored
+	is.Equal(c.PeriodCount(), 0) // a daily period should not be counted as a weekly one
+
+	state, _ := json.Marshal(f)
+	is.True(strings.Contains(string(state), `"period":{"reset":"weekly","count":0}`))
+
+	settings, err := LoadConfig(strings.NewReader("c1;Ett;counter;overflow;sensor1;false"))
+	is.NoErr(err)
+
+	_, err = reg.Reload(ctx, settings)
+	is.NoErr(err)
+
+	f, _ = reg.Get(ctx, "c1")
+	c = f.(*fnct).state.(counters.Counter)
+	is.Equal(c.Count(), 5)
+	is.Equal(c.PeriodCount(), 5) // a counter that is no longer reset should not keep a period
+
+	state, _ = json.Marshal(f)
+	is.True(!strings.Contains(string(state), `"period"`))
+}
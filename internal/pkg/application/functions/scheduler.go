@@ -0,0 +1,79 @@
+package functions
+
+import (
+	"context"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+const DefaultTickInterval time.Duration = 1 * time.Minute
+
+// Scheduler periodically lets every registered function update its state,
+// see fnct.Tick, until the context passed to Run is cancelled.
+type Scheduler interface {
+	Run(ctx context.Context)
+}
+
+type tickable interface {
+	Tick(ctx context.Context, now time.Time, msgctx messaging.MsgContext) error
+}
+
+func NewScheduler(registry Registry, msgctx messaging.MsgContext, clk clock.Clock, interval time.Duration) Scheduler {
+	return &scheduler{
+		registry: registry,
+		msgctx:   msgctx,
+		clock:    clk,
+		interval: interval,
+	}
+}
+
+type scheduler struct {
+	registry Registry
+	msgctx   messaging.MsgContext
+	clock    clock.Clock
+	interval time.Duration
+}
+
+func (s *scheduler) Run(ctx context.Context) {
+	logger := logging.GetFromContext(ctx)
+
+	ticker := s.clock.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	logger.Debug("function scheduler started", "interval", s.interval.String())
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debug("function scheduler stopped")
+			return
+		case now := <-ticker.C():
+			s.tick(ctx, now)
+		}
+	}
+}
+
+func (s *scheduler) tick(ctx context.Context, now time.Time) {
+	logger := logging.GetFromContext(ctx)
+
+	registered, err := s.registry.Find(ctx, MatchAll())
+	if err != nil {
+		logger.Error("failed to find functions to tick", "err", err.Error())
+		return
+	}
+
+	for _, f := range registered {
+		t, ok := f.(tickable)
+		if !ok {
+			continue
+		}
+
+		err := t.Tick(ctx, now, s.msgctx)
+		if err != nil {
+			logger.Error("function failed to handle tick", "function_id", f.ID(), "err", err.Error())
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
+	"github.com/diwise/iot-core/pkg/lwm2m"
+	"github.com/diwise/iot-core/pkg/messaging/events"
+)
+
+func TestSchedulerTicksRunningTimers(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	var mu sync.Mutex
+	logged := []float64{}
+
+	start := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+	clk := clock.NewFake(start)
+
+	config := "functionID;name;timer;overflow;testId;false"
+	reg, err := NewRegistry(ctx, bytes.NewBufferString(config), &database.StorageMock{
+		AddFnFunc: func(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
+			return nil
+		},
+		FnctsFunc: func(ctx context.Context) ([]database.Fnct, error) {
+			return nil, nil
+		},
+		SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+			return nil
+		},
+		StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+			return nil, nil
+		},
+		AddFunc: func(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
+			if label == "time" {
+				mu.Lock()
+				logged = append(logged, value)
+				mu.Unlock()
+			}
+			return nil
+		},
+	}, clk)
+	is.NoErr(err)
+
+	f, _ := reg.Find(ctx, MatchSensor("testId"))
+	pack := NewSenMLPack("testId", lwm2m.DigitalInput, start, BoolValue("5500", true, 0))
+	e := events.NewMessageAccepted(pack)
+	e.Timestamp = start
+	is.NoErr(f[0].Handle(ctx, e, msgctx))
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		NewScheduler(reg, msgctx, clk, time.Minute).Run(ctx)
+		close(done)
+	}()
+
+	clk.BlockUntilTickers(1)
+	clk.Advance(3 * time.Minute)
+
+	cancel()
+	<-done // the scheduler should stop when the context is cancelled
+
+	is.Equal(logged, []float64{0, 1, 2, 3}) // one value when started and then one per tick
+}
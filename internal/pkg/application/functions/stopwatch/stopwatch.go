@@ -7,6 +7,8 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
 	"github.com/diwise/iot-core/pkg/lwm2m"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/senml"
@@ -15,12 +17,24 @@ import (
 
 const FunctionTypeName = "stopwatch"
 
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "stopwatch",
+		DefaultHistoryLabel: "duration",
+		New: func(env factories.Env) (factories.State, error) {
+			return New(env.Clock), nil
+		},
+	})
+}
+
 type Stopwatch interface {
 	Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error)
 }
 
-func New() *StopwatchImpl {
+func New(clk clock.Clock) *StopwatchImpl {
 	return &StopwatchImpl{
+		clock:          clk,
 		StartTime:      time.Time{},
 		CumulativeTime: 0,
 	}
@@ -35,6 +49,8 @@ type StopwatchImpl struct {
 	Count int32 `json:"count"`
 
 	CumulativeTime time.Duration `json:"cumulativeTime"`
+
+	clock clock.Clock
 }
 
 func (sw *StopwatchImpl) Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
@@ -63,7 +79,7 @@ func (sw *StopwatchImpl) Handle(ctx context.Context, e *events.MessageAccepted,
 
 	if ts.IsZero() {
 		log.Warn("timestamp was Zero")
-		ts = time.Now().UTC()
+		ts = sw.clock.Now().UTC()
 	}
 
 	storedState, _ := json.Marshal(sw)
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/matryer/is"
 )
@@ -14,7 +15,7 @@ import (
 func TestStopwatch(t *testing.T) {
 	is := is.New(t)
 
-	sw := New()
+	sw := New(clock.New())
 	sw.Handle(context.Background(), newState(true, "2023-02-07T21:00:00.000000Z"), func(string, float64, time.Time) error { return nil })
 	is.True(sw.State)
 	is.True(sw.Count == 1)
@@ -37,6 +38,43 @@ func TestStopwatch(t *testing.T) {
 	is.True(sw.Count == 5)
 }
 
+func TestStopwatchOverSeveralHours(t *testing.T) {
+	is := is.New(t)
+
+	clk := clock.NewFake(time.Date(2023, 2, 7, 21, 0, 0, 0, time.UTC))
+	sw := New(clk)
+
+	durations := []float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		if prop == "duration" {
+			durations = append(durations, v)
+		}
+		return nil
+	}
+
+	handle := func(on bool) {
+		_, err := sw.Handle(context.Background(), newState(on, clk.Now().Format(time.RFC3339Nano)), onchange)
+		is.NoErr(err)
+	}
+
+	handle(true)
+	clk.Advance(2 * time.Hour)
+	handle(true)
+	clk.Advance(90 * time.Minute)
+	handle(false)
+	is.Equal(*sw.Duration, 3*time.Hour+30*time.Minute)
+
+	clk.Advance(5 * time.Hour) // time spent stopped should not be counted
+	handle(false)
+	handle(true)
+	clk.Advance(1 * time.Hour)
+	handle(false)
+
+	is.Equal(sw.CumulativeTime, 4*time.Hour+30*time.Minute)
+	is.Equal(sw.Count, int32(5))
+	is.Equal(durations, []float64{7200, 12600, 3600})
+}
+
 func newState(on bool, timestamp string) *events.MessageAccepted {
 	ts, _ := time.Parse(time.RFC3339Nano, timestamp)
 
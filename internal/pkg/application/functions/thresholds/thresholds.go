@@ -0,0 +1,271 @@
+package thresholds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
+	"github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/diwise/senml"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+const (
+	FunctionTypeName string = "threshold"
+)
+
+const lwm2mPrefix string = "urn:oma:lwm2m:ext:"
+
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "threshold",
+		DefaultHistoryLabel: "alarm",
+		RestoreFromHistory:  true,
+		Args: []factories.Arg{
+			{Name: "urn"},
+			{Name: "res"},
+			{Name: "high", Kind: factories.Number},
+			{Name: "low", Kind: factories.Number},
+			{Name: "hysteresis", Kind: factories.Number},
+		},
+		New: func(env factories.Env) (factories.State, error) {
+			return New(env.Args, env.Last.Value, History(env.History))
+		},
+	})
+}
+
+type Threshold interface {
+	Handle(context.Context, *events.MessageAccepted, func(string, float64, time.Time) error) (bool, error)
+	Active() bool
+	Value() float64
+}
+
+// History returns the last lastN values that have been logged for prop, oldest first
+type History func(ctx context.Context, prop string, lastN int) ([]database.LogValue, error)
+
+// New creates a threshold function from a config string such as
+// "urn=3303,res=5700,high=25,low=5,hysteresis=0.5". The alarm becomes active
+// when the value of the resource rises above high or falls below low, and is
+// not cleared until the value is back within the limits by a margin of at
+// least hysteresis. The alarm state is restored from active, and the limit of
+// an active alarm is looked up in the history once the first value arrives.
+//
+// Every change of the alarm is recorded as "alarm" (1 raised, 0 cleared)
+// together with the exceeded limit as "limit" (1 high, -1 low, 0 none), so
+// that a switch from one exceeded limit to the other is kept in the history.
+func New(config string, active float64, history History) (Threshold, error) {
+	th := &threshold{
+		resource: "5700",
+		history:  history,
+		Active_:  isNotZero(active),
+	}
+
+	config = strings.ReplaceAll(config, " ", "")
+	settings := strings.Split(config, ",")
+
+	for _, s := range settings {
+		pair := strings.Split(s, "=")
+		if len(pair) != 2 {
+			continue
+		}
+
+		var err error
+
+		switch pair[0] {
+		case "urn":
+			th.objectURN = pair[1]
+			if !strings.HasPrefix(th.objectURN, lwm2mPrefix) {
+				th.objectURN = lwm2mPrefix + th.objectURN
+			}
+		case "res":
+			th.resource = pair[1]
+		case "high":
+			th.high, err = parseLimit(pair[1])
+		case "low":
+			th.low, err = parseLimit(pair[1])
+		case "hysteresis":
+			th.hysteresis, err = strconv.ParseFloat(pair[1], 64)
+			if err == nil && th.hysteresis < 0 {
+				err = fmt.Errorf("hysteresis must not be negative")
+			}
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse threshold config \"%s\": %w", s, err)
+		}
+	}
+
+	if th.objectURN == "" {
+		return nil, fmt.Errorf("threshold config must contain an object urn")
+	}
+
+	if th.high == nil && th.low == nil {
+		return nil, fmt.Errorf("threshold config must contain a high and/or low limit")
+	}
+
+	if th.high != nil && th.low != nil && *th.low >= *th.high {
+		return nil, fmt.Errorf("threshold low limit %f must be less than the high limit %f", *th.low, *th.high)
+	}
+
+	// an alarm is only cleared when the value is at least hysteresis away from
+	// both limits, which must leave room for at least one value in between
+	if th.high != nil && th.low != nil && *th.low+th.hysteresis > *th.high-th.hysteresis {
+		return nil, fmt.Errorf("threshold hysteresis %f is too large for the limits %f and %f", th.hysteresis, *th.low, *th.high)
+	}
+
+	return th, nil
+}
+
+type threshold struct {
+	objectURN  string
+	resource   string
+	high       *float64
+	low        *float64
+	hysteresis float64
+	history    History
+
+	Active_   bool      `json:"active"`
+	Limit     string    `json:"limit,omitempty"`
+	Value_    float64   `json:"-"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (th *threshold) Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
+	if !events.Matches(e, th.objectURN) {
+		return false, events.ErrNoMatch
+	}
+
+	log := logging.GetFromContext(ctx)
+
+	r, ok := e.Pack().GetRecord(senml.FindByName(th.resource))
+	if !ok {
+		return false, fmt.Errorf("could not find record for resource %s in %s pack", th.resource, e.ObjectID())
+	}
+
+	v, ok := r.GetValue()
+	if !ok {
+		return false, fmt.Errorf("could not find a numeric value for resource %s in %s pack", th.resource, e.ObjectID())
+	}
+
+	ts, ok := r.GetTime()
+	if !ok {
+		ts = e.Timestamp
+	}
+
+	th.Value_ = v
+
+	if th.Active_ && th.Limit == "" {
+		th.restoreLimit(ctx)
+	}
+
+	limit := th.exceeded(v)
+
+	// an alarm from before the limits were logged adopts the exceeded limit,
+	// rather than reporting it as a switch of limits
+	if th.Active_ && th.Limit == "" {
+		th.Limit = limit
+	}
+
+	if !th.Active_ && limit != "" {
+		log.Info("threshold alarm raised", "value", v, "limit", limit)
+		th.Active_ = true
+		th.Limit = limit
+		th.Timestamp = ts
+		return true, errors.Join(onchange("alarm", 1, ts), onchange("limit", limitValue[limit], ts))
+	}
+
+	// a value may go straight from beyond one limit to beyond the other, in
+	// which case the alarm stays raised but for the other limit
+	if th.Active_ && limit != "" && limit != th.Limit {
+		log.Info("threshold alarm limit changed", "value", v, "old_limit", th.Limit, "new_limit", limit)
+		th.Limit = limit
+		th.Timestamp = ts
+		return true, onchange("limit", limitValue[limit], ts)
+	}
+
+	if th.Active_ && th.cleared(v) {
+		log.Info("threshold alarm cleared", "value", v)
+		th.Active_ = false
+		th.Limit = ""
+		th.Timestamp = ts
+		return true, errors.Join(onchange("alarm", 0, ts), onchange("limit", limitValue[""], ts))
+	}
+
+	return false, nil
+}
+
+var limitValue = map[string]float64{"high": 1, "low": -1, "": 0}
+
+// restoreLimit looks up the limit of an alarm that has been restored from the
+// history, since only the alarm itself is restored from the last logged value
+func (th *threshold) restoreLimit(ctx context.Context) {
+	if th.history == nil {
+		return
+	}
+
+	logged, err := th.history(ctx, "limit", 1)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("failed to fetch the limit of the restored alarm", "err", err.Error())
+		return
+	}
+
+	if len(logged) == 0 {
+		return
+	}
+
+	for name, v := range limitValue {
+		if name != "" && logged[0].Value == v {
+			th.Limit = name
+		}
+	}
+}
+
+// exceeded returns the name of the limit that is exceeded by v, if any
+func (th *threshold) exceeded(v float64) string {
+	if th.high != nil && v > *th.high {
+		return "high"
+	}
+	if th.low != nil && v < *th.low {
+		return "low"
+	}
+	return ""
+}
+
+func (th *threshold) cleared(v float64) bool {
+	if th.high != nil && v > *th.high-th.hysteresis {
+		return false
+	}
+	if th.low != nil && v < *th.low+th.hysteresis {
+		return false
+	}
+	return true
+}
+
+func (th *threshold) Active() bool {
+	return th.Active_
+}
+
+func (th *threshold) Value() float64 {
+	return th.Value_
+}
+
+func parseLimit(s string) (*float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func isNotZero(value float64) bool {
+	return (math.Abs(value) >= 0.001)
+}
@@ -0,0 +1,180 @@
+package thresholds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/database"
+	"github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/matryer/is"
+)
+
+func TestThresholdAlarmIsRaisedAndCleared(t *testing.T) {
+	is := is.New(t)
+
+	th, err := New("urn=3303,res=5700,high=25,low=5,hysteresis=0.5", 0, nil)
+	is.NoErr(err)
+
+	alarms := []float64{}
+	limits := []float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		switch prop {
+		case "alarm":
+			alarms = append(alarms, v)
+		case "limit":
+			limits = append(limits, v)
+		default:
+			t.Fatalf("unexpected property %s", prop)
+		}
+		return nil
+	}
+
+	changed, err := th.Handle(t.Context(), newTemperature(20), onchange)
+	is.NoErr(err)
+	is.True(!changed)
+
+	changed, _ = th.Handle(t.Context(), newTemperature(25.2), onchange)
+	is.True(changed) // high limit exceeded
+	is.True(th.Active())
+
+	changed, _ = th.Handle(t.Context(), newTemperature(24.8), onchange)
+	is.True(!changed) // still within the hysteresis of the high limit
+	is.True(th.Active())
+
+	changed, _ = th.Handle(t.Context(), newTemperature(24.4), onchange)
+	is.True(changed)
+	is.True(!th.Active())
+
+	changed, _ = th.Handle(t.Context(), newTemperature(4.9), onchange)
+	is.True(changed) // low limit exceeded
+	is.True(th.Active())
+	is.Equal(th.Value(), 4.9)
+
+	is.Equal(alarms, []float64{1, 0, 1})
+	is.Equal(limits, []float64{1, 0, -1})
+}
+
+func TestThresholdIgnoresOtherObjects(t *testing.T) {
+	is := is.New(t)
+
+	th, err := New("urn=urn:oma:lwm2m:ext:3304,high=80", 0, nil)
+	is.NoErr(err)
+
+	_, err = th.Handle(t.Context(), newTemperature(100), func(string, float64, time.Time) error { return nil })
+	is.Equal(err, events.ErrNoMatch)
+}
+
+func TestThresholdStateIsRestored(t *testing.T) {
+	is := is.New(t)
+
+	history := func(ctx context.Context, prop string, lastN int) ([]database.LogValue, error) {
+		if prop != "limit" {
+			return []database.LogValue{}, nil
+		}
+		return []database.LogValue{{Value: -1, Timestamp: time.Now()}}, nil
+	}
+
+	th, err := New("urn=3303,high=25,low=5", 1, history)
+	is.NoErr(err)
+	is.True(th.Active())
+
+	logged := []string{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		logged = append(logged, prop)
+		return nil
+	}
+
+	changed, _ := th.Handle(t.Context(), newTemperature(2), onchange)
+	is.True(!changed) // an alarm that is already active should not be raised again
+	is.Equal(len(logged), 0)
+	is.Equal(th.(*threshold).Limit, "low") // the limit should be restored together with the alarm
+
+	changed, _ = th.Handle(t.Context(), newTemperature(30), onchange)
+	is.True(changed)
+	is.Equal(logged, []string{"limit"}) // a switch to the other limit is still recorded
+}
+
+func TestThresholdWithoutLoggedLimitAdoptsTheExceededLimit(t *testing.T) {
+	is := is.New(t)
+
+	th, err := New("urn=3303,high=25", 1, nil)
+	is.NoErr(err)
+
+	logged := []string{}
+	changed, _ := th.Handle(t.Context(), newTemperature(26), func(prop string, v float64, ts time.Time) error {
+		logged = append(logged, prop)
+		return nil
+	})
+	is.True(!changed) // the limit should not be reported as changed
+	is.Equal(len(logged), 0)
+	is.Equal(th.(*threshold).Limit, "high")
+}
+
+func TestThresholdAlarmFollowsTheExceededLimit(t *testing.T) {
+	is := is.New(t)
+
+	th, err := New("urn=3303,res=5700,high=25,low=5", 0, nil)
+	is.NoErr(err)
+
+	alarms := []float64{}
+	limits := []float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		if prop == "limit" {
+			limits = append(limits, v)
+		} else {
+			alarms = append(alarms, v)
+		}
+		return nil
+	}
+
+	th.Handle(t.Context(), newTemperature(30), onchange)
+	is.Equal(th.(*threshold).Limit, "high")
+
+	changed, err := th.Handle(t.Context(), newTemperature(2), onchange)
+	is.NoErr(err)
+	is.True(changed)
+	is.True(th.Active())
+	is.Equal(th.(*threshold).Limit, "low")
+
+	is.Equal(alarms, []float64{1})     // the alarm is still the one that was raised
+	is.Equal(limits, []float64{1, -1}) // but the switch of limits is recorded
+}
+
+func TestInvalidThresholdConfig(t *testing.T) {
+	is := is.New(t)
+
+	_, err := New("res=5700,high=25", 0, nil)
+	is.True(err != nil) // urn is required
+
+	_, err = New("urn=3303", 0, nil)
+	is.True(err != nil) // at least one limit is required
+
+	_, err = New("urn=3303,high=5,low=25", 0, nil)
+	is.True(err != nil) // low must be less than high
+
+	_, err = New("urn=3303,high=6,low=5,hysteresis=0.6", 0, nil)
+	is.True(err != nil) // an alarm could never be cleared
+
+	_, err = New("urn=3303,high=6,low=5,hysteresis=0.5", 0, nil)
+	is.NoErr(err) // but it may be cleared at exactly 5.5
+
+	_, err = New("urn=3303,high=hot", 0, nil)
+	is.True(err != nil)
+}
+
+func newTemperature(temp float64) *events.MessageAccepted {
+	e := &events.MessageAccepted{}
+	json.Unmarshal(fmt.Appendf(nil, temperatureJSONFormat, temp), e)
+	return e
+}
+
+const temperatureJSONFormat string = `{
+	"pack":[
+		{"bn":"testid/3303/","bt":1675801037,"n":"0","vs":"urn:oma:lwm2m:ext:3303"},
+		{"n":"5700","u":"Cel","v":%f}
+	],
+	"timestamp":"2023-02-07T20:17:17.312028Z"
+}`
@@ -4,6 +4,8 @@ import (
 	"context"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
 	"github.com/diwise/iot-core/pkg/lwm2m"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/senml"
@@ -11,15 +13,28 @@ import (
 
 const FunctionTypeName string = "timer"
 
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "timer",
+		DefaultHistoryLabel: "time",
+		New: func(env factories.Env) (factories.State, error) {
+			return New(env.Clock), nil
+		},
+	})
+}
+
 type Timer interface {
 	Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error)
+	Tick(ctx context.Context, now time.Time, onchange func(prop string, value float64, ts time.Time) error) (bool, error)
 
 	State() bool
 }
 
-func New() Timer {
+func New(clk clock.Clock) Timer {
 	return &timer{
 		StartTime: time.Time{},
+		clock:     clk,
 	}
 }
 
@@ -30,7 +45,8 @@ type timer struct {
 	State_    bool           `json:"state"`
 
 	TotalDuration time.Duration `json:"totalDuration"`
-	valueUpdater  *time.Ticker
+
+	clock clock.Clock
 }
 
 func (t *timer) Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
@@ -48,6 +64,10 @@ func (t *timer) Handle(ctx context.Context, e *events.MessageAccepted, onchange
 	ts, timeOk := e.Pack().GetTime(senml.FindByName(DigitalInputState))
 
 	if stateOK && timeOk && r.BoolValue != nil {
+		if ts.IsZero() {
+			ts = t.clock.Now().UTC()
+		}
+
 		state := *r.BoolValue
 
 		if state != previousState {
@@ -74,24 +94,6 @@ func (t *timer) Handle(ctx context.Context, e *events.MessageAccepted, onchange
 				if err != nil {
 					return true, err
 				}
-
-				if t.valueUpdater == nil {
-					t.valueUpdater = time.NewTicker(1 * time.Minute)
-					go func() error {
-						for range t.valueUpdater.C {
-							if t.State_ {
-								now := time.Now().UTC()
-								duration := t.TotalDuration + now.Sub(t.StartTime)
-								err = onchange("time", duration.Minutes(), now)
-								if err != nil {
-									t.valueUpdater.Stop()
-									return err
-								}
-							}
-						}
-						return nil
-					}()
-				}
 			} else {
 				err = onchange("state", 1, ts)
 				if err != nil {
@@ -121,6 +123,21 @@ func (t *timer) Handle(ctx context.Context, e *events.MessageAccepted, onchange
 	return previousState != t.State_, nil
 }
 
+// Tick updates the duration and logs the accumulated time while the timer is
+// running, so that the history is kept up to date between state changes. The
+// state itself has not changed, so nothing is published.
+func (t *timer) Tick(ctx context.Context, now time.Time, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
+	if !t.State_ {
+		return false, nil
+	}
+
+	now = now.UTC()
+	duration := now.Sub(t.StartTime)
+	t.Duration = &duration
+
+	return false, onchange("time", (t.TotalDuration + duration).Minutes(), now)
+}
+
 func (t *timer) State() bool {
 	return t.State_
 }
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/matryer/is"
 )
@@ -14,13 +15,66 @@ import (
 func TestTimer(t *testing.T) {
 	is := is.New(t)
 
-	tmr := New()
+	tmr := New(clock.New())
 	tmr.Handle(context.Background(), newState(true, "2023-02-07T21:32:59.682607Z"), func(string, float64, time.Time) error { return nil })
 	tmr.Handle(context.Background(), newState(false, "2023-02-07T23:32:59.682607Z"), func(string, float64, time.Time) error { return nil })
 
 	is.True(tmr.State() == false)
 }
 
+func TestTimerTracksTimeOverSeveralHours(t *testing.T) {
+	is := is.New(t)
+
+	start := time.Date(2023, 2, 7, 21, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+
+	logged := []float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		if prop == "time" {
+			logged = append(logged, v)
+		}
+		return nil
+	}
+
+	tmr := New(clk)
+	changed, err := tmr.Handle(context.Background(), newStateAt(true, clk.Now()), onchange)
+	is.NoErr(err)
+	is.True(changed)
+
+	for range 3 {
+		clk.Advance(1 * time.Hour)
+		changed, err = tmr.Tick(context.Background(), clk.Now(), onchange)
+		is.NoErr(err)
+		is.True(!changed) // ticks should only log the time, not change the state
+	}
+
+	d, ok := tmr.(*timer)
+	is.True(ok)
+	is.Equal(*d.Duration, 3*time.Hour) // but the duration of a running timer is kept up to date
+
+	clk.Advance(30 * time.Minute)
+	changed, _ = tmr.Handle(context.Background(), newStateAt(false, clk.Now()), onchange)
+	is.True(changed)
+
+	clk.Advance(2 * time.Hour)
+	changed, _ = tmr.Tick(context.Background(), clk.Now(), onchange)
+	is.True(!changed) // a stopped timer should not log anything
+
+	clk.Advance(1 * time.Hour)
+	tmr.Handle(context.Background(), newStateAt(true, clk.Now()), onchange)
+	clk.Advance(1 * time.Hour)
+	tmr.Tick(context.Background(), clk.Now(), onchange)
+
+	is.Equal(logged, []float64{0, 60, 120, 180, 210, 210, 270})
+}
+
+func newStateAt(on bool, ts time.Time) *events.MessageAccepted {
+	e := &events.MessageAccepted{}
+	json.Unmarshal(
+		fmt.Appendf(nil, timedMessageJSONFormat, ts.Unix(), on, ts.Format(time.RFC3339Nano)), e)
+	return e
+}
+
 func newState(on bool, timestamp string) *events.MessageAccepted {
 	e := &events.MessageAccepted{}
 	json.Unmarshal(
@@ -36,3 +90,11 @@ const messageJSONFormat string = `{
 	],
 	"timestamp":"%s"
 }`
+
+const timedMessageJSONFormat string = `{
+	"pack":[
+		{"bn":"testId/3200/","bt":%d,"n":"0","vs":"urn:oma:lwm2m:ext:3200"},
+		{"n":"5500","vb":%t}
+	],
+	"timestamp":"%s"
+}`
@@ -3,54 +3,165 @@ package functions
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/airquality"
+	"github.com/diwise/iot-core/internal/pkg/application/functions/buildings"
 	"github.com/diwise/iot-core/internal/pkg/application/functions/counters"
+	"github.com/diwise/iot-core/internal/pkg/application/functions/digitalinput"
 	"github.com/diwise/iot-core/internal/pkg/application/functions/levels"
+	"github.com/diwise/iot-core/internal/pkg/application/functions/presences"
 	"github.com/diwise/iot-core/internal/pkg/application/functions/stopwatch"
 	"github.com/diwise/iot-core/internal/pkg/application/functions/timers"
+	"github.com/diwise/iot-core/internal/pkg/application/functions/waterqualities"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/senml"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 
 	lwm2m "github.com/diwise/iot-agent/pkg/lwm2m"
 )
 
+// functionUpdated is the part of a function.updated message that is needed to
+// transform the function state into lwm2m objects
+type functionUpdated struct {
+	DeviceID  string    `json:"deviceID"`
+	Type      string    `json:"type"`
+	SubType   string    `json:"subType"`
+	Location  *location `json:"location,omitempty"`
+	Tenant    string    `json:"tenant"`
+	Timestamp time.Time `json:"timestamp"`
+
+	Counter *struct {
+		Count   int            `json:"count"`
+		Changes map[string]int `json:"changes"`
+	} `json:"counter,omitempty"`
+
+	Level *struct {
+		Current        float64    `json:"current"`
+		Percent        *float64   `json:"percent,omitempty"`
+		Offset         *float64   `json:"offset,omitempty"`
+		Rate           *float64   `json:"rate,omitempty"`
+		EstimatedFull  *time.Time `json:"estimatedFull,omitempty"`
+		EstimatedEmpty *time.Time `json:"estimatedEmpty,omitempty"`
+	} `json:"level,omitempty"`
+
+	Stopwatch *struct {
+		CumulativeTime time.Duration `json:"cumulativeTime"`
+		Count          int32         `json:"count"`
+		State          bool          `json:"state"`
+	} `json:"stopwatch,omitempty"`
+
+	Timer *struct {
+		TotalDuration time.Duration  `json:"totalDuration"`
+		Duration      *time.Duration `json:"duration,omitempty"`
+	} `json:"timer,omitempty"`
+
+	Presence *struct {
+		State bool `json:"state"`
+	} `json:"presence,omitempty"`
+
+	DigitalInput *struct {
+		State   bool `json:"state"`
+		Counter int  `json:"counter"`
+	} `json:"digitalInput,omitempty"`
+
+	// the types below report the quantities they lack as zero, and list the
+	// ones that are known in measured so that only those are transformed
+
+	WaterQuality *struct {
+		Temperature  float64  `json:"temperature"`
+		Conductivity *float64 `json:"conductivity,omitempty"`
+		Measured     measured `json:"measured,omitempty"`
+	} `json:"waterquality,omitempty"`
+
+	Building *struct {
+		Energy   float64  `json:"energy"`
+		Power    float64  `json:"power"`
+		Measured measured `json:"measured,omitempty"`
+	} `json:"building,omitempty"`
+
+	AirQuality *struct {
+		Particulates struct {
+			PM1  float64 `json:"pm1"`
+			PM10 float64 `json:"pm10"`
+			PM25 float64 `json:"pm25"`
+			NO   float64 `json:"no"`
+			NO2  float64 `json:"no2"`
+			CO2  float64 `json:"co2"`
+			O3   float64 `json:"o3"`
+			SO2  float64 `json:"so2"`
+			CO   float64 `json:"co"`
+			VOC  float64 `json:"voc"`
+		} `json:"particulates"`
+		Temperature float64  `json:"temperature"`
+		Humidity    *float64 `json:"humidity,omitempty"`
+		Measured    measured `json:"measured,omitempty"`
+	} `json:"airQuality,omitempty"`
+}
+
+// measured lists the quantities of a function that are known
+type measured []string
+
+// known reports whether the quantity is known. Updates that do not list the
+// measured quantities were published before they were listed, and all of their
+// quantities are treated as known.
+func (m measured) known(name string) bool {
+	return m == nil || slices.Contains(m, name)
+}
+
+// value returns a pointer to v if the quantity is known, and nil otherwise
+func (m measured) value(name string, v float64) *float64 {
+	if !m.known(name) {
+		return nil
+	}
+	return &v
+}
+
+// publisher publishes an lwm2m object, along with any extra records, as a
+// message.transformed
+type publisher func(obj lwm2m.Lwm2mObject, extra ...senml.Record) error
+
+// transformer publishes the state of an updated function as lwm2m objects
+type transformer func(ctx context.Context, f functionUpdated, pub publisher) error
+
+type transformerKey struct {
+	fnType  string
+	subType string
+}
+
+// transformers are keyed by function type and subtype. A transformer with an
+// empty subtype handles all functions of that type that lack a transformer
+// for their specific subtype.
+var transformers = map[transformerKey]transformer{
+	{counters.FunctionTypeName, "peoplecounter"}: transformPeopleCounter,
+	{levels.FunctionTypeName, ""}:                transformLevel,
+	{stopwatch.FunctionTypeName, ""}:             transformStopwatch,
+	{timers.FunctionTypeName, ""}:                transformTimer,
+	{presences.FunctionTypeName, ""}:             transformPresence,
+	{digitalinput.FunctionTypeName, ""}:          transformDigitalInput,
+	{waterqualities.FunctionTypeName, ""}:        transformWaterQuality,
+	{buildings.FunctionTypeName, ""}:             transformBuilding,
+	{airquality.FunctionTypeName, ""}:            transformAirQuality,
+}
+
+func findTransformer(fnType, subType string) (transformer, bool) {
+	if t, ok := transformers[transformerKey{fnType, subType}]; ok {
+		return t, true
+	}
+
+	t, ok := transformers[transformerKey{fnType, ""}]
+	return t, ok
+}
+
 func Transform(ctx context.Context, msgctx messaging.MsgContext, msg messaging.IncomingTopicMessage) error {
 	log := logging.GetFromContext(ctx)
 
-	f := struct {
-		DeviceID  string    `json:"deviceID"`
-		Type      string    `json:"type"`
-		SubType   string    `json:"subType"`
-		Location  *location `json:"location,omitempty"`
-		Tenant    string    `json:"tenant"`
-		Timestamp time.Time `json:"timestamp"`
-
-		Counter *struct {
-			Count   int            `json:"count"`
-			Changes map[string]int `json:"changes"`
-		} `json:"counter,omitempty"`
-
-		Level *struct {
-			Current float64  `json:"current"`
-			Percent *float64 `json:"percent,omitempty"`
-			Offset  *float64 `json:"offset,omitempty"`
-		} `json:"level,omitempty"`
-
-		Stopwatch *struct {
-			CumulativeTime time.Duration `json:"cumulativeTime"`
-			Count          int32         `json:"count"`
-			State          bool          `json:"state"`
-		} `json:"stopwatch,omitempty"`
-
-		Timer *struct {
-			TotalDuration time.Duration  `json:"totalDuration"`
-			Duration      *time.Duration `json:"duration,omitempty"`
-		} `json:"timer,omitempty"`
-	}{}
+	f := functionUpdated{}
 
 	err := json.Unmarshal(msg.Body(), &f)
 	if err != nil {
@@ -59,52 +170,178 @@ func Transform(ctx context.Context, msgctx messaging.MsgContext, msg messaging.I
 
 	log.Debug(fmt.Sprintf("transform function.updated of type %s and subType %s for deviceID %s", f.Type, f.SubType, f.DeviceID))
 
-	pub := func(obj lwm2m.Lwm2mObject, tenant string) error {
+	transform, ok := findTransformer(f.Type, f.SubType)
+	if !ok {
+		log.Debug("no function transformer found for function.updated message", slog.String("content_type", msg.ContentType()))
+		return nil
+	}
+
+	pub := func(obj lwm2m.Lwm2mObject, extra ...senml.Record) error {
 		log.Debug(fmt.Sprintf("pub transformed message, id: %s, urn: %s", obj.ID(), obj.ObjectURN()))
 
-		d := []events.EventDecoratorFunc{events.Tenant(tenant)}
+		d := []events.EventDecoratorFunc{events.Tenant(f.Tenant)}
 		if f.Location != nil {
 			d = append(d, events.Lat(f.Location.Latitude), events.Lon(f.Location.Longitude))
 		}
 
-		mt := events.NewMessageTransformed(lwm2m.ToPack(obj), d...)
+		pack := append(lwm2m.ToPack(obj), extra...)
+		mt := events.NewMessageTransformed(pack, d...)
 
 		return msgctx.PublishOnTopic(ctx, mt)
 	}
 
-	switch f.Type {
-	case counters.FunctionTypeName:
-		switch f.SubType {
-		case "peoplecounter":
-			peopleCounter := lwm2m.NewPeopleCounter(f.DeviceID, f.Counter.Count, f.Timestamp)
-			err = pub(peopleCounter, f.Tenant)
-		}
-	case levels.FunctionTypeName:
-		if f.Level.Percent == nil {
-			log.Debug("could not transform fillingLevel, percent is missing")
-			return nil
-		}
-		fillingLevel := lwm2m.NewFillingLevel(f.DeviceID, *f.Level.Percent, f.Timestamp)
-		l := int64(f.Level.Current)
-		fillingLevel.ActualFillingLevel = &l
-		err = pub(fillingLevel, f.Tenant)
-	case stopwatch.FunctionTypeName:
-		stopwatch := lwm2m.NewStopwatch(f.DeviceID, f.Stopwatch.CumulativeTime.Seconds(), f.Timestamp)
-		stopwatch.OnOff = &f.Stopwatch.State
-		stopwatch.DigitalInputCounter = f.Stopwatch.Count
-		err = pub(stopwatch, f.Tenant)
-	case timers.FunctionTypeName:
-		if f.Timer.Duration == nil {
-			log.Debug("could not transform timer, duration is missing")
-			return nil
-		}
-		timer := lwm2m.NewTimer(f.DeviceID, f.Timer.Duration.Seconds(), f.Timestamp)
-		cumulativeTime := f.Timer.TotalDuration.Seconds()
-		timer.CumulativeTime = &cumulativeTime
-		err = pub(timer, f.Tenant)
-	default:
-		log.Debug("no function transformer found for function.updated message", slog.String("content_type", msg.ContentType()))
+	return transform(ctx, f, pub)
+}
+
+func transformPeopleCounter(ctx context.Context, f functionUpdated, pub publisher) error {
+	if f.Counter == nil {
+		return nil
+	}
+	peopleCounter := lwm2m.NewPeopleCounter(f.DeviceID, f.Counter.Count, f.Timestamp)
+	return pub(peopleCounter)
+}
+
+func transformLevel(ctx context.Context, f functionUpdated, pub publisher) error {
+	if f.Level == nil || f.Level.Percent == nil {
+		logging.GetFromContext(ctx).Debug("could not transform fillingLevel, percent is missing")
+		return nil
+	}
+	fillingLevel := lwm2m.NewFillingLevel(f.DeviceID, *f.Level.Percent, f.Timestamp)
+	l := int64(f.Level.Current)
+	fillingLevel.ActualFillingLevel = &l
+	return pub(fillingLevel, fillingLevelForecast(f.Level.Rate, f.Level.EstimatedFull, f.Level.EstimatedEmpty)...)
+}
+
+func transformStopwatch(ctx context.Context, f functionUpdated, pub publisher) error {
+	if f.Stopwatch == nil {
+		return nil
+	}
+	stopwatch := lwm2m.NewStopwatch(f.DeviceID, f.Stopwatch.CumulativeTime.Seconds(), f.Timestamp)
+	stopwatch.OnOff = &f.Stopwatch.State
+	stopwatch.DigitalInputCounter = f.Stopwatch.Count
+	return pub(stopwatch)
+}
+
+func transformTimer(ctx context.Context, f functionUpdated, pub publisher) error {
+	if f.Timer == nil || f.Timer.Duration == nil {
+		logging.GetFromContext(ctx).Debug("could not transform timer, duration is missing")
+		return nil
+	}
+	timer := lwm2m.NewTimer(f.DeviceID, f.Timer.Duration.Seconds(), f.Timestamp)
+	cumulativeTime := f.Timer.TotalDuration.Seconds()
+	timer.CumulativeTime = &cumulativeTime
+	return pub(timer)
+}
+
+func transformPresence(ctx context.Context, f functionUpdated, pub publisher) error {
+	if f.Presence == nil {
+		return nil
+	}
+	return pub(lwm2m.NewPresence(f.DeviceID, f.Presence.State, f.Timestamp))
+}
+
+func transformDigitalInput(ctx context.Context, f functionUpdated, pub publisher) error {
+	if f.DigitalInput == nil {
+		return nil
+	}
+	digitalInput := lwm2m.NewDigitalInput(f.DeviceID, f.DigitalInput.State, f.Timestamp)
+	counter := int32(f.DigitalInput.Counter)
+	digitalInput.DigitalInputCounter = &counter
+	return pub(digitalInput)
+}
+
+func transformWaterQuality(ctx context.Context, f functionUpdated, pub publisher) error {
+	if f.WaterQuality == nil {
+		return nil
+	}
+
+	errs := []error{}
+
+	if f.WaterQuality.Measured.known(waterqualities.Temperature) {
+		errs = append(errs, pub(lwm2m.NewTemperature(f.DeviceID, f.WaterQuality.Temperature, f.Timestamp)))
+	}
+
+	if f.WaterQuality.Conductivity != nil {
+		errs = append(errs, pub(lwm2m.NewConductivity(f.DeviceID, *f.WaterQuality.Conductivity, f.Timestamp)))
+	}
+
+	return errors.Join(errs...)
+}
+
+func transformBuilding(ctx context.Context, f functionUpdated, pub publisher) error {
+	if f.Building == nil {
+		return nil
+	}
+
+	// the building keeps power in kW and energy in kWh, while the lwm2m objects
+	// use the same units as the sensors it is fed by (W and J)
+	errs := []error{}
+
+	if f.Building.Measured.known("power") {
+		errs = append(errs, pub(lwm2m.NewPower(f.DeviceID, f.Building.Power*1000.0, f.Timestamp)))
+	}
+
+	if f.Building.Measured.known("energy") {
+		errs = append(errs, pub(lwm2m.NewEnergy(f.DeviceID, f.Building.Energy*3600000.0, f.Timestamp)))
+	}
+
+	return errors.Join(errs...)
+}
+
+func transformAirQuality(ctx context.Context, f functionUpdated, pub publisher) error {
+	if f.AirQuality == nil {
+		return nil
+	}
+
+	p := f.AirQuality.Particulates
+	m := f.AirQuality.Measured
+
+	airQuality := lwm2m.NewAirQuality(f.DeviceID, f.Timestamp)
+	airQuality.PM1 = m.value(airquality.PM1, p.PM1)
+	airQuality.PM10 = m.value(airquality.PM10, p.PM10)
+	airQuality.PM25 = m.value(airquality.PM25, p.PM25)
+	airQuality.NO = m.value(airquality.NO, p.NO)
+	airQuality.NO2 = m.value(airquality.NO2, p.NO2)
+	airQuality.CO2 = m.value(airquality.CO2, p.CO2)
+	airQuality.O3 = m.value(airquality.O3, p.O3)
+	airQuality.SO2 = m.value(airquality.SO2, p.SO2)
+	airQuality.CO = m.value(airquality.CO, p.CO)
+	airQuality.VOC = m.value(airquality.VOC, p.VOC)
+	airQuality.Temperature = m.value("temperature", f.AirQuality.Temperature)
+	airQuality.Humidity = f.AirQuality.Humidity
+
+	return pub(airQuality)
+}
+
+// fillingLevelForecast returns the records for the average fill speed and the
+// forecasted full and empty dates of a filling level object, as far as they
+// are known. The rate of the level function is in meters per hour, while the
+// filling level object defines the average fill speed in cm per day.
+func fillingLevelForecast(rate *float64, estimatedFull, estimatedEmpty *time.Time) []senml.Record {
+	const (
+		AverageFillSpeed  string = "8"
+		ForecastFullDate  string = "9"
+		ForecastEmptyDate string = "10"
+
+		UnitCentimeterPerDay string = "cm/d"
+	)
+
+	records := []senml.Record{}
+
+	if rate != nil {
+		speed := *rate * 100 * 24
+		records = append(records, senml.Record{Name: AverageFillSpeed, Unit: UnitCentimeterPerDay, Value: &speed})
+	}
+
+	if estimatedFull != nil {
+		full := float64(estimatedFull.Unix())
+		records = append(records, senml.Record{Name: ForecastFullDate, Value: &full})
+	}
+
+	if estimatedEmpty != nil {
+		empty := float64(estimatedEmpty.Unix())
+		records = append(records, senml.Record{Name: ForecastEmptyDate, Value: &empty})
 	}
 
-	return err
+	return records
 }
@@ -0,0 +1,116 @@
+package functions
+
+import (
+	"testing"
+
+	"github.com/diwise/iot-core/pkg/lwm2m"
+	"github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/senml"
+)
+
+func TestTransformFunctionTypes(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		urns  []string
+		value float64
+	}{
+		{"presence", `{"type":"presence","presence":{"state":true}}`, []string{lwm2m.Presence}, 0},
+		{"digitalinput", `{"type":"digitalinput","digitalInput":{"state":true,"counter":3}}`, []string{lwm2m.DigitalInput}, 0},
+		{"waterquality", `{"type":"waterquality","waterquality":{"temperature":12.5}}`, []string{lwm2m.Temperature}, 12.5},
+		{"waterquality without temperature", `{"type":"waterquality","waterquality":{"temperature":0,"conductivity":120,"measured":["conductivity"]}}`, []string{lwm2m.Conductivity}, 120},
+		{"building", `{"type":"building","building":{"energy":2,"power":1.5,"measured":["energy","power"]}}`, []string{lwm2m.Power, lwm2m.Energy}, 1500},
+		{"building without energy", `{"type":"building","building":{"energy":0,"power":1.5,"measured":["power"]}}`, []string{lwm2m.Power}, 1500},
+		{"building without power", `{"type":"building","building":{"energy":2,"power":0,"measured":["energy"]}}`, []string{lwm2m.Energy}, 7200000},
+		{"building without measured", `{"type":"building","building":{"energy":2,"power":1.5}}`, []string{lwm2m.Power, lwm2m.Energy}, 1500},
+		{"airquality", `{"type":"airquality","airQuality":{"particulates":{"pm10":21},"temperature":4}}`, []string{lwm2m.AirQuality}, 0},
+		{"peoplecounter", `{"type":"counter","subType":"peoplecounter","counter":{"count":7}}`, []string{"urn:oma:lwm2m:ext:3434"}, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			is, ctx, msgctx := testSetup(t)
+
+			err := Transform(ctx, msgctx, newFunctionUpdated(tc.body))
+			is.NoErr(err)
+
+			calls := msgctx.PublishOnTopicCalls()
+			is.Equal(len(calls), len(tc.urns))
+
+			for i, urn := range tc.urns {
+				mt := calls[i].Message.(*events.MessageTransformed)
+				is.Equal(events.GetObjectURN(mt.Pack()), urn)
+			}
+
+			if tc.value != 0 {
+				v, ok := calls[0].Message.(*events.MessageTransformed).Pack().GetValue(senml.FindByName("5700"))
+				is.True(ok)
+				is.Equal(v, tc.value)
+			}
+		})
+	}
+}
+
+func TestTransformOnlyMeasuredPollutants(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	err := Transform(ctx, msgctx, newFunctionUpdated(`{"type":"airquality","airQuality":{"particulates":{"pm1":0,"pm10":21,"pm25":0,"no":0,"no2":12,"co2":0,"o3":0,"so2":0,"co":0,"voc":0},"temperature":0,"measured":["pm10","no2"]}}`))
+	is.NoErr(err)
+
+	pack := msgctx.PublishOnTopicCalls()[0].Message.(*events.MessageTransformed).Pack()
+
+	for _, measured := range []string{"1", "15"} {
+		_, ok := pack.GetValue(senml.FindByName(measured))
+		is.True(ok) // pm10 and no2 should be published
+	}
+
+	for _, unmeasured := range []string{"3", "5", "7", "9", "11", "17", "19", "21", "5700", "23"} {
+		_, ok := pack.GetValue(senml.FindByName(unmeasured))
+		is.True(!ok) // pollutants and temperature that are not measured should be left out
+	}
+}
+
+func TestTransformLevelForecast(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	err := Transform(ctx, msgctx, newFunctionUpdated(`{"type":"level","level":{"current":1,"percent":50,"rate":0.01,"estimatedFull":"2023-02-07T21:00:00Z"}}`))
+	is.NoErr(err)
+
+	pack := msgctx.PublishOnTopicCalls()[0].Message.(*events.MessageTransformed).Pack()
+
+	speed, ok := pack.GetRecord(senml.FindByName("8"))
+	is.True(ok)
+	is.Equal(speed.Unit, "cm/d") // the average fill speed of a filling level is in cm per day
+	is.Equal(*speed.Value, 24.0) // 0.01 m/h
+
+	full, ok := pack.GetValue(senml.FindByName("9"))
+	is.True(ok)
+	is.Equal(full, 1675803600.0)
+
+	_, ok = pack.GetValue(senml.FindByName("10"))
+	is.True(!ok) // the level is not draining
+}
+
+func TestTransformUnknownFunctionTypeIsIgnored(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	err := Transform(ctx, msgctx, newFunctionUpdated(`{"type":"nosuchtype","nosuchtype":{"value":7}}`))
+	is.NoErr(err)
+	is.Equal(len(msgctx.PublishOnTopicCalls()), 0)
+}
+
+func TestTransformSubtypeWithoutTransformerIsIgnored(t *testing.T) {
+	is, ctx, msgctx := testSetup(t)
+
+	err := Transform(ctx, msgctx, newFunctionUpdated(`{"type":"counter","subType":"doorcounter","counter":{"count":7}}`))
+	is.NoErr(err)
+	is.Equal(len(msgctx.PublishOnTopicCalls()), 0)
+}
+
+func newFunctionUpdated(body string) messaging.IncomingTopicMessage {
+	return &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(body) },
+		ContentTypeFunc: func() string { return "application/vnd.diwise.function.updated+json" },
+	}
+}
@@ -0,0 +1,18 @@
+package functions
+
+// Function types register their factories when their packages are imported,
+// so a new function type only needs to be imported here to become available.
+import (
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/airquality"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/buildings"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/composites"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/counters"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/digitalinput"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/formulas"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/levels"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/presences"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/stopwatch"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/thresholds"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/timers"
+	_ "github.com/diwise/iot-core/internal/pkg/application/functions/waterqualities"
+)
@@ -2,10 +2,16 @@ package waterqualities
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/diwise/iot-core/internal/pkg/application/functions/factories"
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
 	"github.com/diwise/iot-core/pkg/lwm2m"
 	"github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/senml"
@@ -15,47 +21,334 @@ const (
 	FunctionTypeName string = "waterquality"
 )
 
+const (
+	Temperature     string = "temperature"
+	Conductivity    string = "conductivity"
+	PH              string = "ph"
+	DissolvedOxygen string = "dissolvedOxygen"
+	Turbidity       string = "turbidity"
+	Bathing         string = "bathing"
+)
+
+func init() {
+	factories.Register(factories.FunctionFactory{
+		Type:                FunctionTypeName,
+		JSONKey:             "waterquality",
+		DefaultHistoryLabel: "temperature",
+		Args:                args(),
+		New: func(env factories.Env) (factories.State, error) {
+			return New(env.Args, env.Clock)
+		},
+	})
+}
+
 type WaterQuality interface {
 	Handle(context.Context, *events.MessageAccepted, func(string, float64, time.Time) error) (bool, error)
+	Value(quantity string) (float64, bool)
+	Suitable() (bool, bool)
+}
+
+// quantity describes how a measured quantity is read from its source and when
+// a change is large enough to be logged with the quantity name as label. A
+// quantity without an urn is not read at all.
+type quantity struct {
+	name      string
+	urn       string
+	decimals  int
+	threshold float64
+	min, max  *float64
+}
+
+// args returns the settings of each quantity, such as "ph.min"
+func args() []factories.Arg {
+	a := []factories.Arg{}
+	for _, q := range defaultQuantities() {
+		a = append(a,
+			factories.Arg{Name: q.name + ".urn"},
+			factories.Arg{Name: q.name + ".decimals", Kind: factories.Integer},
+			factories.Arg{Name: q.name + ".threshold", Kind: factories.Number},
+			factories.Arg{Name: q.name + ".min", Kind: factories.Number},
+			factories.Arg{Name: q.name + ".max", Kind: factories.Number},
+		)
+	}
+	return a
+}
+
+func defaultQuantities() []*quantity {
+	return []*quantity{
+		{name: Temperature, urn: lwm2m.Temperature, decimals: 1, threshold: 0.001},
+		{name: Conductivity, urn: lwm2m.Conductivity, decimals: 0, threshold: 0.001},
+		{name: PH, urn: lwm2m.Acidity, decimals: 2, threshold: 0.001},
+		{name: DissolvedOxygen, decimals: 1, threshold: 0.001},
+		{name: Turbidity, decimals: 1, threshold: 0.001},
+	}
 }
 
-func New() WaterQuality {
-	return &waterquality{}
+// New creates a water quality function. Temperature, conductivity and pH are
+// read from the sensor value of their respective lwm2m objects, which may be
+// reported by different sensors bound to the same function. Dissolved oxygen
+// and turbidity have no objects of their own, but are measured by generic
+// objects such as concentration (3325) and generic sensor (3300) that are used
+// for other quantities as well, so they are only read when their source object
+// is configured, such as "turbidity.urn=urn:oma:lwm2m:ext:3300".
+//
+// Each quantity can be configured using its name as prefix, such as
+// "ph.decimals=1" for the rounding, "ph.threshold=0.1" for the smallest change
+// that is logged, "ph.urn=urn:oma:lwm2m:ext:3326" for the source object and
+// "ph.min=6,ph.max=9" for the limits of what is suitable for bathing. When
+// any limits are configured, the water is flagged as suitable for bathing when
+// all quantities with limits are known and within them.
+func New(config string, clk clock.Clock) (WaterQuality, error) {
+	wq := &waterquality{
+		quantities: defaultQuantities(),
+		timestamps: map[string]time.Time{},
+		logged:     map[string]float64{},
+		clock:      clk,
+	}
+
+	config = strings.ReplaceAll(config, " ", "")
+
+	for s := range strings.SplitSeq(config, ",") {
+		pair := strings.Split(s, "=")
+		if len(pair) != 2 {
+			continue
+		}
+
+		name, setting, ok := strings.Cut(pair[0], ".")
+		if !ok {
+			continue
+		}
+
+		q := wq.quantity(name)
+		if q == nil {
+			return nil, fmt.Errorf("unknown water quality quantity in config \"%s\"", s)
+		}
+
+		var err error
+
+		if setting == "urn" {
+			q.urn = pair[1]
+		} else if setting == "decimals" {
+			q.decimals, err = strconv.Atoi(pair[1])
+			if err == nil && q.decimals < 0 {
+				err = fmt.Errorf("number of decimals must not be negative")
+			}
+		} else if setting == "threshold" {
+			q.threshold, err = strconv.ParseFloat(pair[1], 64)
+			if err == nil && q.threshold < 0 {
+				err = fmt.Errorf("threshold must not be negative")
+			}
+		} else if setting == "min" || setting == "max" {
+			var limit float64
+			limit, err = strconv.ParseFloat(pair[1], 64)
+			if setting == "min" {
+				q.min = &limit
+			} else {
+				q.max = &limit
+			}
+			wq.limited = true
+		} else {
+			err = fmt.Errorf("unknown setting %s", setting)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse water quality config \"%s\": %w", s, err)
+		}
+	}
+
+	// limits on a quantity that is never read would make the water unsuitable forever
+	for _, q := range wq.quantities {
+		if q.urn == "" && (q.min != nil || q.max != nil) {
+			return nil, fmt.Errorf("water quality limits for %s require %s.urn to be set", q.name, q.name)
+		}
+	}
+
+	return wq, nil
 }
 
 type waterquality struct {
-	Temperature float64   `json:"temperature"`
-	Timestamp   time.Time `json:"timestamp"`
+	Temperature     float64   `json:"temperature"`
+	Conductivity    *float64  `json:"conductivity,omitempty"`
+	PH              *float64  `json:"ph,omitempty"`
+	DissolvedOxygen *float64  `json:"dissolvedOxygen,omitempty"`
+	Turbidity       *float64  `json:"turbidity,omitempty"`
+	Bathing         *bool     `json:"bathing,omitempty"`
+	Timestamp       time.Time `json:"timestamp"`
+
+	// Measured lists the quantities that have been read, since the
+	// temperature is reported as zero until it is
+	Measured []string `json:"measured,omitempty"`
+
+	quantities []*quantity
+	limited    bool
+
+	// timestamps and logged values per quantity, to handle several sensors
+	// that report at different times
+	timestamps map[string]time.Time
+	logged     map[string]float64
+
+	clock clock.Clock
+}
+
+func (wq *waterquality) quantity(name string) *quantity {
+	for _, q := range wq.quantities {
+		if q.name == name {
+			return q
+		}
+	}
+	return nil
+}
+
+func (wq *waterquality) Value(name string) (float64, bool) {
+	if name == Temperature {
+		// states saved before the measured quantities were listed lack them
+		return wq.Temperature, slices.Contains(wq.Measured, Temperature) || wq.Temperature != 0
+	}
+
+	if v := wq.value(name); v != nil && *v != nil {
+		return **v, true
+	}
+
+	return 0, false
+}
+
+func (wq *waterquality) Suitable() (bool, bool) {
+	if wq.Bathing == nil {
+		return false, false
+	}
+	return *wq.Bathing, true
+}
+
+func (wq *waterquality) value(name string) **float64 {
+	switch name {
+	case Conductivity:
+		return &wq.Conductivity
+	case PH:
+		return &wq.PH
+	case DissolvedOxygen:
+		return &wq.DissolvedOxygen
+	case Turbidity:
+		return &wq.Turbidity
+	}
+	return nil
 }
 
 func (wq *waterquality) Handle(ctx context.Context, e *events.MessageAccepted, onchange func(prop string, value float64, ts time.Time) error) (bool, error) {
-	if !events.Matches(e, lwm2m.Temperature) {
+	var q *quantity
+	for _, candidate := range wq.quantities {
+		if candidate.urn != "" && events.Matches(e, candidate.urn) {
+			q = candidate
+			break
+		}
+	}
+
+	if q == nil {
 		return false, events.ErrNoMatch
 	}
 
 	const SensorValue string = "5700"
 
-	r, tempOk := e.Pack().GetRecord(senml.FindByName(SensorValue))
+	r, valueOk := e.Pack().GetRecord(senml.FindByName(SensorValue))
 	ts, timeOk := e.Pack().GetTime(senml.FindByName(SensorValue))
 
-	if ts.After(time.Now().Add(5 * time.Second)) {
+	if ts.After(wq.clock.Now().Add(5 * time.Second)) {
 		return false, fmt.Errorf("invalid timestamp %s in waterquality pack: %w", ts.Format(time.RFC3339), events.ErrBadTimestamp)
 	}
 
-	if tempOk && timeOk && r.Value != nil && ts.After(wq.Timestamp) {
-		temp := math.Round(*r.Value*10) / 10
-		oldTemp := wq.Temperature
+	if !valueOk || !timeOk || r.Value == nil {
+		return false, nil
+	}
+
+	previousTs, ok := wq.timestamps[q.name]
+	if !ok && q.name == Temperature {
+		previousTs = wq.Timestamp
+	}
+
+	if !ts.After(previousTs) {
+		return false, nil
+	}
+
+	scale := math.Pow(10, float64(q.decimals))
+	v := math.Round(*r.Value*scale) / scale
+
+	previous, known := wq.Value(q.name)
+	wq.set(q.name, v)
 
-		wq.Temperature = temp
+	wq.timestamps[q.name] = ts
+	if ts.After(wq.Timestamp) {
 		wq.Timestamp = ts
+	}
+
+	// the logged values are forgotten when the function is restored, so the
+	// threshold is then compared to the last known value instead
+	if lastLogged, ok := wq.logged[q.name]; ok {
+		previous = lastLogged
+	}
 
-		if hasChanged(oldTemp, temp) {
-			err := onchange("temperature", temp, ts)
-			return true, err
+	changed := false
+	errs := []error{}
+
+	if !known || (hasChanged(previous, v) && math.Abs(v-previous) >= q.threshold) {
+		wq.logged[q.name] = v
+		errs = append(errs, onchange(q.name, v, ts))
+		changed = true
+	}
+
+	if wq.updateBathing() {
+		errs = append(errs, onchange(Bathing, boolToFloat(*wq.Bathing), ts))
+		changed = true
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+func (wq *waterquality) set(name string, v float64) {
+	if !slices.Contains(wq.Measured, name) {
+		wq.Measured = append(wq.Measured, name)
+	}
+
+	if name == Temperature {
+		wq.Temperature = v
+		return
+	}
+
+	*wq.value(name) = &v
+}
+
+// updateBathing checks the known values against the configured limits and
+// returns true if the suitability for bathing changed
+func (wq *waterquality) updateBathing() bool {
+	if !wq.limited {
+		return false
+	}
+
+	suitable := true
+
+	for _, q := range wq.quantities {
+		if q.min == nil && q.max == nil {
+			continue
+		}
+
+		v, ok := wq.Value(q.name)
+		if !ok || (q.min != nil && v < *q.min) || (q.max != nil && v > *q.max) {
+			suitable = false
+			break
 		}
 	}
 
-	return false, nil
+	if wq.Bathing != nil && *wq.Bathing == suitable {
+		return false
+	}
+
+	wq.Bathing = &suitable
+	return true
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 func hasChanged(previousLevel, newLevel float64) bool {
@@ -0,0 +1,148 @@
+package waterqualities
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/infrastructure/clock"
+	"github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/matryer/is"
+)
+
+func TestWaterQualityFromSeveralSensors(t *testing.T) {
+	is := is.New(t)
+
+	wq, err := New("conductivity.threshold=10,ph.decimals=1", clock.New())
+	is.NoErr(err)
+
+	logged := map[string][]float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		logged[prop] = append(logged[prop], v)
+		return nil
+	}
+
+	handle := func(sensor, objectID string, v float64, timestamp string) bool {
+		changed, err := wq.Handle(context.Background(), newValue(sensor, objectID, v, timestamp), onchange)
+		is.NoErr(err)
+		return changed
+	}
+
+	is.True(handle("temp", "3303", 12.34, "2023-06-05T11:00:00Z"))
+	is.True(handle("cond", "3327", 250, "2023-06-05T10:59:00Z")) // older than the temperature, but from another sensor
+	is.True(handle("ph", "3326", 7.26, "2023-06-05T11:01:00Z"))
+	is.True(!handle("cond", "3327", 255, "2023-06-05T11:02:00Z")) // below the threshold
+	is.True(handle("cond", "3327", 261, "2023-06-05T11:03:00Z"))
+	is.True(!handle("ph", "3326", 7.3, "2023-06-05T11:00:30Z")) // out of order
+
+	is.Equal(logged, map[string][]float64{
+		Temperature:  {12.3},
+		Conductivity: {250, 261},
+		PH:           {7.3},
+	})
+
+	v, ok := wq.Value(PH)
+	is.True(ok)
+	is.Equal(v, 7.3)
+
+	_, ok = wq.Value(Turbidity)
+	is.True(!ok)
+
+	_, ok = wq.Suitable()
+	is.True(!ok) // no limits are configured
+
+	_, err = wq.Handle(context.Background(), newValue("other", "3330", 1, "2023-06-05T11:04:00Z"), onchange)
+	is.Equal(err, events.ErrNoMatch)
+}
+
+func TestWaterQualitySuitableForBathing(t *testing.T) {
+	is := is.New(t)
+
+	wq, err := New("temperature.min=16,ph.min=6,ph.max=9", clock.New())
+	is.NoErr(err)
+
+	bathing := []float64{}
+	onchange := func(prop string, v float64, ts time.Time) error {
+		if prop == Bathing {
+			bathing = append(bathing, v)
+		}
+		return nil
+	}
+
+	wq.Handle(context.Background(), newValue("temp", "3303", 18, "2023-06-05T11:00:00Z"), onchange)
+	suitable, ok := wq.Suitable()
+	is.True(ok)
+	is.True(!suitable) // the ph is still unknown
+
+	wq.Handle(context.Background(), newValue("ph", "3326", 7, "2023-06-05T11:01:00Z"), onchange)
+	suitable, _ = wq.Suitable()
+	is.True(suitable)
+
+	wq.Handle(context.Background(), newValue("temp", "3303", 15.5, "2023-06-05T12:00:00Z"), onchange)
+	suitable, _ = wq.Suitable()
+	is.True(!suitable)
+
+	is.Equal(bathing, []float64{0, 1, 0})
+
+	b, _ := json.Marshal(wq)
+	is.Equal(string(b), `{"temperature":15.5,"ph":7,"bathing":false,"timestamp":"2023-06-05T12:00:00Z","measured":["temperature","ph"]}`)
+}
+
+func TestWaterQualityConfig(t *testing.T) {
+	is := is.New(t)
+
+	_, err := New("salinity.min=3", clock.New())
+	is.True(err != nil)
+
+	_, err = New("ph.decimals=-1", clock.New())
+	is.True(err != nil)
+
+	_, err = New("turbidity.max=5", clock.New())
+	is.True(err != nil) // turbidity is not read unless its source is configured
+
+	_, err = New("turbidity.urn=urn:oma:lwm2m:ext:3300,turbidity.max=5", clock.New())
+	is.NoErr(err)
+}
+
+func TestWaterQualityGenericObjectsAreOptIn(t *testing.T) {
+	is := is.New(t)
+
+	onchange := func(string, float64, time.Time) error { return nil }
+
+	wq, _ := New("", clock.New())
+	_, err := wq.Handle(context.Background(), newValue("generic", "3300", 4.2, "2023-06-05T11:00:00Z"), onchange)
+	is.Equal(err, events.ErrNoMatch) // a generic sensor may measure anything
+	_, err = wq.Handle(context.Background(), newValue("concentration", "3325", 8.1, "2023-06-05T11:00:00Z"), onchange)
+	is.Equal(err, events.ErrNoMatch)
+
+	wq, _ = New("turbidity.urn=urn:oma:lwm2m:ext:3300,dissolvedOxygen.urn=urn:oma:lwm2m:ext:3325", clock.New())
+	wq.Handle(context.Background(), newValue("generic", "3300", 4.2, "2023-06-05T11:00:00Z"), onchange)
+	wq.Handle(context.Background(), newValue("concentration", "3325", 8.1, "2023-06-05T11:00:00Z"), onchange)
+
+	v, ok := wq.Value(Turbidity)
+	is.True(ok)
+	is.Equal(v, 4.2)
+
+	v, ok = wq.Value(DissolvedOxygen)
+	is.True(ok)
+	is.Equal(v, 8.1)
+}
+
+func newValue(sensor, objectID string, v float64, timestamp string) *events.MessageAccepted {
+	ts, _ := time.Parse(time.RFC3339, timestamp)
+
+	e := &events.MessageAccepted{}
+	json.Unmarshal(
+		fmt.Appendf(nil, messageJSONFormat, sensor, objectID, ts.Unix(), objectID, v, timestamp), e)
+	return e
+}
+
+const messageJSONFormat string = `{
+	"pack":[
+		{"bn":"%s/%s/","bt":%d,"n":"0","vs":"urn:oma:lwm2m:ext:%s"},
+		{"n":"5700","v":%f}
+	],
+	"timestamp":"%s"
+}`
@@ -2,9 +2,9 @@ package application
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"sync"
 
 	"github.com/diwise/iot-core/internal/pkg/application/decorators"
 	"github.com/diwise/iot-core/internal/pkg/application/functions"
@@ -18,20 +18,27 @@ import (
 type App interface {
 	MessageAccepted(ctx context.Context, evt events.MessageAccepted, msgctx messaging.MsgContext) error
 	MessageReceived(ctx context.Context, msg events.MessageReceived) (*events.MessageAccepted, error)
+
+	Shutdown(ctx context.Context) error
 }
 
 type app struct {
 	client             client.DeviceManagementClient
 	measurementsClient measurements.MeasurementsClient
 	fnctRegistry       functions.Registry
-	mu                 sync.Mutex
+	dispatcher         *dispatcher
 }
 
 func New(client client.DeviceManagementClient, measurementsClient measurements.MeasurementsClient, functionRegistry functions.Registry) App {
+	return newApp(client, measurementsClient, functionRegistry, defaultWorkerCount)
+}
+
+func newApp(client client.DeviceManagementClient, measurementsClient measurements.MeasurementsClient, functionRegistry functions.Registry, workerCount int) *app {
 	return &app{
 		client:             client,
 		fnctRegistry:       functionRegistry,
 		measurementsClient: measurementsClient,
+		dispatcher:         newDispatcher(workerCount, defaultQueueSize),
 	}
 }
 
@@ -40,10 +47,30 @@ func (a *app) MessageAccepted(ctx context.Context, evt events.MessageAccepted, m
 		return evt.Error()
 	}
 
-	logger := logging.GetFromContext(ctx)
+	// messages from the same sensor are handled in order, one at a time, while
+	// messages from other sensors are handled in parallel by other workers
+	err := a.dispatcher.dispatch(ctx, evt.DeviceID(), func() error {
+		return a.handleMessageAccepted(ctx, evt, msgctx)
+	})
+	if errors.Is(err, errDispatcherClosed) {
+		// the message has already been acked and would be lost if it was
+		// dropped, so once the workers have been shut down it is handled by
+		// the caller instead
+		return a.handleMessageAccepted(ctx, evt, msgctx)
+	}
 
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	return err
+}
+
+// Shutdown stops dispatching messages to the workers and waits for the messages
+// that are being handled to finish, or for the context to be cancelled. Messages
+// that arrive after Shutdown are handled by the caller of MessageAccepted.
+func (a *app) Shutdown(ctx context.Context) error {
+	return a.dispatcher.close(ctx)
+}
+
+func (a *app) handleMessageAccepted(ctx context.Context, evt events.MessageAccepted, msgctx messaging.MsgContext) error {
+	logger := logging.GetFromContext(ctx)
 
 	matchingFunctions, _ := a.fnctRegistry.Find(ctx, functions.MatchSensor(evt.DeviceID()))
 	matchingCount := len(matchingFunctions)
@@ -55,13 +82,17 @@ func (a *app) MessageAccepted(ctx context.Context, evt events.MessageAccepted, m
 
 	logger.Debug("found matching functions", "count", matchingCount)
 
+	// a sensor may feed several functions, so a failing function should not
+	// prevent the message from reaching the others
+	var errs []error
+
 	for _, f := range matchingFunctions {
 		if err := f.Handle(ctx, &evt, msgctx); err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("function %s failed to handle message: %w", f.ID(), err))
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 var ErrCouldNotFindDevice = fmt.Errorf("could not find device")
@@ -0,0 +1,292 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-core/internal/pkg/application/functions"
+	"github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/senml"
+	"github.com/matryer/is"
+)
+
+func TestMessagesFromSameSensorAreHandledInOrder(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	const count int = 50
+
+	f := newBlockingFunction("fid1", count)
+	a := newTestApp(t, f, defaultWorkerCount)
+
+	results := make(chan error, count)
+	accept := func(v float64) {
+		results <- a.MessageAccepted(ctx, newMessageAccepted("sensor1", v), nil)
+	}
+
+	go accept(0)
+	is.Equal(receive(t, f.started), 0.0) // the worker is now busy with the first message
+
+	// queue the rest of the messages from concurrent callers, one at a time so
+	// that the order in which they are queued is known
+	queue := a.dispatcher.queues[a.dispatcher.worker("sensor1")]
+	for i := 1; i < count; i++ {
+		go accept(float64(i))
+		waitUntil(t, func() bool { return len(queue) == i })
+	}
+
+	close(f.release)
+
+	for range count {
+		is.NoErr(<-results)
+	}
+
+	is.Equal(len(f.values), count)
+	for i, v := range f.values {
+		is.Equal(v, float64(i)) // messages should be handled in the order they were queued
+	}
+	is.Equal(f.maxConcurrent.Load(), int32(1)) // and one at a time
+}
+
+func TestMessagesFromDifferentSensorsAreHandledInParallel(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	f := newBlockingFunction("fid1", 4)
+	a := newTestApp(t, f, defaultWorkerCount)
+
+	// pick sensor ids that are handled by different workers
+	sensors := []string{}
+	workers := map[int]bool{}
+	for i := 0; len(sensors) < 4; i++ {
+		id := fmt.Sprintf("sensor%d", i)
+		if w := a.dispatcher.worker(id); !workers[w] {
+			workers[w] = true
+			sensors = append(sensors, id)
+		}
+	}
+
+	results := make(chan error, len(sensors))
+	for _, id := range sensors {
+		go func() {
+			results <- a.MessageAccepted(ctx, newMessageAccepted(id, 1.0), nil)
+		}()
+	}
+
+	// every message should be handled while none of them has finished
+	for range sensors {
+		receive(t, f.started)
+	}
+	is.Equal(f.concurrent.Load(), int32(len(sensors)))
+
+	close(f.release)
+
+	for range sensors {
+		is.NoErr(<-results)
+	}
+
+	is.Equal(len(f.values), len(sensors))
+}
+
+func TestShutdownWaitsForMessagesBeingHandled(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	f := newBlockingFunction("fid1", 1)
+	a := newTestApp(t, f, defaultWorkerCount)
+
+	handled := make(chan error, 1)
+	go func() {
+		handled <- a.MessageAccepted(ctx, newMessageAccepted("sensor1", 1.0), nil)
+	}()
+
+	receive(t, f.started)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- a.Shutdown(ctx)
+	}()
+
+	waitUntil(t, func() bool {
+		a.dispatcher.mu.RLock()
+		defer a.dispatcher.mu.RUnlock()
+		return a.dispatcher.closed
+	})
+
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned while a message was being handled")
+	default:
+	}
+
+	close(f.release)
+
+	is.NoErr(<-shutdown)
+	is.Equal(len(f.values), 1) // the message should have been handled before shutdown returns
+	is.NoErr(<-handled)
+
+	err := a.MessageAccepted(ctx, newMessageAccepted("sensor1", 2.0), nil)
+	is.NoErr(err)
+	is.Equal(len(f.values), 2) // a message that arrives after shutdown should still be handled
+}
+
+func TestShutdownStopsTheWorkers(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	a := newApp(nil, nil, &fakeRegistry{f: &fakeFunction{id: "fid1"}}, defaultWorkerCount)
+	is.NoErr(a.MessageAccepted(ctx, newMessageAccepted("sensor1", 1.0), nil))
+
+	is.NoErr(a.Shutdown(ctx))
+
+	for _, queue := range a.dispatcher.queues {
+		_, open := <-queue
+		is.True(!open) // the queues should be closed once the work is done
+	}
+
+	is.NoErr(a.Shutdown(ctx)) // and shutting down again should be harmless
+}
+
+// BenchmarkMessageAccepted compares handling messages from many sensors on a
+// single worker, which is equivalent to the previous global lock, with
+// handling them on the default number of workers. The functions simulate a
+// slow database insert.
+func BenchmarkMessageAccepted(b *testing.B) {
+	for _, workerCount := range []int{1, defaultWorkerCount} {
+		b.Run(fmt.Sprintf("workers=%d", workerCount), func(b *testing.B) {
+			ctx := context.Background()
+
+			f := &fakeFunction{id: "fid1", delay: 500 * time.Microsecond}
+			a := newTestApp(b, f, workerCount)
+
+			var n atomic.Int64
+
+			b.SetParallelism(defaultWorkerCount)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					sensorID := fmt.Sprintf("sensor%d", n.Add(1)%100)
+					_ = a.MessageAccepted(ctx, newMessageAccepted(sensorID, 1.0), nil)
+				}
+			})
+		})
+	}
+}
+
+// newTestApp returns an app that is shut down when the test is done, so that
+// its workers do not outlive the test
+func newTestApp(tb testing.TB, f functions.Function, workerCount int) *app {
+	a := newApp(nil, nil, &fakeRegistry{f: f}, workerCount)
+	tb.Cleanup(func() { a.Shutdown(context.Background()) })
+	return a
+}
+
+func newMessageAccepted(sensorID string, value float64) events.MessageAccepted {
+	pack := senml.Pack{
+		{BaseName: sensorID + "/3303/", Name: "0", StringValue: "urn:oma:lwm2m:ext:3303"},
+		{Name: "5700", Value: &value},
+	}
+	return *events.NewMessageAccepted(pack)
+}
+
+type fakeRegistry struct {
+	functions.Registry
+	f functions.Function
+}
+
+func (r *fakeRegistry) Find(ctx context.Context, matchers ...functions.RegistryMatcherFunc) ([]functions.Function, error) {
+	return []functions.Function{r.f}, nil
+}
+
+type fakeFunction struct {
+	functions.Function
+	id    string
+	delay time.Duration
+
+	// started receives the value of each message as it starts to be handled,
+	// and the handling is then blocked until release is closed
+	started chan float64
+	release chan struct{}
+
+	mu            sync.Mutex
+	values        []float64
+	concurrent    atomic.Int32
+	maxConcurrent atomic.Int32
+}
+
+func (f *fakeFunction) ID() string {
+	return f.id
+}
+
+func (f *fakeFunction) Handle(ctx context.Context, e *events.MessageAccepted, msgctx messaging.MsgContext) error {
+	n := f.concurrent.Add(1)
+	defer f.concurrent.Add(-1)
+
+	for {
+		m := f.maxConcurrent.Load()
+		if n <= m || f.maxConcurrent.CompareAndSwap(m, n) {
+			break
+		}
+	}
+
+	v, _ := e.Pack().GetValue(senml.FindByName("5700"))
+
+	if f.started != nil {
+		f.started <- v
+		<-f.release
+	}
+
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	f.values = append(f.values, v)
+	f.mu.Unlock()
+
+	return nil
+}
+
+// newBlockingFunction returns a function that blocks the handling of messages
+// until its release channel is closed. At most n messages can be started
+// without being received from its started channel.
+func newBlockingFunction(id string, n int) *fakeFunction {
+	return &fakeFunction{
+		id:      id,
+		started: make(chan float64, n),
+		release: make(chan struct{}),
+	}
+}
+
+// receive returns the next value from ch, or fails the test if there is none
+// within a generous timeout rather than blocking forever
+func receive(t *testing.T, ch chan float64) float64 {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message to be handled")
+		return 0
+	}
+}
+
+// waitUntil waits for the condition to become true, or fails the test if it
+// does not within a generous timeout
+func waitUntil(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,127 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock that only moves when told to, intended for tests
+type Fake struct {
+	now     time.Time
+	tickers []*fakeTicker
+	mu      sync.Mutex
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *Fake) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTicker{
+		c:        make(chan time.Time),
+		interval: d,
+		next:     c.now.Add(d),
+		done:     make(chan struct{}),
+	}
+	c.tickers = append(c.tickers, t)
+
+	return t
+}
+
+// Advance moves the clock forward by d and fires all tickers that are due,
+// in order. Each tick is delivered before the clock moves on, so Advance
+// blocks until every due tick has been received or the ticker is stopped.
+func (c *Fake) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+
+		var next *fakeTicker
+		for _, t := range c.tickers {
+			if !t.stopped() && !t.next.After(end) && (next == nil || t.next.Before(next.next)) {
+				next = t
+			}
+		}
+
+		if next == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+
+		c.now = next.next
+		now := c.now
+		next.next = next.next.Add(next.interval)
+
+		c.mu.Unlock()
+
+		next.send(now)
+	}
+}
+
+// BlockUntilTickers blocks until at least n tickers that have not been
+// stopped have been created, so that tests can wait for background workers
+// to start before advancing the clock.
+func (c *Fake) BlockUntilTickers(n int) {
+	for {
+		c.mu.Lock()
+		active := 0
+		for _, t := range c.tickers {
+			if !t.stopped() {
+				active++
+			}
+		}
+		c.mu.Unlock()
+
+		if active >= n {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type fakeTicker struct {
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.once.Do(func() { close(t.done) })
+}
+
+func (t *fakeTicker) stopped() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *fakeTicker) send(now time.Time) {
+	select {
+	case t.c <- now:
+	case <-t.done:
+	}
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/diwise/service-chassis/pkg/infrastructure/env"
@@ -15,7 +16,16 @@ type Storage interface {
 	Initialize(context.Context) error
 	Add(ctx context.Context, id, label string, value float64, timestamp time.Time) error
 	AddFnct(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error
+	SaveFnct(ctx context.Context, f Fnct) error
+	DeleteFnct(ctx context.Context, id string) error
+	ResetFnct(ctx context.Context, id string) error
+	Fncts(ctx context.Context) ([]Fnct, error)
+	SaveState(ctx context.Context, id string, state []byte, timestamp time.Time) error
+	States(ctx context.Context) (map[string][]byte, error)
 	History(ctx context.Context, id, label string, lastN int) ([]LogValue, error)
+	QueryHistory(ctx context.Context, id string, q HistoryQuery) (HistoryResult, error)
+
+	Close()
 }
 
 type impl struct {
@@ -27,6 +37,69 @@ type LogValue struct {
 	Timestamp time.Time `json:"ts"`
 }
 
+const (
+	TimeRelBefore  string = "before"
+	TimeRelAfter   string = "after"
+	TimeRelBetween string = "between"
+)
+
+var aggregates = map[string]string{
+	"avg":   "avg(value)",
+	"min":   "min(value)",
+	"max":   "max(value)",
+	"sum":   "sum(value)",
+	"count": "count(value)::DOUBLE PRECISION",
+	"first": "first(value, time)",
+	"last":  "last(value, time)",
+}
+
+// IsSupportedAggregate reports whether aggr can be used as Aggregate in a HistoryQuery.
+func IsSupportedAggregate(aggr string) bool {
+	_, ok := aggregates[aggr]
+	return ok
+}
+
+// HistoryQuery selects logged values for a label within a time window. The
+// semantics of TimeRel follow NGSI-LD temporal queries, i.e. "before" and
+// "after" are exclusive of TimeAt and "between" is inclusive of TimeAt and
+// exclusive of EndTimeAt. Values are returned in chronological order, but with
+// "before" the offset counts back from TimeAt, so that the first page holds the
+// values closest to TimeAt.
+//
+// If Aggregate is set the values are grouped into buckets of Interval using
+// time_bucket and each returned LogValue holds the aggregated value of a
+// bucket, timestamped with the start of the bucket.
+type HistoryQuery struct {
+	Label     string
+	TimeRel   string
+	TimeAt    time.Time
+	EndTimeAt time.Time
+	Aggregate string
+	Interval  time.Duration
+	Offset    int
+	Limit     int
+}
+
+type HistoryResult struct {
+	Values     []LogValue
+	Offset     int
+	Limit      int
+	TotalCount int64
+}
+
+// Fnct holds the configuration of a function that has been created or
+// reconfigured at runtime and needs to be restored after a restart.
+type Fnct struct {
+	ID       string
+	Name     string
+	Type     string
+	SubType  string
+	SensorID string
+	Tenant   string
+	OnUpdate bool
+	Args     string
+}
+
 type Config struct {
 	host     string
 	user     string
@@ -97,6 +170,11 @@ func (i *impl) createTables(ctx context.Context) error {
 			longitude NUMERIC(7, 5)
 	  	);
 
+		ALTER TABLE fnct ADD COLUMN IF NOT EXISTS name TEXT NULL;
+		ALTER TABLE fnct ADD COLUMN IF NOT EXISTS sensor_id TEXT NULL;
+		ALTER TABLE fnct ADD COLUMN IF NOT EXISTS onupdate BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE fnct ADD COLUMN IF NOT EXISTS args TEXT NULL;
+
 		CREATE TABLE IF NOT EXISTS fnct_history (
 			row_id 	bigserial,
 			time 	TIMESTAMPTZ NOT NULL,
@@ -106,7 +184,14 @@ func (i *impl) createTables(ctx context.Context) error {
 			FOREIGN KEY (fnct_id) REFERENCES fnct (id)
 	  	);
 
-		CREATE INDEX IF NOT EXISTS fnct_history_fnct_id_label_idx ON fnct_history (fnct_id, label);`
+		CREATE INDEX IF NOT EXISTS fnct_history_fnct_id_label_idx ON fnct_history (fnct_id, label);
+
+		CREATE TABLE IF NOT EXISTS fnct_state (
+			fnct_id TEXT PRIMARY KEY NOT NULL,
+			time 	TIMESTAMPTZ NOT NULL,
+			state 	JSONB NOT NULL,
+			FOREIGN KEY (fnct_id) REFERENCES fnct (id)
+		);`
 
 	tx, err := i.db.Begin(ctx)
 	if err != nil {
@@ -145,6 +230,11 @@ func (i *impl) createTables(ctx context.Context) error {
 	return nil
 }
 
+// Close closes all connections to the database
+func (i *impl) Close() {
+	i.db.Close()
+}
+
 func (i *impl) AddFnct(ctx context.Context, id, fnType, subType, tenant, source string, lat, lon float64) error {
 	_, err := i.db.Exec(ctx, `
 		INSERT INTO fnct(id,type,sub_type,tenant,source,latitude,longitude) VALUES ($1,$2,$3,$4,$5,$6,$7) ON CONFLICT (id) DO NOTHING;
@@ -153,6 +243,108 @@ func (i *impl) AddFnct(ctx context.Context, id, fnType, subType, tenant, source
 	return err
 }
 
+func (i *impl) SaveFnct(ctx context.Context, f Fnct) error {
+	_, err := i.db.Exec(ctx, `
+		INSERT INTO fnct(id,type,sub_type,tenant,name,sensor_id,onupdate,args) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+		ON CONFLICT (id) DO UPDATE SET type=EXCLUDED.type, sub_type=EXCLUDED.sub_type, tenant=EXCLUDED.tenant, name=EXCLUDED.name, sensor_id=EXCLUDED.sensor_id, onupdate=EXCLUDED.onupdate, args=EXCLUDED.args;
+	`, f.ID, f.Type, f.SubType, f.Tenant, f.Name, f.SensorID, f.OnUpdate, f.Args)
+
+	return err
+}
+
+func (i *impl) DeleteFnct(ctx context.Context, id string) error {
+	tx, err := i.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM fnct_history WHERE fnct_id=$1;`, id)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM fnct_state WHERE fnct_id=$1;`, id)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM fnct WHERE id=$1;`, id)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ResetFnct clears the runtime configuration of a function, so that it is no
+// longer restored after a restart, while its history and state are kept
+func (i *impl) ResetFnct(ctx context.Context, id string) error {
+	_, err := i.db.Exec(ctx, `
+		UPDATE fnct SET name=NULL, sensor_id=NULL, onupdate=FALSE, args=NULL WHERE id=$1;
+	`, id)
+
+	return err
+}
+
+func (i *impl) Fncts(ctx context.Context) ([]Fnct, error) {
+	rows, err := i.db.Query(ctx, `
+		SELECT id, type, sub_type, tenant, COALESCE(name, ''), sensor_id, onupdate, COALESCE(args, '')
+		FROM fnct
+		WHERE sensor_id IS NOT NULL
+		ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fncts := make([]Fnct, 0)
+
+	for rows.Next() {
+		var f Fnct
+		err := rows.Scan(&f.ID, &f.Type, &f.SubType, &f.Tenant, &f.Name, &f.SensorID, &f.OnUpdate, &f.Args)
+		if err != nil {
+			return nil, err
+		}
+		fncts = append(fncts, f)
+	}
+
+	return fncts, rows.Err()
+}
+
+func (i *impl) SaveState(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+	_, err := i.db.Exec(ctx, `
+		INSERT INTO fnct_state (fnct_id, time, state) VALUES ($1, $2, $3)
+		ON CONFLICT (fnct_id) DO UPDATE SET time=EXCLUDED.time, state=EXCLUDED.state;
+	`, id, timestamp, state)
+
+	return err
+}
+
+func (i *impl) States(ctx context.Context) (map[string][]byte, error) {
+	rows, err := i.db.Query(ctx, `SELECT fnct_id, state FROM fnct_state`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string][]byte)
+
+	for rows.Next() {
+		var id string
+		var state []byte
+		err := rows.Scan(&id, &state)
+		if err != nil {
+			return nil, err
+		}
+		states[id] = state
+	}
+
+	return states, rows.Err()
+}
+
 func (i *impl) Add(ctx context.Context, id, label string, value float64, timestamp time.Time) error {
 	_, err := i.db.Exec(ctx, `
 		INSERT INTO fnct_history (time, fnct_id, label, value) VALUES ($1, $2, $3, $4);
@@ -190,3 +382,100 @@ func (i *impl) History(ctx context.Context, id, label string, lastN int) ([]LogV
 
 	return logValues, nil
 }
+
+func (i *impl) QueryHistory(ctx context.Context, id string, q HistoryQuery) (HistoryResult, error) {
+	count, query, args, err := historyStatements(id, q)
+	if err != nil {
+		return HistoryResult{}, err
+	}
+
+	var total int64
+	err = i.db.QueryRow(ctx, count, args...).Scan(&total)
+	if err != nil {
+		return HistoryResult{}, err
+	}
+
+	n := len(args)
+	rows, err := i.db.Query(ctx, fmt.Sprintf(`%s OFFSET $%d LIMIT $%d`, query, n+1, n+2), append(args, q.Offset, q.Limit)...)
+	if err != nil {
+		return HistoryResult{}, err
+	}
+	defer rows.Close()
+
+	logValues := make([]LogValue, 0)
+
+	for rows.Next() {
+		var t time.Time
+		var v float64
+		err := rows.Scan(&t, &v)
+		if err != nil {
+			return HistoryResult{}, err
+		}
+		logValues = append(logValues, LogValue{Timestamp: t, Value: v})
+	}
+
+	if rows.Err() != nil {
+		return HistoryResult{}, rows.Err()
+	}
+
+	// values before TimeAt are selected latest first, so that a page holds the
+	// values closest to TimeAt, but are returned in chronological order
+	if q.TimeRel == TimeRelBefore {
+		slices.Reverse(logValues)
+	}
+
+	return HistoryResult{
+		Values:     logValues,
+		Offset:     q.Offset,
+		Limit:      q.Limit,
+		TotalCount: total,
+	}, nil
+}
+
+// historyStatements returns the statements that count and select the values, or
+// buckets, that match the query along with their arguments
+func historyStatements(id string, q HistoryQuery) (string, string, []any, error) {
+	where := "fnct_id=$1 AND label=$2"
+	args := []any{id, q.Label}
+
+	switch q.TimeRel {
+	case TimeRelBefore:
+		where += " AND time < $3"
+		args = append(args, q.TimeAt)
+	case TimeRelAfter:
+		where += " AND time > $3"
+		args = append(args, q.TimeAt)
+	case TimeRelBetween:
+		where += " AND time >= $3 AND time < $4"
+		args = append(args, q.TimeAt, q.EndTimeAt)
+	default:
+		return "", "", nil, fmt.Errorf("unsupported time relation %q", q.TimeRel)
+	}
+
+	// pages of values before TimeAt start at TimeAt and go back in time
+	order := "ASC"
+	if q.TimeRel == TimeRelBefore {
+		order = "DESC"
+	}
+
+	count := `SELECT COUNT(*) FROM fnct_history WHERE ` + where
+	query := fmt.Sprintf(`SELECT time, value FROM fnct_history WHERE %s ORDER BY time %s, row_id %s`, where, order, order)
+
+	if q.Aggregate != "" {
+		aggr, ok := aggregates[q.Aggregate]
+		if !ok {
+			return "", "", nil, fmt.Errorf("unsupported aggregate %q", q.Aggregate)
+		}
+		if q.Interval <= 0 {
+			return "", "", nil, fmt.Errorf("an interval is required when aggregating history")
+		}
+
+		args = append(args, fmt.Sprintf("%d microseconds", q.Interval.Microseconds()))
+		bucket := fmt.Sprintf("time_bucket($%d::INTERVAL, time)", len(args))
+
+		count = fmt.Sprintf(`SELECT COUNT(DISTINCT %s) FROM fnct_history WHERE %s`, bucket, where)
+		query = fmt.Sprintf(`SELECT %s AS bucket, %s FROM fnct_history WHERE %s GROUP BY bucket ORDER BY bucket %s`, bucket, aggr, where, order)
+	}
+
+	return count, query, args, nil
+}
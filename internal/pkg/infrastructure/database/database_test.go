@@ -2,6 +2,7 @@ package database
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 )
@@ -37,6 +38,99 @@ func TestSQL(t *testing.T) {
 	if !(len(logValues) >= 2) {
 		t.Fail()
 	}
+
+	result, err := s.QueryHistory(ctx, "fnct-01", HistoryQuery{
+		Label:   "temperature",
+		TimeRel: TimeRelAfter,
+		TimeAt:  time.Now().UTC().Add(-1 * time.Hour),
+		Limit:   1,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(result.Values) != 1 || result.TotalCount < 2 {
+		t.Fail()
+	}
+
+	result, err = s.QueryHistory(ctx, "fnct-01", HistoryQuery{
+		Label:     "temperature",
+		TimeRel:   TimeRelAfter,
+		TimeAt:    time.Now().UTC().Add(-1 * time.Hour),
+		Aggregate: "max",
+		Interval:  24 * time.Hour,
+		Limit:     10,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(result.Values) == 0 || result.Values[len(result.Values)-1].Value < 45.0 {
+		t.Fail()
+	}
+
+	result, err = s.QueryHistory(ctx, "fnct-01", HistoryQuery{
+		Label:   "temperature",
+		TimeRel: TimeRelBefore,
+		TimeAt:  time.Now().UTC().Add(time.Minute),
+		Limit:   2,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	// the latest values before timeAt, in chronological order
+	if len(result.Values) != 2 || result.Values[1].Value != 45.0 || result.Values[0].Timestamp.After(result.Values[1].Timestamp) {
+		t.Fail()
+	}
+
+	err = s.SaveFnct(ctx, Fnct{ID: "fnct-01", Type: "waterquality", SubType: "beach", SensorID: "sensor-01"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = s.ResetFnct(ctx, "fnct-01")
+	if err != nil {
+		t.Error(err)
+	}
+
+	fncts, err := s.Fncts(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, f := range fncts {
+		if f.ID == "fnct-01" {
+			t.Errorf("a reset function should not be restored as a runtime function")
+		}
+	}
+
+	// the history is kept when the runtime configuration is reset
+	err = s.Add(ctx, "fnct-01", "temperature", 46.0, time.Now().UTC().Add(10*time.Second))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHistoryBeforeIsSelectedLatestFirst(t *testing.T) {
+	q := HistoryQuery{Label: "temperature", TimeRel: TimeRelBefore, TimeAt: time.Now()}
+
+	_, query, _, err := historyStatements("fnct-01", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(query, "ORDER BY time DESC, row_id DESC") {
+		t.Errorf("values before timeAt should be selected latest first, got %q", query)
+	}
+
+	q.TimeRel = TimeRelAfter
+	_, query, _, _ = historyStatements("fnct-01", q)
+	if !strings.HasSuffix(query, "ORDER BY time ASC, row_id ASC") {
+		t.Errorf("values after timeAt should be selected earliest first, got %q", query)
+	}
+
+	q.TimeRel = TimeRelBefore
+	q.Aggregate, q.Interval = "avg", time.Hour
+	_, query, _, _ = historyStatements("fnct-01", q)
+	if !strings.HasSuffix(query, "ORDER BY bucket DESC") {
+		t.Errorf("buckets before timeAt should be selected latest first, got %q", query)
+	}
 }
 
 func testSetup() (Storage, context.Context, error) {
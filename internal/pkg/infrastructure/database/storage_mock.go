@@ -25,12 +25,36 @@ var _ Storage = &StorageMock{}
 //			AddFnFunc: func(ctx context.Context, id string, fnType string, subType string, tenant string, source string, lat float64, lon float64) error {
 //				panic("mock out the AddFn method")
 //			},
+//			CloseFunc: func()  {
+//				panic("mock out the Close method")
+//			},
+//			DeleteFnctFunc: func(ctx context.Context, id string) error {
+//				panic("mock out the DeleteFnct method")
+//			},
+//			FnctsFunc: func(ctx context.Context) ([]Fnct, error) {
+//				panic("mock out the Fncts method")
+//			},
 //			HistoryFunc: func(ctx context.Context, id string, label string, lastN int) ([]LogValue, error) {
 //				panic("mock out the History method")
 //			},
 //			InitializeFunc: func(contextMoqParam context.Context) error {
 //				panic("mock out the Initialize method")
 //			},
+//			QueryHistoryFunc: func(ctx context.Context, id string, q HistoryQuery) (HistoryResult, error) {
+//				panic("mock out the QueryHistory method")
+//			},
+//			ResetFnctFunc: func(ctx context.Context, id string) error {
+//				panic("mock out the ResetFnct method")
+//			},
+//			SaveFnctFunc: func(ctx context.Context, f Fnct) error {
+//				panic("mock out the SaveFnct method")
+//			},
+//			SaveStateFunc: func(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+//				panic("mock out the SaveState method")
+//			},
+//			StatesFunc: func(ctx context.Context) (map[string][]byte, error) {
+//				panic("mock out the States method")
+//			},
 //		}
 //
 //		// use mockedStorage in code that requires Storage
@@ -44,12 +68,36 @@ type StorageMock struct {
 	// AddFnFunc mocks the AddFn method.
 	AddFnFunc func(ctx context.Context, id string, fnType string, subType string, tenant string, source string, lat float64, lon float64) error
 
+	// CloseFunc mocks the Close method.
+	CloseFunc func()
+
+	// DeleteFnctFunc mocks the DeleteFnct method.
+	DeleteFnctFunc func(ctx context.Context, id string) error
+
+	// FnctsFunc mocks the Fncts method.
+	FnctsFunc func(ctx context.Context) ([]Fnct, error)
+
 	// HistoryFunc mocks the History method.
 	HistoryFunc func(ctx context.Context, id string, label string, lastN int) ([]LogValue, error)
 
 	// InitializeFunc mocks the Initialize method.
 	InitializeFunc func(contextMoqParam context.Context) error
 
+	// QueryHistoryFunc mocks the QueryHistory method.
+	QueryHistoryFunc func(ctx context.Context, id string, q HistoryQuery) (HistoryResult, error)
+
+	// ResetFnctFunc mocks the ResetFnct method.
+	ResetFnctFunc func(ctx context.Context, id string) error
+
+	// SaveFnctFunc mocks the SaveFnct method.
+	SaveFnctFunc func(ctx context.Context, f Fnct) error
+
+	// SaveStateFunc mocks the SaveState method.
+	SaveStateFunc func(ctx context.Context, id string, state []byte, timestamp time.Time) error
+
+	// StatesFunc mocks the States method.
+	StatesFunc func(ctx context.Context) (map[string][]byte, error)
+
 	// calls tracks calls to the methods.
 	calls struct {
 		// Add holds details about calls to the Add method.
@@ -84,6 +132,21 @@ type StorageMock struct {
 			// Lon is the lon argument value.
 			Lon float64
 		}
+		// Close holds details about calls to the Close method.
+		Close []struct {
+		}
+		// DeleteFnct holds details about calls to the DeleteFnct method.
+		DeleteFnct []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+		}
+		// Fncts holds details about calls to the Fncts method.
+		Fncts []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
 		// History holds details about calls to the History method.
 		History []struct {
 			// Ctx is the ctx argument value.
@@ -100,11 +163,58 @@ type StorageMock struct {
 			// ContextMoqParam is the contextMoqParam argument value.
 			ContextMoqParam context.Context
 		}
+		// QueryHistory holds details about calls to the QueryHistory method.
+		QueryHistory []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+			// Q is the q argument value.
+			Q HistoryQuery
+		}
+		// ResetFnct holds details about calls to the ResetFnct method.
+		ResetFnct []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+		}
+		// SaveFnct holds details about calls to the SaveFnct method.
+		SaveFnct []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// F is the f argument value.
+			F Fnct
+		}
+		// SaveState holds details about calls to the SaveState method.
+		SaveState []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+			// State is the state argument value.
+			State []byte
+			// Timestamp is the timestamp argument value.
+			Timestamp time.Time
+		}
+		// States holds details about calls to the States method.
+		States []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
 	}
-	lockAdd        sync.RWMutex
-	lockAddFn      sync.RWMutex
-	lockHistory    sync.RWMutex
-	lockInitialize sync.RWMutex
+	lockAdd          sync.RWMutex
+	lockAddFn        sync.RWMutex
+	lockClose        sync.RWMutex
+	lockDeleteFnct   sync.RWMutex
+	lockFncts        sync.RWMutex
+	lockHistory      sync.RWMutex
+	lockInitialize   sync.RWMutex
+	lockQueryHistory sync.RWMutex
+	lockResetFnct    sync.RWMutex
+	lockSaveFnct     sync.RWMutex
+	lockSaveState    sync.RWMutex
+	lockStates       sync.RWMutex
 }
 
 // Add calls AddFunc.
@@ -215,6 +325,101 @@ func (mock *StorageMock) AddFnCalls() []struct {
 	return calls
 }
 
+// Close calls CloseFunc.
+func (mock *StorageMock) Close() {
+	if mock.CloseFunc == nil {
+		panic("StorageMock.CloseFunc: method is nil but Storage.Close was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockClose.Lock()
+	mock.calls.Close = append(mock.calls.Close, callInfo)
+	mock.lockClose.Unlock()
+	mock.CloseFunc()
+}
+
+// CloseCalls gets all the calls that were made to Close.
+// Check the length with:
+//
+//	len(mockedStorage.CloseCalls())
+func (mock *StorageMock) CloseCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockClose.RLock()
+	calls = mock.calls.Close
+	mock.lockClose.RUnlock()
+	return calls
+}
+
+// DeleteFnct calls DeleteFnctFunc.
+func (mock *StorageMock) DeleteFnct(ctx context.Context, id string) error {
+	if mock.DeleteFnctFunc == nil {
+		panic("StorageMock.DeleteFnctFunc: method is nil but Storage.DeleteFnct was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		ID  string
+	}{
+		Ctx: ctx,
+		ID:  id,
+	}
+	mock.lockDeleteFnct.Lock()
+	mock.calls.DeleteFnct = append(mock.calls.DeleteFnct, callInfo)
+	mock.lockDeleteFnct.Unlock()
+	return mock.DeleteFnctFunc(ctx, id)
+}
+
+// DeleteFnctCalls gets all the calls that were made to DeleteFnct.
+// Check the length with:
+//
+//	len(mockedStorage.DeleteFnctCalls())
+func (mock *StorageMock) DeleteFnctCalls() []struct {
+	Ctx context.Context
+	ID  string
+} {
+	var calls []struct {
+		Ctx context.Context
+		ID  string
+	}
+	mock.lockDeleteFnct.RLock()
+	calls = mock.calls.DeleteFnct
+	mock.lockDeleteFnct.RUnlock()
+	return calls
+}
+
+// Fncts calls FnctsFunc.
+func (mock *StorageMock) Fncts(ctx context.Context) ([]Fnct, error) {
+	if mock.FnctsFunc == nil {
+		panic("StorageMock.FnctsFunc: method is nil but Storage.Fncts was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockFncts.Lock()
+	mock.calls.Fncts = append(mock.calls.Fncts, callInfo)
+	mock.lockFncts.Unlock()
+	return mock.FnctsFunc(ctx)
+}
+
+// FnctsCalls gets all the calls that were made to Fncts.
+// Check the length with:
+//
+//	len(mockedStorage.FnctsCalls())
+func (mock *StorageMock) FnctsCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockFncts.RLock()
+	calls = mock.calls.Fncts
+	mock.lockFncts.RUnlock()
+	return calls
+}
+
 // History calls HistoryFunc.
 func (mock *StorageMock) History(ctx context.Context, id string, label string, lastN int) ([]LogValue, error) {
 	if mock.HistoryFunc == nil {
@@ -290,3 +495,191 @@ func (mock *StorageMock) InitializeCalls() []struct {
 	mock.lockInitialize.RUnlock()
 	return calls
 }
+
+// QueryHistory calls QueryHistoryFunc.
+func (mock *StorageMock) QueryHistory(ctx context.Context, id string, q HistoryQuery) (HistoryResult, error) {
+	if mock.QueryHistoryFunc == nil {
+		panic("StorageMock.QueryHistoryFunc: method is nil but Storage.QueryHistory was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		ID  string
+		Q   HistoryQuery
+	}{
+		Ctx: ctx,
+		ID:  id,
+		Q:   q,
+	}
+	mock.lockQueryHistory.Lock()
+	mock.calls.QueryHistory = append(mock.calls.QueryHistory, callInfo)
+	mock.lockQueryHistory.Unlock()
+	return mock.QueryHistoryFunc(ctx, id, q)
+}
+
+// QueryHistoryCalls gets all the calls that were made to QueryHistory.
+// Check the length with:
+//
+//	len(mockedStorage.QueryHistoryCalls())
+func (mock *StorageMock) QueryHistoryCalls() []struct {
+	Ctx context.Context
+	ID  string
+	Q   HistoryQuery
+} {
+	var calls []struct {
+		Ctx context.Context
+		ID  string
+		Q   HistoryQuery
+	}
+	mock.lockQueryHistory.RLock()
+	calls = mock.calls.QueryHistory
+	mock.lockQueryHistory.RUnlock()
+	return calls
+}
+
+// ResetFnct calls ResetFnctFunc.
+func (mock *StorageMock) ResetFnct(ctx context.Context, id string) error {
+	if mock.ResetFnctFunc == nil {
+		panic("StorageMock.ResetFnctFunc: method is nil but Storage.ResetFnct was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		ID  string
+	}{
+		Ctx: ctx,
+		ID:  id,
+	}
+	mock.lockResetFnct.Lock()
+	mock.calls.ResetFnct = append(mock.calls.ResetFnct, callInfo)
+	mock.lockResetFnct.Unlock()
+	return mock.ResetFnctFunc(ctx, id)
+}
+
+// ResetFnctCalls gets all the calls that were made to ResetFnct.
+// Check the length with:
+//
+//	len(mockedStorage.ResetFnctCalls())
+func (mock *StorageMock) ResetFnctCalls() []struct {
+	Ctx context.Context
+	ID  string
+} {
+	var calls []struct {
+		Ctx context.Context
+		ID  string
+	}
+	mock.lockResetFnct.RLock()
+	calls = mock.calls.ResetFnct
+	mock.lockResetFnct.RUnlock()
+	return calls
+}
+
+// SaveFnct calls SaveFnctFunc.
+func (mock *StorageMock) SaveFnct(ctx context.Context, f Fnct) error {
+	if mock.SaveFnctFunc == nil {
+		panic("StorageMock.SaveFnctFunc: method is nil but Storage.SaveFnct was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		F   Fnct
+	}{
+		Ctx: ctx,
+		F:   f,
+	}
+	mock.lockSaveFnct.Lock()
+	mock.calls.SaveFnct = append(mock.calls.SaveFnct, callInfo)
+	mock.lockSaveFnct.Unlock()
+	return mock.SaveFnctFunc(ctx, f)
+}
+
+// SaveFnctCalls gets all the calls that were made to SaveFnct.
+// Check the length with:
+//
+//	len(mockedStorage.SaveFnctCalls())
+func (mock *StorageMock) SaveFnctCalls() []struct {
+	Ctx context.Context
+	F   Fnct
+} {
+	var calls []struct {
+		Ctx context.Context
+		F   Fnct
+	}
+	mock.lockSaveFnct.RLock()
+	calls = mock.calls.SaveFnct
+	mock.lockSaveFnct.RUnlock()
+	return calls
+}
+
+// SaveState calls SaveStateFunc.
+func (mock *StorageMock) SaveState(ctx context.Context, id string, state []byte, timestamp time.Time) error {
+	if mock.SaveStateFunc == nil {
+		panic("StorageMock.SaveStateFunc: method is nil but Storage.SaveState was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		ID        string
+		State     []byte
+		Timestamp time.Time
+	}{
+		Ctx:       ctx,
+		ID:        id,
+		State:     state,
+		Timestamp: timestamp,
+	}
+	mock.lockSaveState.Lock()
+	mock.calls.SaveState = append(mock.calls.SaveState, callInfo)
+	mock.lockSaveState.Unlock()
+	return mock.SaveStateFunc(ctx, id, state, timestamp)
+}
+
+// SaveStateCalls gets all the calls that were made to SaveState.
+// Check the length with:
+//
+//	len(mockedStorage.SaveStateCalls())
+func (mock *StorageMock) SaveStateCalls() []struct {
+	Ctx       context.Context
+	ID        string
+	State     []byte
+	Timestamp time.Time
+} {
+	var calls []struct {
+		Ctx       context.Context
+		ID        string
+		State     []byte
+		Timestamp time.Time
+	}
+	mock.lockSaveState.RLock()
+	calls = mock.calls.SaveState
+	mock.lockSaveState.RUnlock()
+	return calls
+}
+
+// States calls StatesFunc.
+func (mock *StorageMock) States(ctx context.Context) (map[string][]byte, error) {
+	if mock.StatesFunc == nil {
+		panic("StorageMock.StatesFunc: method is nil but Storage.States was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockStates.Lock()
+	mock.calls.States = append(mock.calls.States, callInfo)
+	mock.lockStates.Unlock()
+	return mock.StatesFunc(ctx)
+}
+
+// StatesCalls gets all the calls that were made to States.
+// Check the length with:
+//
+//	len(mockedStorage.StatesCalls())
+func (mock *StorageMock) StatesCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockStates.RLock()
+	calls = mock.calls.States
+	mock.lockStates.RUnlock()
+	return calls
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/diwise/iot-core/internal/pkg/application/functions"
+	"github.com/diwise/iot-device-mgmt/pkg/client"
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/cors"
 )
@@ -13,7 +14,7 @@ type API interface {
 	Router() *chi.Mux
 }
 
-func New(ctx context.Context, registry functions.Registry) API {
+func New(ctx context.Context, registry functions.Registry, devices client.DeviceManagementClient, authenticator func(http.Handler) http.Handler) API {
 	api_ := &api{
 		router: chi.NewRouter(),
 	}
@@ -24,9 +25,16 @@ func New(ctx context.Context, registry functions.Registry) API {
 		Debug:            false,
 	}).Handler)
 
-	// TODO: Introduce an authenticator to manage tenant access
-	api_.router.Get("/api/functions", NewQueryFunctionsHandler(ctx, registry))
-	api_.router.Get("/api/functions/{id}/history", NewQueryFunctionHistoryHandler(ctx, registry))
+	api_.router.Group(func(r chi.Router) {
+		r.Use(authenticator)
+
+		r.Get("/api/functions", NewQueryFunctionsHandler(ctx, registry))
+		r.Get("/api/functions/{id}/history", NewQueryFunctionHistoryHandler(ctx, registry))
+		r.Post("/api/functions", NewCreateFunctionHandler(ctx, registry, devices))
+		r.Put("/api/functions/{id}", NewUpdateFunctionHandler(ctx, registry, devices))
+		r.Patch("/api/functions/{id}", NewPatchFunctionHandler(ctx, registry, devices))
+		r.Delete("/api/functions/{id}", NewDeleteFunctionHandler(ctx, registry))
+	})
 
 	api_.router.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+// KeySource verifies the signature of a raw JWT and returns its payload
+type KeySource interface {
+	VerifySignature(ctx context.Context, jwt string) ([]byte, error)
+}
+
+// NewRemoteKeySource returns a KeySource that fetches (and caches) the signing
+// keys from a JSON Web Key Set hosted at the given URL
+func NewRemoteKeySource(ctx context.Context, jwksURL string) KeySource {
+	return oidc.NewRemoteKeySet(ctx, jwksURL)
+}
+
+// NewFileKeySource returns a KeySource that uses the signing keys found in a
+// local JSON Web Key Set file
+func NewFileKeySource(path string) (KeySource, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key set from %s: %w", path, err)
+	}
+
+	jwks := jose.JSONWebKeySet{}
+	err = json.Unmarshal(b, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key set from %s: %w", path, err)
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		keys = append(keys, k.Public().Key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys found in %s", path)
+	}
+
+	return &oidc.StaticKeySet{PublicKeys: keys}, nil
+}
+
+// NewAuthenticator returns a middleware that requires a valid bearer token on every
+// request and stores the tenants found in the tenantsClaim in the request context.
+// The issuer check is skipped if issuer is empty.
+func NewAuthenticator(ctx context.Context, keys KeySource, issuer, tenantsClaim string) func(http.Handler) http.Handler {
+	logger := logging.GetFromContext(ctx)
+
+	verifier := oidc.NewVerifier(issuer, keys, &oidc.Config{
+		SkipClientIDCheck:    true,
+		SkipIssuerCheck:      issuer == "",
+		SupportedSigningAlgs: []string{oidc.RS256, oidc.RS384, oidc.RS512, oidc.ES256, oidc.ES384, oidc.ES512, oidc.EdDSA},
+	})
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || token == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			idToken, err := verifier.Verify(r.Context(), token)
+			if err != nil {
+				logger.Info("failed to verify bearer token", "err", err.Error())
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			claims := map[string]any{}
+			err = idToken.Claims(&claims)
+			if err != nil {
+				logger.Info("failed to decode token claims", "err", err.Error())
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			ctx := WithAllowedTenants(r.Context(), tenantsFromClaim(claims[tenantsClaim]))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// NewAllowAllAuthenticator returns a middleware that lets every request through
+// with access to all tenants. It is only meant for deployments that have not
+// yet been configured with a key set to verify bearer tokens against.
+func NewAllowAllAuthenticator() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), anyTenantKey{}, true)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func tenantsFromClaim(claim any) []string {
+	tenants := []string{}
+
+	switch c := claim.(type) {
+	case string:
+		tenants = append(tenants, c)
+	case []any:
+		for _, t := range c {
+			if s, ok := t.(string); ok {
+				tenants = append(tenants, s)
+			}
+		}
+	}
+
+	return tenants
+}
+
+type tenantsKey struct{}
+type anyTenantKey struct{}
+
+// WithAllowedTenants returns a copy of ctx that carries the tenants that the caller has access to
+func WithAllowedTenants(ctx context.Context, tenants []string) context.Context {
+	return context.WithValue(ctx, tenantsKey{}, tenants)
+}
+
+// GetAllowedTenantsFromContext returns the tenants that the caller has access to
+func GetAllowedTenantsFromContext(ctx context.Context) []string {
+	tenants, ok := ctx.Value(tenantsKey{}).([]string)
+	if !ok {
+		return []string{}
+	}
+	return tenants
+}
+
+// IsAllowed reports if the caller has access to the given tenant
+func IsAllowed(ctx context.Context, tenant string) bool {
+	if anyTenant, ok := ctx.Value(anyTenantKey{}).(bool); ok && anyTenant {
+		return true
+	}
+	return slices.Contains(GetAllowedTenantsFromContext(ctx), tenant)
+}
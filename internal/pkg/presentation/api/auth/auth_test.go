@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/matryer/is"
+)
+
+func TestValidTokenGivesAccessToTenants(t *testing.T) {
+	is, signer, keys := testSetup(t)
+
+	token := newToken(t, signer, map[string]any{"tenants": []string{"default", "other"}, "exp": time.Now().Add(time.Hour).Unix()})
+
+	var tenants []string
+	handler := NewAuthenticator(context.Background(), keys, "", "tenants")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenants = GetAllowedTenantsFromContext(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest(token))
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(tenants, []string{"default", "other"})
+}
+
+func TestAllowAllAuthenticatorGivesAccessToAnyTenant(t *testing.T) {
+	is := is.New(t)
+
+	allowed := false
+	handler := NewAllowAllAuthenticator()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed = IsAllowed(r.Context(), "default") && IsAllowed(r.Context(), "other")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest(""))
+
+	is.Equal(w.Code, http.StatusOK)
+	is.True(allowed)
+	is.True(!IsAllowed(context.Background(), "default")) // but not outside of the middleware
+}
+
+func TestMissingOrInvalidTokenIsUnauthorized(t *testing.T) {
+	is, signer, keys := testSetup(t)
+
+	handler := NewAuthenticator(context.Background(), keys, "", "tenants")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not have been called")
+	}))
+
+	expired := newToken(t, signer, map[string]any{"tenants": "default", "exp": time.Now().Add(-time.Hour).Unix()})
+
+	otherSigner, _ := newSigner(t)
+	foreign := newToken(t, otherSigner, map[string]any{"tenants": "default", "exp": time.Now().Add(time.Hour).Unix()})
+
+	for _, token := range []string{"", "not-a-jwt", expired, foreign} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(token))
+		is.Equal(w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestIssuerIsVerifiedWhenConfigured(t *testing.T) {
+	is, signer, keys := testSetup(t)
+
+	handler := NewAuthenticator(context.Background(), keys, "https://issuer.example", "tenants")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	token := newToken(t, signer, map[string]any{"iss": "https://other.example", "tenants": "default", "exp": time.Now().Add(time.Hour).Unix()})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest(token))
+	is.Equal(w.Code, http.StatusUnauthorized)
+
+	token = newToken(t, signer, map[string]any{"iss": "https://issuer.example", "tenants": "default", "exp": time.Now().Add(time.Hour).Unix()})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest(token))
+	is.Equal(w.Code, http.StatusOK)
+}
+
+func testSetup(t *testing.T) (*is.I, jose.Signer, KeySource) {
+	is := is.New(t)
+
+	signer, jwks := newSigner(t)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	b, _ := json.Marshal(jwks)
+	is.NoErr(os.WriteFile(path, b, 0600))
+
+	keys, err := NewFileKeySource(path)
+	is.NoErr(err)
+
+	return is, signer, keys
+}
+
+func newSigner(t *testing.T) (jose.Signer, jose.JSONWebKeySet) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: string(jose.ES256), Use: "sig"}},
+	}
+
+	return signer, jwks
+}
+
+func newToken(t *testing.T, signer jose.Signer, claims map[string]any) string {
+	payload, _ := json.Marshal(claims)
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func newRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/functions", nil)
+	if token != "" {
+		r.Header.Set("Authorization", strings.Join([]string{"Bearer", token}, " "))
+	}
+	return r
+}
@@ -3,13 +3,17 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/diwise/iot-core/internal/pkg/application/functions"
+	"github.com/diwise/iot-core/internal/pkg/presentation/api/auth"
+	"github.com/diwise/iot-device-mgmt/pkg/client"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
@@ -19,6 +23,63 @@ import (
 
 var tracer = otel.Tracer("iot-core/api")
 
+var errForbidden = errors.New("access to function is not allowed")
+var errUnknownSensor = errors.New("unknown sensor")
+var errUnknownSource = errors.New("unknown source function")
+
+// checkBindings verifies that the sensors and the source functions that the
+// function is bound to belong to the tenant of the function
+func checkBindings(ctx context.Context, registry functions.Registry, devices client.DeviceManagementClient, s functions.Setting) error {
+	err := checkSensors(ctx, devices, s)
+	if err != nil {
+		return err
+	}
+
+	return checkSources(ctx, registry, s)
+}
+
+// checkSensors verifies that the sensors that the function is bound to belong to
+// the tenant of the function, so that a function can not be used to read the
+// measurements of sensors that belong to another tenant
+func checkSensors(ctx context.Context, devices client.DeviceManagementClient, s functions.Setting) error {
+	for _, sensorID := range s.SensorIDs() {
+		device, err := devices.FindDeviceFromInternalID(ctx, sensorID)
+		if err != nil {
+			if errors.Is(err, client.ErrNotFound) {
+				return fmt.Errorf("%w: %s", errUnknownSensor, sensorID)
+			}
+			return fmt.Errorf("failed to look up sensor %s: %w", sensorID, err)
+		}
+
+		if device.Tenant() != s.Tenant {
+			return fmt.Errorf("%w: sensor %s belongs to another tenant", errForbidden, sensorID)
+		}
+	}
+
+	return nil
+}
+
+// checkSources verifies that the functions that a composite function combines
+// the values of exist and belong to the tenant of the composite, so that a
+// composite can not be used to read the values of another tenant
+func checkSources(ctx context.Context, registry functions.Registry, s functions.Setting) error {
+	for _, sourceID := range s.SourceIDs() {
+		source, err := registry.Get(ctx, sourceID)
+		if err != nil {
+			if errors.Is(err, functions.ErrNotFound) {
+				return fmt.Errorf("%w: %s", errUnknownSource, sourceID)
+			}
+			return fmt.Errorf("failed to look up source function %s: %w", sourceID, err)
+		}
+
+		if source.Tenant() != s.Tenant {
+			return fmt.Errorf("%w: source function %s belongs to another tenant", errForbidden, sourceID)
+		}
+	}
+
+	return nil
+}
+
 func NewQueryFunctionsHandler(ctx context.Context, registry functions.Registry) http.HandlerFunc {
 	logger := logging.GetFromContext(ctx)
 
@@ -33,14 +94,74 @@ func NewQueryFunctionsHandler(ctx context.Context, registry functions.Registry)
 
 		log.Debug("functions requested")
 
-		functions, _ := registry.Find(ctx, functions.MatchAll())
-		b, _ := json.MarshalIndent(functions, "  ", "  ")
+		matchers, err := matchersFromQuery(r)
+		if err != nil {
+			log.Error("bad request", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		matches, _ := registry.Find(ctx, matchers...)
+
+		allowed := make([]functions.Function, 0, len(matches))
+		for _, f := range matches {
+			if auth.IsAllowed(ctx, f.Tenant()) {
+				allowed = append(allowed, f)
+			}
+		}
+
+		b, _ := json.MarshalIndent(allowed, "  ", "  ")
 
 		w.WriteHeader(http.StatusOK)
 		w.Write(b)
 	}
 }
 
+func matchersFromQuery(r *http.Request) ([]functions.RegistryMatcherFunc, error) {
+	matchers := []functions.RegistryMatcherFunc{functions.MatchAll()}
+
+	if fnType := queryUnescapeQueryStr(r, "type"); fnType != "" {
+		matchers = append(matchers, functions.MatchType(fnType))
+	}
+
+	if subType := queryUnescapeQueryStr(r, "subtype"); subType != "" {
+		matchers = append(matchers, functions.MatchSubType(subType))
+	}
+
+	if tenant := queryUnescapeQueryStr(r, "tenant"); tenant != "" {
+		matchers = append(matchers, functions.MatchTenant(tenant))
+	}
+
+	if source := queryUnescapeQueryStr(r, "source"); source != "" {
+		matchers = append(matchers, functions.MatchSource(source))
+	}
+
+	if bbox := queryUnescapeQueryStr(r, "bbox"); bbox != "" {
+		// bbox follows the GeoJSON order of minLon,minLat,maxLon,maxLat
+		coords := strings.Split(bbox, ",")
+		if len(coords) != 4 {
+			return nil, fmt.Errorf("bbox must contain four comma separated coordinates")
+		}
+
+		values := make([]float64, len(coords))
+		for i, c := range coords {
+			v, err := strconv.ParseFloat(strings.TrimSpace(c), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bbox contains an invalid coordinate %q", c)
+			}
+			values[i] = v
+		}
+
+		if values[0] > values[2] || values[1] > values[3] {
+			return nil, fmt.Errorf("bbox must be given as minLon,minLat,maxLon,maxLat")
+		}
+
+		matchers = append(matchers, functions.MatchWithinBoundingBox(values[1], values[0], values[3], values[2]))
+	}
+
+	return matchers, nil
+}
+
 func NewQueryFunctionHistoryHandler(ctx context.Context, registry functions.Registry) http.HandlerFunc {
 	logger := logging.GetFromContext(ctx)
 
@@ -68,28 +189,64 @@ func NewQueryFunctionHistoryHandler(ctx context.Context, registry functions.Regi
 			return
 		}
 
-		lastN := queryUnescapeQueryInt(r, "lastN")
+		if !auth.IsAllowed(ctx, function.Tenant()) {
+			err = errForbidden
+			log.Info("access denied", "function_id", functionID, "tenant", function.Tenant())
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
 		label := queryUnescapeQueryStr(r, "label")
 
-		history, _ := function.History(ctx, label, lastN)
-		st := time.Time{}
-		et := time.Now().UTC()
+		var historyResponse HistoryResponse
+
+		if isTemporalQuery(r) {
+			var q functions.HistoryQuery
+			q, err = parseHistoryQuery(r)
+			if err != nil {
+				log.Error("bad request", "err", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			q.Label = label
 
-		if len(history) > 0 {
-			st = history[0].Timestamp
-			et = history[len(history)-1].Timestamp
+			var result functions.HistoryResult
+			result, err = function.QueryHistory(ctx, q)
+			if err != nil {
+				log.Error("failed to query history", "err", err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			historyResponse = newTemporalHistoryResponse(q, result)
+			if q.Aggregate != "" {
+				historyResponse.Interval = queryUnescapeQueryStr(r, "interval")
+			}
+		} else {
+			lastN := queryUnescapeQueryInt(r, "lastN")
+
+			history, _ := function.History(ctx, label, lastN)
+			st := time.Time{}
+			et := time.Now().UTC()
+
+			if len(history) > 0 {
+				st = history[0].Timestamp
+				et = history[len(history)-1].Timestamp
+			}
+
+			historyResponse = HistoryResponse{
+				StartTime: st,
+				EndTime:   et,
+				Values:    history,
+			}
 		}
 
 		response := struct {
 			ID      string          `json:"id"`
 			History HistoryResponse `json:"history"`
 		}{
-			ID: function.ID(),
-			History: HistoryResponse{
-				StartTime: st,
-				EndTime:   et,
-				Values:    history,
-			},
+			ID:      function.ID(),
+			History: historyResponse,
 		}
 
 		b, _ := json.MarshalIndent(response, "  ", "  ")
@@ -98,6 +255,410 @@ func NewQueryFunctionHistoryHandler(ctx context.Context, registry functions.Regi
 		w.Write(b)
 	}
 }
+
+func isTemporalQuery(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("timeAt") || q.Has("endTimeAt") || q.Has("timeRel") || q.Has("aggr") || q.Has("interval")
+}
+
+func parseHistoryQuery(r *http.Request) (functions.HistoryQuery, error) {
+	var err error
+	q := functions.HistoryQuery{}
+
+	timeAt := queryUnescapeQueryStr(r, "timeAt")
+	if timeAt == "" {
+		return q, fmt.Errorf("timeAt is required for temporal queries")
+	}
+
+	q.TimeAt, err = time.Parse(time.RFC3339, timeAt)
+	if err != nil {
+		return q, fmt.Errorf("timeAt is not a valid RFC3339 timestamp: %w", err)
+	}
+
+	if endTimeAt := queryUnescapeQueryStr(r, "endTimeAt"); endTimeAt != "" {
+		q.EndTimeAt, err = time.Parse(time.RFC3339, endTimeAt)
+		if err != nil {
+			return q, fmt.Errorf("endTimeAt is not a valid RFC3339 timestamp: %w", err)
+		}
+	}
+
+	q.TimeRel = queryUnescapeQueryStr(r, "timeRel")
+	if q.TimeRel == "" {
+		q.TimeRel = "after"
+		if !q.EndTimeAt.IsZero() {
+			q.TimeRel = "between"
+		}
+	}
+
+	switch q.TimeRel {
+	case "before", "after":
+		if !q.EndTimeAt.IsZero() {
+			return q, fmt.Errorf("endTimeAt is only allowed when timeRel is between")
+		}
+	case "between":
+		if q.EndTimeAt.IsZero() {
+			return q, fmt.Errorf("endTimeAt is required when timeRel is between")
+		}
+		if !q.EndTimeAt.After(q.TimeAt) {
+			return q, fmt.Errorf("endTimeAt must be after timeAt")
+		}
+	default:
+		return q, fmt.Errorf("timeRel must be one of before, after or between")
+	}
+
+	q.Aggregate = queryUnescapeQueryStr(r, "aggr")
+	if q.Aggregate != "" && !functions.IsSupportedAggregate(q.Aggregate) {
+		return q, fmt.Errorf("aggr must be one of avg, min, max, sum, count, first or last")
+	}
+
+	if interval := queryUnescapeQueryStr(r, "interval"); interval != "" {
+		q.Interval, err = parseInterval(interval)
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if q.Aggregate != "" && q.Interval == 0 {
+		return q, fmt.Errorf("interval is required when aggr is set")
+	}
+
+	if q.Aggregate == "" && q.Interval != 0 {
+		return q, fmt.Errorf("aggr is required when interval is set")
+	}
+
+	q.Offset, err = queryIntOrDefault(r, "offset", 0)
+	if err != nil || q.Offset < 0 {
+		return q, fmt.Errorf("offset must be a non-negative integer")
+	}
+
+	q.Limit, err = queryIntOrDefault(r, "limit", functions.DefaultHistoryLimit)
+	if err != nil || q.Limit <= 0 || q.Limit > functions.DefaultHistoryLimit {
+		return q, fmt.Errorf("limit must be an integer between 1 and %d", functions.DefaultHistoryLimit)
+	}
+
+	return q, nil
+}
+
+// parseInterval parses a bucket interval such as 5m, 1h or 1d. Apart from
+// the units supported by time.ParseDuration a whole number of days is allowed.
+func parseInterval(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("interval must be a duration of at least one second, such as 5m, 1h or 1d")
+	}
+
+	return d, nil
+}
+
+func newTemporalHistoryResponse(q functions.HistoryQuery, result functions.HistoryResult) HistoryResponse {
+	st, et := q.TimeAt, q.EndTimeAt
+
+	switch q.TimeRel {
+	case "before":
+		st, et = time.Time{}, q.TimeAt
+		if len(result.Values) > 0 {
+			st = result.Values[0].Timestamp
+		}
+	case "after":
+		et = time.Now().UTC()
+		if len(result.Values) > 0 {
+			et = result.Values[len(result.Values)-1].Timestamp
+		}
+	}
+
+	return HistoryResponse{
+		StartTime: st,
+		EndTime:   et,
+		Values:    result.Values,
+		Aggregate: q.Aggregate,
+		Pagination: &Pagination{
+			Offset:     result.Offset,
+			Limit:      result.Limit,
+			Count:      len(result.Values),
+			TotalCount: result.TotalCount,
+		},
+	}
+}
+
+func NewCreateFunctionHandler(ctx context.Context, registry functions.Registry, devices client.DeviceManagementClient) http.HandlerFunc {
+	logger := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer r.Body.Close()
+
+		ctx, span := tracer.Start(r.Context(), "create-function")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		_, ctx, log := o11y.AddTraceIDToLoggerAndStoreInContext(span, logger, ctx)
+
+		setting := functions.Setting{}
+		err = json.NewDecoder(r.Body).Decode(&setting)
+		if err != nil {
+			log.Error("failed to decode function setting", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if setting.Tenant == "" {
+			setting.Tenant = functions.DefaultTenant
+		}
+
+		if !auth.IsAllowed(ctx, setting.Tenant) {
+			err = errForbidden
+			log.Info("access denied", "tenant", setting.Tenant)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		err = checkBindings(ctx, registry, devices, setting)
+		if err != nil {
+			log.Info("invalid sensors or sources", "tenant", setting.Tenant, "err", err.Error())
+			w.WriteHeader(statusCodeFromError(err))
+			return
+		}
+
+		function, err := registry.Add(ctx, setting)
+		if err != nil {
+			log.Error("failed to add function", "err", err.Error())
+			w.WriteHeader(statusCodeFromError(err))
+			return
+		}
+
+		b, _ := json.MarshalIndent(function, "  ", "  ")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/api/functions/"+url.PathEscape(function.ID()))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+}
+
+func NewUpdateFunctionHandler(ctx context.Context, registry functions.Registry, devices client.DeviceManagementClient) http.HandlerFunc {
+	logger := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer r.Body.Close()
+
+		ctx, span := tracer.Start(r.Context(), "update-function")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		_, ctx, log := o11y.AddTraceIDToLoggerAndStoreInContext(span, logger, ctx)
+
+		functionID, _ := url.QueryUnescape(chi.URLParam(r, "id"))
+
+		setting := functions.Setting{}
+		err = json.NewDecoder(r.Body).Decode(&setting)
+		if err != nil {
+			log.Error("failed to decode function setting", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if setting.ID == "" {
+			setting.ID = functionID
+		}
+
+		if setting.ID != functionID {
+			err = fmt.Errorf("function id in body (%s) does not match id in path (%s)", setting.ID, functionID)
+			log.Error("bad request", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		existing, err := registry.Get(ctx, functionID)
+		if err != nil {
+			log.Error("not found", "err", err.Error())
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if setting.Tenant == "" {
+			setting.Tenant = existing.Tenant()
+		}
+
+		if !auth.IsAllowed(ctx, existing.Tenant()) || !auth.IsAllowed(ctx, setting.Tenant) {
+			err = errForbidden
+			log.Info("access denied", "function_id", functionID, "tenant", existing.Tenant())
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		err = checkBindings(ctx, registry, devices, setting)
+		if err != nil {
+			log.Info("invalid sensors or sources", "function_id", functionID, "tenant", setting.Tenant, "err", err.Error())
+			w.WriteHeader(statusCodeFromError(err))
+			return
+		}
+
+		function, err := registry.Update(ctx, setting)
+		if err != nil {
+			log.Error("failed to update function", "err", err.Error())
+			w.WriteHeader(statusCodeFromError(err))
+			return
+		}
+
+		b, _ := json.MarshalIndent(function, "  ", "  ")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func NewPatchFunctionHandler(ctx context.Context, registry functions.Registry, devices client.DeviceManagementClient) http.HandlerFunc {
+	logger := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer r.Body.Close()
+
+		ctx, span := tracer.Start(r.Context(), "patch-function")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		_, ctx, log := o11y.AddTraceIDToLoggerAndStoreInContext(span, logger, ctx)
+
+		functionID, _ := url.QueryUnescape(chi.URLParam(r, "id"))
+
+		function, err := registry.Get(ctx, functionID)
+		if err != nil {
+			log.Error("not found", "err", err.Error())
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !auth.IsAllowed(ctx, function.Tenant()) {
+			err = errForbidden
+			log.Info("access denied", "function_id", functionID, "tenant", function.Tenant())
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		patch := struct {
+			Name     *string `json:"name"`
+			SubType  *string `json:"subtype"`
+			SensorID *string `json:"sensorID"`
+			OnUpdate *bool   `json:"onupdate"`
+			Args     *string `json:"args"`
+		}{}
+
+		err = json.NewDecoder(r.Body).Decode(&patch)
+		if err != nil {
+			log.Error("failed to decode function patch", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		setting := function.Setting()
+		if setting.Tenant == "" {
+			setting.Tenant = function.Tenant()
+		}
+
+		if patch.Name != nil {
+			setting.Name = *patch.Name
+		}
+		if patch.SubType != nil {
+			setting.SubType = *patch.SubType
+		}
+		if patch.SensorID != nil {
+			setting.SensorID = *patch.SensorID
+		}
+		if patch.OnUpdate != nil {
+			setting.OnUpdate = *patch.OnUpdate
+		}
+		if patch.Args != nil {
+			setting.Args = *patch.Args
+		}
+
+		if patch.SensorID != nil || patch.Args != nil {
+			err = checkBindings(ctx, registry, devices, setting)
+			if err != nil {
+				log.Info("invalid sensors or sources", "function_id", functionID, "tenant", setting.Tenant, "err", err.Error())
+				w.WriteHeader(statusCodeFromError(err))
+				return
+			}
+		}
+
+		function, err = registry.Update(ctx, setting)
+		if err != nil {
+			log.Error("failed to patch function", "err", err.Error())
+			w.WriteHeader(statusCodeFromError(err))
+			return
+		}
+
+		b, _ := json.MarshalIndent(function, "  ", "  ")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func NewDeleteFunctionHandler(ctx context.Context, registry functions.Registry) http.HandlerFunc {
+	logger := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer r.Body.Close()
+
+		ctx, span := tracer.Start(r.Context(), "delete-function")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		_, ctx, log := o11y.AddTraceIDToLoggerAndStoreInContext(span, logger, ctx)
+
+		functionID, _ := url.QueryUnescape(chi.URLParam(r, "id"))
+
+		function, err := registry.Get(ctx, functionID)
+		if err != nil {
+			log.Error("not found", "err", err.Error())
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !auth.IsAllowed(ctx, function.Tenant()) {
+			err = errForbidden
+			log.Info("access denied", "function_id", functionID, "tenant", function.Tenant())
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		err = registry.Remove(ctx, functionID)
+		if err != nil {
+			log.Error("failed to remove function", "err", err.Error())
+			w.WriteHeader(statusCodeFromError(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func statusCodeFromError(err error) int {
+	switch {
+	case errors.Is(err, functions.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, functions.ErrAlreadyExists), errors.Is(err, functions.ErrConfigured):
+		return http.StatusConflict
+	case errors.Is(err, functions.ErrInvalidSetting), errors.Is(err, errUnknownSensor), errors.Is(err, errUnknownSource):
+		return http.StatusBadRequest
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func queryUnescapeQueryStr(r *http.Request, key string) string {
 	q, err := url.QueryUnescape(r.URL.Query().Get(key))
 	if err != nil {
@@ -106,6 +667,14 @@ func queryUnescapeQueryStr(r *http.Request, key string) string {
 	return q
 }
 
+func queryIntOrDefault(r *http.Request, key string, defaultValue int) (int, error) {
+	q := queryUnescapeQueryStr(r, key)
+	if q == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(q)
+}
+
 func queryUnescapeQueryInt(r *http.Request, key string) int {
 	q, err := url.QueryUnescape(r.URL.Query().Get(key))
 	if err != nil {
@@ -122,4 +691,15 @@ type HistoryResponse struct {
 	StartTime time.Time            `json:"startTime"`
 	EndTime   time.Time            `json:"endTime"`
 	Values    []functions.LogValue `json:"values"`
+	Aggregate string               `json:"aggr,omitempty"`
+	Interval  string               `json:"interval,omitempty"`
+
+	Pagination *Pagination `json:"pagination,omitempty"`
+}
+
+type Pagination struct {
+	Offset     int   `json:"offset"`
+	Limit      int   `json:"limit"`
+	Count      int   `json:"count"`
+	TotalCount int64 `json:"totalCount"`
 }